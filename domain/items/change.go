@@ -0,0 +1,9 @@
+package items
+
+// PriceChange is a price set for an item, it is scheduled when it has a Window
+// and replaces the item price otherwise
+type PriceChange struct {
+	ItemCode string
+	Price    Price
+	Window   *Window
+}
@@ -0,0 +1,13 @@
+package items
+
+import "time"
+
+// PriceRecord is a price an item had from EffectiveAt until the next record
+type PriceRecord struct {
+	Price       Price
+	EffectiveAt time.Time
+	// Actor is who set the price
+	Actor string
+	// Deleted records that the item price was deleted, Price is empty then
+	Deleted bool
+}
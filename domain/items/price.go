@@ -0,0 +1,49 @@
+package items
+
+import (
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+)
+
+// Price is the price of an item in a currency
+type Price struct {
+	Amount   money.Amount
+	Currency money.Currency
+	// Conversion is the exchange rate applied when the price was converted
+	// from the item currency, nil for prices in their own currency
+	Conversion *money.ExchangeRate
+	// ValidUntil is when the price stops being effective because its window ends
+	// or a scheduled price starts, zero when no change is scheduled
+	ValidUntil time.Time
+	// LoadedAt is when the price was read from the storage, zero if it is unknown
+	LoadedAt time.Time
+	// Version is the version of the item row the price was read from, it grows every time
+	// the item price is set or deleted
+	Version int64
+}
+
+// NewPrice builds a price in its own currency
+func NewPrice(amount money.Amount, currency money.Currency) Price {
+	return Price{Amount: amount, Currency: currency}
+}
+
+// ConvertWith converts the price using an exchange rate from its currency
+func (p Price) ConvertWith(rate money.ExchangeRate) Price {
+	return Price{
+		Amount:     rate.Convert(p.Amount),
+		Currency:   rate.To,
+		Conversion: &rate,
+		ValidUntil: p.ValidUntil,
+		LoadedAt:   p.LoadedAt,
+		Version:    p.Version,
+	}
+}
+
+// Age returns how long ago the price was read from the storage, 0 if it is unknown
+func (p Price) Age(now time.Time) time.Duration {
+	if p.LoadedAt.IsZero() || now.Before(p.LoadedAt) {
+		return 0
+	}
+	return now.Sub(p.LoadedAt)
+}
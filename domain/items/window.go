@@ -0,0 +1,36 @@
+package items
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInvalidWindow is returned when a window ends before it starts or is already over
+var ErrInvalidWindow = errors.New("invalid window")
+
+// Window is the period a scheduled price is effective, from From (inclusive) until To (exclusive).
+// A zero To means the price is effective until another price replaces it.
+type Window struct {
+	From time.Time
+	To   time.Time
+}
+
+// NewWindow validates a window, a nil from means it starts now and a nil to means it never ends
+func NewWindow(from, to *time.Time, now time.Time) (Window, error) {
+	w := Window{From: now}
+	if from != nil {
+		w.From = *from
+	}
+	if to != nil {
+		w.To = *to
+		if !w.To.After(w.From) || !w.To.After(now) {
+			return Window{}, ErrInvalidWindow
+		}
+	}
+	return w, nil
+}
+
+// Contains tells if the window is effective at t
+func (w Window) Contains(t time.Time) bool {
+	return !t.Before(w.From) && (w.To.IsZero() || t.Before(w.To))
+}
@@ -0,0 +1,40 @@
+package items
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewWindow(t *testing.T) {
+	now := time.Now()
+	from := now.Add(time.Hour)
+	to := now.Add(2 * time.Hour)
+
+	w, err := NewWindow(nil, nil, now)
+	assert.Nil(t, err)
+	assert.Equal(t, Window{From: now}, w)
+
+	w, err = NewWindow(&from, &to, now)
+	assert.Nil(t, err)
+	assert.Equal(t, Window{From: from, To: to}, w)
+
+	_, err = NewWindow(&to, &from, now)
+	assert.Equal(t, ErrInvalidWindow, err)
+
+	past := now.Add(-time.Hour)
+	_, err = NewWindow(nil, &past, now)
+	assert.Equal(t, ErrInvalidWindow, err)
+}
+
+func TestWindow_Contains(t *testing.T) {
+	now := time.Now()
+	w := Window{From: now, To: now.Add(time.Hour)}
+
+	assert.True(t, w.Contains(now))
+	assert.True(t, w.Contains(now.Add(time.Minute)))
+	assert.False(t, w.Contains(now.Add(time.Hour)))
+	assert.False(t, w.Contains(now.Add(-time.Minute)))
+	assert.True(t, Window{From: now}.Contains(now.Add(24*time.Hour)))
+}
@@ -0,0 +1,33 @@
+package money
+
+import (
+	"errors"
+	"strings"
+)
+
+// DefaultCurrency is used for prices created without an explicit currency
+const DefaultCurrency Currency = "USD"
+
+// ErrInvalidCurrency is returned when a value is not an ISO 4217 alphabetic code
+var ErrInvalidCurrency = errors.New("invalid currency")
+
+// Currency is an ISO 4217 alphabetic currency code, e.g. "USD"
+type Currency string
+
+// ParseCurrency validates and normalizes a currency code, "usd" becomes "USD"
+func ParseCurrency(s string) (Currency, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) != 3 {
+		return "", ErrInvalidCurrency
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return "", ErrInvalidCurrency
+		}
+	}
+	return Currency(s), nil
+}
+
+func (c Currency) String() string {
+	return string(c)
+}
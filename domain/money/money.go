@@ -0,0 +1,181 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Scale is the number of fractional digits an Amount keeps.
+const Scale = 2
+
+const centsPerUnit = 100
+
+var (
+	// ErrInvalidAmount is returned when a value can not be read as a decimal number
+	ErrInvalidAmount = errors.New("invalid amount")
+	// ErrPrecision is returned when a value has more fractional digits than Scale
+	ErrPrecision = errors.New("amount has more than two fractional digits")
+
+	errExcessPrecision = errors.New("too many fractional digits")
+)
+
+// Amount is an exact decimal with two fractional digits, stored as an integer
+// number of cents so prices never drift the way float64 values do.
+//
+// Rounding rules: values read from clients, Postgres or Redis are never rounded,
+// Parse rejects them when they carry more precision than Scale. Derived values,
+// such as currency conversions, are rounded with Round, half away from zero.
+type Amount int64
+
+// FromCents builds an amount from its number of cents
+func FromCents(cents int64) Amount {
+	return Amount(cents)
+}
+
+// Parse reads a decimal string like "19.99", "-3" or "0.5" without rounding
+func Parse(s string) (Amount, error) {
+	cents, err := parseFixed(s, Scale)
+	if err == errExcessPrecision {
+		return 0, ErrPrecision
+	}
+	return Amount(cents), err
+}
+
+// parseFixed reads a decimal string as an integer scaled by 10^scale
+func parseFixed(s string, scale int) (int64, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	if negative {
+		s = s[1:]
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+
+	units, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		units, fraction = s[:i], s[i+1:]
+	}
+	if units == "" && fraction == "" || !isDigits(units) || !isDigits(fraction) {
+		return 0, ErrInvalidAmount
+	}
+	if len(fraction) > scale {
+		if strings.Trim(fraction[scale:], "0") != "" {
+			return 0, errExcessPrecision
+		}
+		fraction = fraction[:scale]
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+
+	v, err := strconv.ParseInt(units+fraction, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidAmount
+	}
+	if negative {
+		v = -v
+	}
+	return v, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// MustParse is like Parse but panics if the value is invalid
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// Round converts an arbitrary precision number to an amount, rounding half away from zero
+func Round(r *big.Rat) Amount {
+	cents := new(big.Rat).Mul(r, big.NewRat(centsPerUnit, 1))
+	q, m := new(big.Int).QuoRem(cents.Num(), cents.Denom(), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(m), big.NewInt(2)).Cmp(cents.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(cents.Sign())))
+	}
+	return Amount(q.Int64())
+}
+
+// Cents returns the amount as an integer number of cents
+func (a Amount) Cents() int64 {
+	return int64(a)
+}
+
+// Rat returns the amount as an arbitrary precision number
+func (a Amount) Rat() *big.Rat {
+	return big.NewRat(int64(a), centsPerUnit)
+}
+
+// String formats the amount with exactly two fractional digits, e.g. "19.99"
+func (a Amount) String() string {
+	sign := ""
+	cents := int64(a)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/centsPerUnit, cents%centsPerUnit)
+}
+
+// MarshalJSON encodes the amount as a fixed scale number, e.g. 5.00
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON accepts a json number or a string holding a number
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Scan reads a NUMERIC column, which the postgres driver hands over as text
+func (a *Amount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return a.scanString(string(v))
+	case string:
+		return a.scanString(v)
+	case int64:
+		*a = Amount(v * centsPerUnit)
+		return nil
+	default:
+		return fmt.Errorf("can not scan %T into money.Amount", src)
+	}
+}
+
+func (a *Amount) scanString(s string) error {
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Value writes the amount as a decimal string so the database never sees a float
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
@@ -0,0 +1,111 @@
+package money
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]Amount{
+		"19.99":  1999,
+		"0.1":    10,
+		"5":      500,
+		"-3.50":  -350,
+		"+2.00":  200,
+		".25":    25,
+		"10.500": 1050,
+	}
+	for s, expected := range cases {
+		a, err := Parse(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, a, s)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	_, err := Parse("19.999")
+	assert.Equal(t, ErrPrecision, err)
+
+	for _, s := range []string{"", ".", "abc", "1e3", "1/2", "--1", "1.2.3", "99999999999999999999"} {
+		_, err := Parse(s)
+		assert.Equal(t, ErrInvalidAmount, err, s)
+	}
+}
+
+func TestAmount_NoFloatDrift(t *testing.T) {
+	sum := MustParse("0.1") + MustParse("0.2")
+	assert.Equal(t, "0.30", sum.String())
+}
+
+func TestAmount_String(t *testing.T) {
+	assert.Equal(t, "19.99", MustParse("19.99").String())
+	assert.Equal(t, "5.00", MustParse("5").String())
+	assert.Equal(t, "-0.05", MustParse("-0.05").String())
+}
+
+func TestRound_HalfAwayFromZero(t *testing.T) {
+	assert.Equal(t, MustParse("0.13"), Round(big.NewRat(125, 1000)))
+	assert.Equal(t, MustParse("0.12"), Round(big.NewRat(1249, 10000)))
+	assert.Equal(t, MustParse("-0.13"), Round(big.NewRat(-125, 1000)))
+	assert.Equal(t, MustParse("0.33"), Round(big.NewRat(1, 3)))
+}
+
+func TestAmount_JSON(t *testing.T) {
+	b, err := json.Marshal(struct {
+		Price Amount `json:"price"`
+	}{MustParse("5")})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"price":5.00}`, string(b))
+
+	var v struct {
+		Price Amount `json:"price"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(`{"price":19.99}`), &v))
+	assert.Equal(t, MustParse("19.99"), v.Price)
+	assert.Nil(t, json.Unmarshal([]byte(`{"price":"4.5"}`), &v))
+	assert.Equal(t, MustParse("4.50"), v.Price)
+	assert.Equal(t, ErrPrecision, json.Unmarshal([]byte(`{"price":0.001}`), &v))
+}
+
+func TestAmount_Scan(t *testing.T) {
+	var a Amount
+	assert.Nil(t, a.Scan([]byte("19.99")))
+	assert.Equal(t, MustParse("19.99"), a)
+	assert.NotNil(t, a.Scan(1.5))
+
+	v, err := MustParse("3.1").Value()
+	assert.Nil(t, err)
+	assert.Equal(t, "3.10", v)
+}
+
+func TestParseCurrency(t *testing.T) {
+	c, err := ParseCurrency(" eur ")
+	assert.Nil(t, err)
+	assert.Equal(t, Currency("EUR"), c)
+
+	for _, s := range []string{"", "EU", "EURO", "E1R"} {
+		_, err := ParseCurrency(s)
+		assert.Equal(t, ErrInvalidCurrency, err, s)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	r, err := ParseRate("0.8625")
+	assert.Nil(t, err)
+	assert.Equal(t, "0.8625", r.String())
+	assert.Equal(t, "2", MustParseRate("2.000").String())
+
+	for _, s := range []string{"0", "-1", "0.123456789", "abc"} {
+		_, err := ParseRate(s)
+		assert.Equal(t, ErrInvalidRate, err, s)
+	}
+}
+
+func TestExchangeRate_Convert(t *testing.T) {
+	rate := ExchangeRate{From: "USD", To: "EUR", Rate: MustParseRate("0.8625")}
+	assert.Equal(t, MustParse("8.63"), rate.Convert(MustParse("10")))
+	assert.Equal(t, MustParse("17.24"), rate.Convert(MustParse("19.99")))
+}
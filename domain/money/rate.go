@@ -0,0 +1,110 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateScale is the number of fractional digits a Rate keeps
+const RateScale = 8
+
+const rateUnit = 100000000
+
+// ErrInvalidRate is returned when an exchange rate is not a positive number with at most eight fractional digits
+var ErrInvalidRate = errors.New("invalid exchange rate")
+
+// Rate is an exact exchange rate with eight fractional digits, e.g. 0.86250000
+type Rate int64
+
+// ParseRate reads a positive decimal string like "0.8625" without rounding
+func ParseRate(s string) (Rate, error) {
+	v, err := parseFixed(s, RateScale)
+	if err != nil || v <= 0 {
+		return 0, ErrInvalidRate
+	}
+	return Rate(v), nil
+}
+
+// MustParseRate is like ParseRate but panics if the value is invalid
+func MustParseRate(s string) Rate {
+	r, err := ParseRate(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Rat returns the rate as an arbitrary precision number
+func (r Rate) Rat() *big.Rat {
+	return big.NewRat(int64(r), rateUnit)
+}
+
+// String formats the rate without trailing zeros, e.g. "0.8625"
+func (r Rate) String() string {
+	s := fmt.Sprintf("%d.%08d", int64(r)/rateUnit, int64(r)%rateUnit)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// MarshalJSON encodes the rate as a json number
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalJSON accepts a json number or a string holding a number
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	v, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+// Scan reads a NUMERIC column
+func (r *Rate) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return fmt.Errorf("can not scan %T into money.Rate", src)
+	}
+	v, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+// Value writes the rate as a decimal string
+func (r Rate) Value() (driver.Value, error) {
+	return r.String(), nil
+}
+
+// ExchangeRate is the rate used to convert amounts From one currency To another
+type ExchangeRate struct {
+	From      Currency
+	To        Currency
+	Rate      Rate
+	UpdatedAt time.Time
+}
+
+// Convert returns the amount in the target currency, rounded half away from zero
+func (e ExchangeRate) Convert(a Amount) Amount {
+	return Round(new(big.Rat).Mul(a.Rat(), e.Rate.Rat()))
+}
@@ -10,6 +10,7 @@ const (
 	InternalErrorCode = iota
 	NotFoundCode
 	BadRequestCode
+	ConflictCode
 )
 
 type CustomError struct {
@@ -36,10 +37,17 @@ func (errMsg CustomError) Error() string {
 }
 
 var (
-	InternalError  = NewCustomError(InternalErrorCode, "Internal server error.")
-	NotFoundItems  = NewCustomError(NotFoundCode, "Items not found: %s.")
-	InvalidItems   = NewCustomError(BadRequestCode, "Invalid items: %s.")
-	AtLeastOneItem = NewCustomError(BadRequestCode, "You must provide at least one item code.")
-	InvalidFormat  = NewCustomError(BadRequestCode, "Request invalid format.")
-	MaxItemsExceded  = NewCustomError(BadRequestCode, "Max items quantity exceded.")
+	InternalError   = NewCustomError(InternalErrorCode, "Internal server error.")
+	NotFoundItems   = NewCustomError(NotFoundCode, "Items not found: %s.")
+	InvalidItems    = NewCustomError(BadRequestCode, "Invalid items: %s.")
+	AtLeastOneItem  = NewCustomError(BadRequestCode, "You must provide at least one item code.")
+	InvalidFormat   = NewCustomError(BadRequestCode, "Request invalid format.")
+	MaxItemsExceded = NewCustomError(BadRequestCode, "Max items quantity exceded.")
+	InvalidPrice    = NewCustomError(BadRequestCode, "Item price must have at most two decimal digits.")
+	InvalidCurrency = NewCustomError(BadRequestCode, "Invalid currency: %s.")
+	InvalidRate     = NewCustomError(BadRequestCode, "Rate must be a positive number with at most eight decimal digits.")
+	RateNotFound    = NewCustomError(BadRequestCode, "Exchange rates not found: %s.")
+	InvalidAsOf     = NewCustomError(BadRequestCode, "as_of must be a RFC3339 timestamp.")
+	InvalidWindow   = NewCustomError(BadRequestCode, "effective_to must be after effective_from and in the future.")
+	WarmUpRunning   = NewCustomError(ConflictCode, "A cache warm-up is already running.")
 )
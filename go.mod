@@ -1,13 +1,15 @@
 module github.com/ldegaetano/go-ddd-example
 
-go 1.13
+go 1.16
 
 require (
-	github.com/gin-gonic/gin v1.6.3
+	github.com/gin-gonic/gin v1.10.1
 	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/jinzhu/gorm v1.9.16
 	github.com/kelseyhightower/envconfig v1.4.0
-	github.com/labstack/gommon v0.3.0
 	github.com/lib/pq v1.8.0
-	github.com/stretchr/testify v1.4.0
+	github.com/stretchr/testify v1.9.0
+	github.com/ugorji/go v1.1.7 // indirect
+	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -0,0 +1,50 @@
+package prices
+
+import (
+	"github.com/ldegaetano/go-ddd-example/metrics"
+	"github.com/ldegaetano/go-ddd-example/repositories/cache"
+)
+
+// breakerStates are the states the breaker state gauge has a value for, 1 for the current one
+var breakerStates = []string{cache.BreakerClosed, cache.BreakerOpen, cache.BreakerHalfOpen}
+
+// RegisterMetrics exports the counters of the service and the cache, the ones of the stats and the health
+// endpoints, as metrics read when they are served. It must be called once.
+func (i PricesHandler) RegisterMetrics() {
+	metrics.NewCounterFunc("cache_lookups_total", "Items looked up in each cache tier by result, hit or miss",
+		func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, t := range i.Cache.Stats() {
+				samples = append(samples,
+					metrics.Sample{LabelValues: []string{t.Tier, "hit"}, Value: float64(t.Hits)},
+					metrics.Sample{LabelValues: []string{t.Tier, "miss"}, Value: float64(t.Misses)})
+			}
+			return samples
+		}, "tier", "result")
+	metrics.NewCounterFunc("prices_collapsed_calls_total", "Item lookups served by a storage call already in flight",
+		func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(i.PricesService.Stats().CollapsedCalls)}}
+		})
+	metrics.NewGaugeFunc("cache_breaker_state", "State of the circuit breaker of each cache tier, 1 for the current one",
+		func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, h := range i.breakersHealth() {
+				for _, state := range breakerStates {
+					value := 0.0
+					if h.State == state {
+						value = 1
+					}
+					samples = append(samples, metrics.Sample{LabelValues: []string{h.Tier, state}, Value: value})
+				}
+			}
+			return samples
+		}, "tier", "state")
+	metrics.NewGaugeFunc("cache_breaker_failures", "Calls in a row that failed to reach each cache tier",
+		func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, h := range i.breakersHealth() {
+				samples = append(samples, metrics.Sample{LabelValues: []string{h.Tier}, Value: float64(h.Failures)})
+			}
+			return samples
+		}, "tier")
+}
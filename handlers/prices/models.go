@@ -1,9 +1,48 @@
 package prices
 
+import (
+	"context"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/errors"
+)
+
 type (
+	// Pinger is a dependency the readiness of the service is checked against
+	Pinger interface {
+		Ping(ctx context.Context) error
+	}
+
+	// errorResponse is an error along with the id of the request it answers
+	errorResponse struct {
+		*errors.CustomError
+		RequestID string `json:"request_id,omitempty"`
+	}
+
 	priceCreate struct {
-		ItemCode  string `json:"item_code" binding:"required,max=5"`
-		ItemPrice float64 `json:"item_price" binding:"required"`
+		ItemCode      string       `json:"item_code" binding:"required,max=5"`
+		ItemPrice     money.Amount `json:"item_price" binding:"required"`
+		Currency      string       `json:"currency"`
+		EffectiveFrom *time.Time   `json:"effective_from"`
+		EffectiveTo   *time.Time   `json:"effective_to"`
+	}
+
+	rateCreate struct {
+		From string     `json:"from" binding:"required"`
+		To   string     `json:"to" binding:"required"`
+		Rate money.Rate `json:"rate" binding:"required"`
+	}
+
+	batchResponse struct {
+		Items []batchResult `json:"items"`
+	}
+
+	batchResult struct {
+		Index    int                 `json:"index"`
+		ItemCode string              `json:"item_code"`
+		Status   int                 `json:"status"`
+		Error    *errors.CustomError `json:"error,omitempty"`
 	}
 
 	pricesResponse struct {
@@ -11,7 +50,79 @@ type (
 	}
 
 	item struct {
-		ItemCode  string  `json:"item_code"`
-		ItemPrice float64 `json:"item_price"`
+		ItemCode      string         `json:"item_code"`
+		ItemPrice     money.Amount   `json:"item_price"`
+		Currency      money.Currency `json:"currency"`
+		Rate          *money.Rate    `json:"rate,omitempty"`
+		RateUpdatedAt *time.Time     `json:"rate_updated_at,omitempty"`
+	}
+
+	historyResponse struct {
+		ItemCode string         `json:"item_code"`
+		History  []historyEntry `json:"history"`
+	}
+
+	// historyEntry has no price when it records a deletion
+	historyEntry struct {
+		ItemPrice   *money.Amount  `json:"item_price"`
+		Currency    money.Currency `json:"currency,omitempty"`
+		EffectiveAt time.Time      `json:"effective_at"`
+		Actor       string         `json:"actor"`
+		Deleted     bool           `json:"deleted,omitempty"`
+	}
+
+	warmUpCreate struct {
+		ItemsCodes []string `json:"items_codes"`
+	}
+
+	warmUpResponse struct {
+		Running    bool       `json:"running"`
+		Batches    int        `json:"batches"`
+		Failed     int        `json:"failed"`
+		Cached     int        `json:"cached"`
+		StartedAt  *time.Time `json:"started_at,omitempty"`
+		FinishedAt *time.Time `json:"finished_at,omitempty"`
+	}
+
+	// healthResponse is degraded while prices are served without some cache tier
+	healthResponse struct {
+		Status string          `json:"status"`
+		Cache  []breakerHealth `json:"cache"`
+	}
+
+	// readinessResponse is unavailable while the storage is down and degraded while only the cache is
+	readinessResponse struct {
+		Status       string             `json:"status"`
+		Dependencies []dependencyStatus `json:"dependencies"`
+		Cache        []breakerHealth    `json:"cache"`
+	}
+
+	dependencyStatus struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	breakerHealth struct {
+		Tier     string     `json:"tier"`
+		State    string     `json:"state"`
+		Failures int        `json:"failures"`
+		OpenedAt *time.Time `json:"opened_at,omitempty"`
+	}
+
+	statsResponse struct {
+		CollapsedCalls uint64      `json:"collapsed_calls"`
+		Cache          []tierStats `json:"cache"`
+	}
+
+	tierStats struct {
+		Tier   string `json:"tier"`
+		Hits   uint64 `json:"hits"`
+		Misses uint64 `json:"misses"`
 	}
 )
+
+func (r *batchResult) setError(status int, err *errors.CustomError) {
+	r.Status = status
+	r.Error = err
+}
@@ -1,91 +1,639 @@
 package prices
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
 	"github.com/ldegaetano/go-ddd-example/errors"
+	"github.com/ldegaetano/go-ddd-example/logging"
 	"github.com/ldegaetano/go-ddd-example/repositories/cache"
 	"github.com/ldegaetano/go-ddd-example/repositories/storage"
 	"github.com/ldegaetano/go-ddd-example/services/prices"
 	"github.com/ldegaetano/go-ddd-example/settings"
+	"github.com/ldegaetano/go-ddd-example/tracing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 const (
 	maxItemsLength  = 5
 	maxItems        = 10
+	maxBatchItems   = 1000
 	itemsCodesParam = "items_codes"
+	currencyParam   = "currency"
+	asOfParam       = "as_of"
+	itemCodeParam   = "item_code"
+	actionParam     = "action"
+	batchAction     = ":batch"
+	actorHeader     = "X-Actor"
+	// cacheStatusHeader tells if the prices were fresh in the cache, stale or read from the storage
+	cacheStatusHeader = "X-Cache-Status"
+	// ageHeader has the seconds since the oldest price was read from the storage
+	ageHeader    = "Age"
+	defaultActor = "anonymous"
+	// health statuses, degraded while prices are read from the database because a cache tier is unreachable
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	// healthUnavailable is reported by the readiness check while prices can not be served at all
+	healthUnavailable = "unavailable"
+	dependencyUp      = "up"
+	dependencyDown    = "down"
+	storageDependency = "postgres"
+	cacheDependency   = "redis"
+	loggerName        = "handlers"
 )
 
 type PricesHandler struct {
 	BasePath      string
 	PricesPath    string
+	ActionPath    string
+	HistoryPath   string
+	RatesPath     string
+	StatsPath     string
+	WarmUpPath    string
+	HealthPath    string
+	LivenessPath  string
+	ReadinessPath string
 	PricesService prices.Service
+	Cache         cache.Repository
+	// Storage is pinged by the readiness check along with the cache
+	Storage Pinger
+	// ReadinessTimeout bounds the ping of each dependency
+	ReadinessTimeout time.Duration
+	// Logger logs the error responses, with the id of the request they answer
+	Logger *logging.Logger
+	// closers are the connections the handler opened, closed by Close
+	closers []io.Closer
 }
 
-func StartHandler() PricesHandler {
-	return PricesHandler{
-		BasePath:   "/api/items",
-		PricesPath: "/prices",
-		PricesService: prices.NewService(
-			storage.New(),
-			cache.New(settings.Redis.DefaultExpiration),
+// StartHandler connects to the storage and the cache in settings, it fails when the storage can not be reached.
+// The handler, the service and the repositories log through logger, each under its own name.
+func StartHandler(logger *logging.Logger) (PricesHandler, error) {
+	pricesStorage, err := storage.New(logger)
+	if err != nil {
+		return PricesHandler{}, err
+	}
+	pricesCache := cache.FromSettings(logger)
+	handler := NewHandler(
+		prices.NewService(
+			pricesStorage,
+			pricesCache,
+			prices.WithBatchSize(settings.Postgres.BatchSize),
+			prices.WithRefreshConcurrency(settings.Redis.RefreshConcurrency),
+			prices.WithWarmUp(settings.Cache.WarmUpBatchSize, settings.Cache.WarmUpInterval),
+			prices.WithLogger(logger),
 		),
+		pricesCache,
+		logger,
+	)
+	handler.Storage = pricesStorage
+	// the service goes first, its background work uses the storage and the cache
+	if closer, ok := handler.PricesService.(io.Closer); ok {
+		handler.closers = append(handler.closers, closer)
+	}
+	handler.closers = append(handler.closers, pricesStorage)
+	if closer, ok := pricesCache.(io.Closer); ok {
+		handler.closers = append(handler.closers, closer)
+	}
+	return handler, nil
+}
+
+// NewHandler serves the prices of the service, reporting the stats and health of the cache
+func NewHandler(service prices.Service, pricesCache cache.Repository, logger *logging.Logger) PricesHandler {
+	return PricesHandler{
+		BasePath:      "/api/items",
+		PricesPath:    "/prices",
+		ActionPath:    "/prices:" + actionParam,
+		HistoryPath:   "/:" + itemCodeParam + "/prices/history",
+		RatesPath:     "/rates",
+		StatsPath:     "/stats",
+		WarmUpPath:    "/cache/warmup",
+		HealthPath:    "/health",
+		LivenessPath:  "/healthz",
+		ReadinessPath: "/readyz",
+		PricesService: service,
+		Cache:         pricesCache,
+		// the storage is only known once connected by StartHandler
+		ReadinessTimeout: settings.Server.ReadinessTimeout,
+		Logger:           logger.Named(loggerName),
+	}
+}
+
+// Close stops the background work of the service and then closes the connections to the storage
+// and the cache opened by StartHandler
+func (i PricesHandler) Close() error {
+	var err error
+	for _, closer := range i.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
 	}
+	return err
 }
 
 func (i PricesHandler) GetPricesFor(c *gin.Context) {
+	span := startSpan(c, "PricesHandler.GetPricesFor")
+	defer endSpan(c, span)
 	itemsStr := c.Query(itemsCodesParam)
 
 	itemsCodes, validateErr := validateItems(itemsStr)
 	if validateErr != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, validateErr)
+		i.abort(c, http.StatusBadRequest, validateErr)
 		return
 	}
 
-	itemsPrices, err := i.PricesService.GetPricesFor(itemsCodes...)
-	if err != nil {
-		if err.Code == errors.NotFoundCode {
-			c.AbortWithStatusJSON(http.StatusNotFound, err)
+	var currency money.Currency
+	if currencyStr := c.Query(currencyParam); currencyStr != "" {
+		parsed, err := money.ParseCurrency(currencyStr)
+		if err != nil {
+			i.abort(c, http.StatusBadRequest, errors.InvalidCurrency.WithParams([]string{currencyStr}))
+			return
+		}
+		currency = parsed
+	}
+	span.SetAttributes(tracing.Int("items.count", len(itemsCodes)), tracing.String("currency", currency.String()))
+
+	var itemsPrices map[string]items.Price
+	var err *errors.CustomError
+	if asOfStr := c.Query(asOfParam); asOfStr != "" {
+		asOf, parseErr := time.Parse(time.RFC3339, asOfStr)
+		if parseErr != nil {
+			i.abort(c, http.StatusBadRequest, errors.InvalidAsOf)
 			return
 		}
-		c.AbortWithStatusJSON(http.StatusInternalServerError, errors.InternalError)
+		itemsPrices, err = i.PricesService.GetPricesAt(c.Request.Context(), asOf, currency, itemsCodes...)
+	} else {
+		var status prices.CacheStatus
+		itemsPrices, status, err = i.PricesService.GetPricesFor(c.Request.Context(), currency, itemsCodes...)
+		c.Header(cacheStatusHeader, string(status))
+		span.SetAttributes(tracing.String("cache.status", string(status)))
+		if age := oldestAge(itemsPrices, time.Now()); age > 0 {
+			c.Header(ageHeader, strconv.FormatInt(int64(age/time.Second), 10))
+		}
+	}
+	if err != nil {
+		i.abortWithError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, buildPricesResponse(itemsPrices))
 }
 
-//SetPricesFor set price to item_code, if exists update the price
+// GetPriceHistory returns every price the item had, newest first
+func (i PricesHandler) GetPriceHistory(c *gin.Context) {
+	itemCode := c.Param(itemCodeParam)
+	if invalids := getInvalidItems([]string{itemCode}); len(invalids) > 0 {
+		i.abort(c, http.StatusBadRequest, errors.InvalidItems.WithParams(invalids))
+		return
+	}
+
+	history, err := i.PricesService.GetPriceHistory(c.Request.Context(), itemCode)
+	if err != nil {
+		i.abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, buildHistoryResponse(itemCode, history))
+}
+
+// SetPricesFor set price to item_code, if exists update the price
 func (i PricesHandler) SetPricesFor(c *gin.Context) {
+	span := startSpan(c, "PricesHandler.SetPricesFor")
+	defer endSpan(c, span)
 	p := priceCreate{}
 
 	if err := c.BindJSON(&p); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, errors.InvalidFormat)
+		i.abort(c, http.StatusBadRequest, bindError(err))
 		return
 	}
 
-	if err := i.PricesService.SetPriceFor(p.ItemCode, p.ItemPrice); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, errors.InternalError)
+	change, validateErr := buildPriceChange(p, time.Now())
+	if validateErr != nil {
+		i.abort(c, http.StatusBadRequest, validateErr)
+		return
+	}
+
+	actor := getActor(c)
+	span.SetAttributes(tracing.String("item.code", change.ItemCode), tracing.Bool("scheduled", change.Window != nil))
+	var err *errors.CustomError
+	if change.Window == nil {
+		err = i.PricesService.SetPriceFor(c.Request.Context(), change.ItemCode, change.Price, actor)
+	} else {
+		err = i.PricesService.SchedulePriceFor(c.Request.Context(), change.ItemCode, change.Price, *change.Window, actor)
+	}
+	if err != nil {
+		i.abort(c, http.StatusInternalServerError, errors.InternalError)
 		return
 	}
 
 	c.Status(http.StatusNoContent)
 }
 
-func buildPricesResponse(itemsPrices map[string]float64) (response pricesResponse) {
+// DeletePricesFor removes the price of the items, they are not found from then on
+func (i PricesHandler) DeletePricesFor(c *gin.Context) {
+	itemsCodes, validateErr := validateItems(c.Query(itemsCodesParam))
+	if validateErr != nil {
+		i.abort(c, http.StatusBadRequest, validateErr)
+		return
+	}
+
+	if err := i.PricesService.DeletePricesFor(c.Request.Context(), itemsCodes, getActor(c)); err != nil {
+		i.abortWithError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// PricesAction serves the custom methods of the prices collection, e.g. "/prices:batch".
+// gin can not route a literal colon so the action is matched as a param here.
+func (i PricesHandler) PricesAction(c *gin.Context) {
+	switch c.Param(actionParam) {
+	case batchAction:
+		i.SetPricesBatch(c)
+	default:
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
+// SetPricesBatch sets many prices at once, every entry follows the same rules as in SetPricesFor.
+// Valid entries are written even if others are invalid, the response has the result of each entry.
+func (i PricesHandler) SetPricesBatch(c *gin.Context) {
+	entries := []json.RawMessage{}
+
+	if err := c.ShouldBindJSON(&entries); err != nil {
+		i.abort(c, http.StatusBadRequest, errors.InvalidFormat)
+		return
+	}
+	if len(entries) == 0 {
+		i.abort(c, http.StatusBadRequest, errors.AtLeastOneItem)
+		return
+	}
+	if len(entries) > maxBatchItems {
+		i.abort(c, http.StatusBadRequest, errors.MaxItemsExceded)
+		return
+	}
+
+	now := time.Now()
+	results := make([]batchResult, len(entries))
+	changes := []items.PriceChange{}
+	positions := []int{}
+	for k, entry := range entries {
+		results[k] = batchResult{Index: k, Status: http.StatusNoContent}
+
+		p := priceCreate{}
+		if err := json.Unmarshal(entry, &p); err != nil {
+			results[k].setError(http.StatusBadRequest, bindError(err))
+			continue
+		}
+		results[k].ItemCode = p.ItemCode
+		if err := binding.Validator.ValidateStruct(p); err != nil {
+			results[k].setError(http.StatusBadRequest, errors.InvalidFormat)
+			continue
+		}
+		change, err := buildPriceChange(p, now)
+		if err != nil {
+			results[k].setError(http.StatusBadRequest, err)
+			continue
+		}
+		changes = append(changes, change)
+		positions = append(positions, k)
+	}
+
+	if len(changes) > 0 {
+		for k, err := range i.PricesService.SetPricesFor(c.Request.Context(), changes, getActor(c)) {
+			if err != nil {
+				results[positions[k]].setError(http.StatusInternalServerError, errors.InternalError)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, batchResponse{Items: results})
+}
+
+// SetRate set the exchange rate between two currencies, if exists update the rate
+func (i PricesHandler) SetRate(c *gin.Context) {
+	r := rateCreate{}
+
+	if err := c.BindJSON(&r); err != nil {
+		if err == money.ErrInvalidRate {
+			i.abort(c, http.StatusBadRequest, errors.InvalidRate)
+			return
+		}
+		i.abort(c, http.StatusBadRequest, errors.InvalidFormat)
+		return
+	}
+
+	from, fromErr := money.ParseCurrency(r.From)
+	to, toErr := money.ParseCurrency(r.To)
+	if fromErr != nil || toErr != nil {
+		i.abort(c, http.StatusBadRequest, errors.InvalidCurrency.WithParams(getInvalidCurrencies(r.From, r.To)))
+		return
+	}
+
+	rate := money.ExchangeRate{From: from, To: to, Rate: r.Rate}
+	if err := i.PricesService.SetRate(c.Request.Context(), rate); err != nil {
+		i.abort(c, http.StatusInternalServerError, errors.InternalError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetStats returns the prices service and cache counters
+func (i PricesHandler) GetStats(c *gin.Context) {
+	stats := i.PricesService.Stats()
+	response := statsResponse{CollapsedCalls: stats.CollapsedCalls, Cache: []tierStats{}}
+	for _, t := range i.Cache.Stats() {
+		response.Cache = append(response.Cache, tierStats{Tier: t.Tier, Hits: t.Hits, Misses: t.Misses})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetHealth returns the state of the cache circuit breakers, degraded while some circuit is not closed
+func (i PricesHandler) GetHealth(c *gin.Context) {
+	response := healthResponse{Status: healthOK}
+	if response.Cache = i.breakersHealth(); !allClosed(response.Cache) {
+		response.Status = healthDegraded
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetLiveness answers as long as the process can serve requests
+func (i PricesHandler) GetLiveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": healthOK})
+}
+
+// GetReadiness pings the storage and the cache. The service is unavailable while the storage is down,
+// and ready but degraded while only the cache is since prices are still read from the storage.
+func (i PricesHandler) GetReadiness(c *gin.Context) {
+	names, pingers := []string{}, []Pinger{}
+	if i.Storage != nil {
+		names, pingers = append(names, storageDependency), append(pingers, i.Storage)
+	}
+	if pinger, ok := i.Cache.(cache.Pinger); ok {
+		names, pingers = append(names, cacheDependency), append(pingers, pinger)
+	}
+
+	response := readinessResponse{Status: healthOK, Dependencies: make([]dependencyStatus, len(pingers))}
+	var wg sync.WaitGroup
+	for k := range pingers {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			response.Dependencies[k] = i.ping(c.Request.Context(), names[k], pingers[k])
+		}(k)
+	}
+	wg.Wait()
+
+	response.Cache = i.breakersHealth()
+	if !allClosed(response.Cache) {
+		response.Status = healthDegraded
+	}
+	for _, d := range response.Dependencies {
+		switch {
+		case d.Status == dependencyUp:
+		case d.Name == storageDependency:
+			response.Status = healthUnavailable
+		case response.Status == healthOK:
+			response.Status = healthDegraded
+		}
+	}
+
+	if response.Status == healthUnavailable {
+		c.JSON(http.StatusServiceUnavailable, response)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ping pings the dependency, giving up after ReadinessTimeout even if the ping is still in flight
+func (i PricesHandler) ping(ctx context.Context, name string, pinger Pinger) dependencyStatus {
+	if i.ReadinessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.ReadinessTimeout)
+		defer cancel()
+	}
+	pinged := make(chan error, 1)
+	go func() { pinged <- pinger.Ping(ctx) }()
+
+	var err error
+	select {
+	case err = <-pinged:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return dependencyStatus{Name: name, Status: dependencyDown, Error: err.Error()}
+	}
+	return dependencyStatus{Name: name, Status: dependencyUp}
+}
+
+func (i PricesHandler) breakersHealth() []breakerHealth {
+	health := []breakerHealth{}
+	if reporter, ok := i.Cache.(cache.HealthReporter); ok {
+		for _, h := range reporter.Health() {
+			b := breakerHealth{Tier: h.Tier, State: h.State, Failures: h.Failures}
+			if !h.OpenedAt.IsZero() {
+				openedAt := h.OpenedAt
+				b.OpenedAt = &openedAt
+			}
+			health = append(health, b)
+		}
+	}
+	return health
+}
+
+func allClosed(health []breakerHealth) bool {
+	for _, h := range health {
+		if h.State != cache.BreakerClosed {
+			return false
+		}
+	}
+	return true
+}
+
+// WarmUpCache starts caching in the background the prices of the items in the body or,
+// without body, of every item. GetWarmUp reports its progress.
+func (i PricesHandler) WarmUpCache(c *gin.Context) {
+	r := warmUpCreate{}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&r); err != nil {
+			i.abort(c, http.StatusBadRequest, errors.InvalidFormat)
+			return
+		}
+	}
+	if len(r.ItemsCodes) > maxBatchItems {
+		i.abort(c, http.StatusBadRequest, errors.MaxItemsExceded)
+		return
+	}
+	if invalids := getInvalidItems(r.ItemsCodes); len(invalids) > 0 {
+		i.abort(c, http.StatusBadRequest, errors.InvalidItems.WithParams(invalids))
+		return
+	}
+
+	if _, err := i.PricesService.WarmUp(c.Request.Context(), r.ItemsCodes); err != nil {
+		i.abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, buildWarmUpResponse(i.PricesService.WarmUpProgress()))
+}
+
+// GetWarmUp returns the progress of the running cache warm-up or else of the last one
+func (i PricesHandler) GetWarmUp(c *gin.Context) {
+	c.JSON(http.StatusOK, buildWarmUpResponse(i.PricesService.WarmUpProgress()))
+}
+
+func buildWarmUpResponse(progress prices.WarmUpProgress) warmUpResponse {
+	response := warmUpResponse{
+		Running: progress.Running,
+		Batches: progress.Batches,
+		Failed:  progress.Failed,
+		Cached:  progress.Cached,
+	}
+	if !progress.StartedAt.IsZero() {
+		response.StartedAt = &progress.StartedAt
+	}
+	if !progress.FinishedAt.IsZero() {
+		response.FinishedAt = &progress.FinishedAt
+	}
+	return response
+}
+
+func buildPricesResponse(itemsPrices map[string]items.Price) (response pricesResponse) {
 	for itemCode, price := range itemsPrices {
-		response.Items = append(response.Items, item{
+		i := item{
 			ItemCode:  itemCode,
-			ItemPrice: price,
-		})
+			ItemPrice: price.Amount,
+			Currency:  price.Currency,
+		}
+		if conversion := price.Conversion; conversion != nil {
+			i.Rate = &conversion.Rate
+			i.RateUpdatedAt = &conversion.UpdatedAt
+		}
+		response.Items = append(response.Items, i)
+	}
+	return
+}
+
+// oldestAge returns the age of the price read from the storage the longest ago
+func oldestAge(itemsPrices map[string]items.Price, now time.Time) (age time.Duration) {
+	for _, p := range itemsPrices {
+		if a := p.Age(now); a > age {
+			age = a
+		}
 	}
 	return
 }
 
-func validateItems(itemsString string) ([]string, error) {
+// buildPriceChange validates a price and turns it into a change, scheduled when it has a window
+func buildPriceChange(p priceCreate, now time.Time) (items.PriceChange, *errors.CustomError) {
+	currency := money.DefaultCurrency
+	if p.Currency != "" {
+		parsed, err := money.ParseCurrency(p.Currency)
+		if err != nil {
+			return items.PriceChange{}, errors.InvalidCurrency.WithParams([]string{p.Currency})
+		}
+		currency = parsed
+	}
+
+	change := items.PriceChange{
+		ItemCode: p.ItemCode,
+		Price:    items.NewPrice(p.ItemPrice, currency),
+	}
+	if p.EffectiveFrom == nil && p.EffectiveTo == nil {
+		return change, nil
+	}
+
+	window, err := items.NewWindow(p.EffectiveFrom, p.EffectiveTo, now)
+	if err != nil {
+		return items.PriceChange{}, errors.InvalidWindow
+	}
+	change.Window = &window
+	return change, nil
+}
+
+// bindError tells apart the price precision error from any other invalid body
+func bindError(err error) *errors.CustomError {
+	if err == money.ErrPrecision {
+		return errors.InvalidPrice
+	}
+	return errors.InvalidFormat
+}
+
+func getActor(c *gin.Context) string {
+	if actor := c.GetHeader(actorHeader); actor != "" {
+		return actor
+	}
+	return defaultActor
+}
+
+func buildHistoryResponse(itemCode string, history []items.PriceRecord) historyResponse {
+	response := historyResponse{ItemCode: itemCode, History: []historyEntry{}}
+	for _, record := range history {
+		entry := historyEntry{
+			EffectiveAt: record.EffectiveAt,
+			Actor:       record.Actor,
+			Deleted:     record.Deleted,
+		}
+		if !record.Deleted {
+			amount := record.Price.Amount
+			entry.ItemPrice = &amount
+			entry.Currency = record.Price.Currency
+		}
+		response.History = append(response.History, entry)
+	}
+	return response
+}
+
+// abort responds the error along with the id of the request, server errors are logged as errors
+// and the rest as debug lines
+func (i PricesHandler) abort(c *gin.Context, status int, err *errors.CustomError) {
+	ctx := c.Request.Context()
+	fields := []logging.Field{logging.F("status", status), logging.Err(err), logging.F("path", c.FullPath())}
+	if status >= http.StatusInternalServerError {
+		i.Logger.Error(ctx, "request_failed", fields...)
+	} else {
+		i.Logger.Debug(ctx, "request_rejected", fields...)
+	}
+	c.AbortWithStatusJSON(status, errorResponse{CustomError: err, RequestID: logging.RequestID(ctx)})
+}
+
+// abortWithError responds the service error with the status matching its code
+func (i PricesHandler) abortWithError(c *gin.Context, err *errors.CustomError) {
+	switch err.Code {
+	case errors.NotFoundCode:
+		i.abort(c, http.StatusNotFound, err)
+	case errors.BadRequestCode:
+		i.abort(c, http.StatusBadRequest, err)
+	case errors.ConflictCode:
+		i.abort(c, http.StatusConflict, err)
+	default:
+		i.abort(c, http.StatusInternalServerError, errors.InternalError)
+	}
+}
+
+func getInvalidCurrencies(currencies ...string) (res []string) {
+	for _, c := range currencies {
+		if _, err := money.ParseCurrency(c); err != nil {
+			res = append(res, c)
+		}
+	}
+	return
+}
+
+func validateItems(itemsString string) ([]string, *errors.CustomError) {
 	itemsCodes := strings.Split(itemsString, ",")
 	totalItems := len(itemsCodes)
 	if len(itemsString) == 0 || totalItems == 0 {
@@ -108,3 +656,20 @@ func getInvalidItems(items []string) (res []string) {
 	}
 	return
 }
+
+// startSpan starts the span of the request, the calls made with its context become children of it
+func startSpan(c *gin.Context, name string) *tracing.Span {
+	ctx, span := tracing.Start(c.Request.Context(), name, tracing.String("http.route", c.FullPath()))
+	c.Request = c.Request.WithContext(ctx)
+	return span
+}
+
+// endSpan ends the span of the request with the status of its response, failed on server errors
+func endSpan(c *gin.Context, span *tracing.Span) {
+	status := c.Writer.Status()
+	span.SetAttributes(tracing.Int("http.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.RecordError(fmt.Errorf("%s", http.StatusText(status)))
+	}
+	span.End()
+}
@@ -1,12 +1,23 @@
 package prices
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
 	"github.com/ldegaetano/go-ddd-example/errors"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/metrics"
+	"github.com/ldegaetano/go-ddd-example/repositories/cache"
+	"github.com/ldegaetano/go-ddd-example/services/prices"
 	"github.com/ldegaetano/go-ddd-example/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -16,42 +27,155 @@ type serviceMock struct {
 	mock.Mock
 }
 
-func (_m *serviceMock) GetPricesFor(itemCode ...string) (map[string]float64, *errors.CustomError) {
+func (_m *serviceMock) GetPricesFor(ctx context.Context, currency money.Currency, itemCode ...string) (map[string]items.Price, prices.CacheStatus, *errors.CustomError) {
 	_va := make([]interface{}, len(itemCode))
 	for _i := range itemCode {
 		_va[_i] = itemCode[_i]
 	}
 	var _ca []interface{}
+	_ca = append(_ca, currency)
 	_ca = append(_ca, _va...)
 	ret := _m.Called(_ca...)
 
-	var r0 map[string]float64
-	if rf, ok := ret.Get(0).(func(...string) map[string]float64); ok {
-		r0 = rf(itemCode...)
+	var r0 map[string]items.Price
+	if rf, ok := ret.Get(0).(func(money.Currency, ...string) map[string]items.Price); ok {
+		r0 = rf(currency, itemCode...)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(map[string]float64)
+			r0 = ret.Get(0).(map[string]items.Price)
 		}
 	}
 
-	var r1 *errors.CustomError
-	if rf, ok := ret.Get(1).(func(...string) *errors.CustomError); ok {
-		r1 = rf(itemCode...)
+	r1 := ret.Get(1).(prices.CacheStatus)
+
+	var r2 *errors.CustomError
+	if rf, ok := ret.Get(2).(func(money.Currency, ...string) *errors.CustomError); ok {
+		r2 = rf(currency, itemCode...)
 	} else {
-		if ret.Get(1) != nil {
-			r1 = ret.Get(1).(*errors.CustomError)
+		if ret.Get(2) != nil {
+			r2 = ret.Get(2).(*errors.CustomError)
 		}
 	}
 
+	return r0, r1, r2
+}
+
+func (_m *serviceMock) GetPricesAt(ctx context.Context, asOf time.Time, currency money.Currency, itemCode ...string) (map[string]items.Price, *errors.CustomError) {
+	_va := make([]interface{}, len(itemCode))
+	for _i := range itemCode {
+		_va[_i] = itemCode[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, asOf, currency)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 map[string]items.Price
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).(map[string]items.Price)
+	}
+
+	var r1 *errors.CustomError
+	if ret.Get(1) != nil {
+		r1 = ret.Get(1).(*errors.CustomError)
+	}
+
 	return r0, r1
 }
 
-func (_m *serviceMock) SetPriceFor(itemCode string, price float64) *errors.CustomError {
-	ret := _m.Called(itemCode, price)
+func (_m *serviceMock) GetPriceHistory(ctx context.Context, itemCode string) ([]items.PriceRecord, *errors.CustomError) {
+	ret := _m.Called(itemCode)
+
+	var r0 []items.PriceRecord
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]items.PriceRecord)
+	}
+
+	var r1 *errors.CustomError
+	if ret.Get(1) != nil {
+		r1 = ret.Get(1).(*errors.CustomError)
+	}
+
+	return r0, r1
+}
+
+func (_m *serviceMock) SetPriceFor(ctx context.Context, itemCode string, price items.Price, actor string) *errors.CustomError {
+	ret := _m.Called(itemCode, price, actor)
+
+	var r0 *errors.CustomError
+	if rf, ok := ret.Get(0).(func(string, items.Price, string) *errors.CustomError); ok {
+		r0 = rf(itemCode, price, actor)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*errors.CustomError)
+		}
+	}
+
+	return r0
+}
+
+func (_m *serviceMock) SetPricesFor(ctx context.Context, changes []items.PriceChange, actor string) []*errors.CustomError {
+	ret := _m.Called(changes, actor)
+
+	var r0 []*errors.CustomError
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]*errors.CustomError)
+	}
+
+	return r0
+}
+
+func (_m *serviceMock) SchedulePriceFor(ctx context.Context, itemCode string, price items.Price, window items.Window, actor string) *errors.CustomError {
+	ret := _m.Called(itemCode, price, window, actor)
 
 	var r0 *errors.CustomError
-	if rf, ok := ret.Get(0).(func(string, float64) *errors.CustomError); ok {
-		r0 = rf(itemCode, price)
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).(*errors.CustomError)
+	}
+
+	return r0
+}
+
+func (_m *serviceMock) DeletePricesFor(ctx context.Context, itemsCode []string, actor string) *errors.CustomError {
+	ret := _m.Called(itemsCode, actor)
+
+	var r0 *errors.CustomError
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).(*errors.CustomError)
+	}
+
+	return r0
+}
+
+func (_m *serviceMock) WarmUp(ctx context.Context, itemsCode []string) (<-chan struct{}, *errors.CustomError) {
+	ret := _m.Called(itemsCode)
+
+	var r1 *errors.CustomError
+	if ret.Get(1) != nil {
+		r1 = ret.Get(1).(*errors.CustomError)
+	}
+
+	return make(chan struct{}), r1
+}
+
+func (_m *serviceMock) WarmUpProgress() prices.WarmUpProgress {
+	ret := _m.Called()
+
+	return ret.Get(0).(prices.WarmUpProgress)
+}
+
+func (_m *serviceMock) Stats() prices.Stats {
+	ret := _m.Called()
+
+	return ret.Get(0).(prices.Stats)
+}
+
+func (_m *serviceMock) SetRate(ctx context.Context, rate money.ExchangeRate) *errors.CustomError {
+	ret := _m.Called(rate)
+
+	var r0 *errors.CustomError
+	if rf, ok := ret.Get(0).(func(money.ExchangeRate) *errors.CustomError); ok {
+		r0 = rf(rate)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*errors.CustomError)
@@ -61,8 +185,12 @@ func (_m *serviceMock) SetPriceFor(itemCode string, price float64) *errors.Custo
 	return r0
 }
 
+func usd(price string) items.Price {
+	return items.NewPrice(money.MustParse(price), money.DefaultCurrency)
+}
+
 func TestGetPricesFor_InvalidItems(t *testing.T) {
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	path := handler.BasePath + handler.PricesPath
 	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=ppppppp")
 
@@ -71,7 +199,7 @@ func TestGetPricesFor_InvalidItems(t *testing.T) {
 }
 
 func TestGetPricesFor_AtLeastOneItem(t *testing.T) {
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	path := handler.BasePath + handler.PricesPath
 	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "item")
 
@@ -80,7 +208,7 @@ func TestGetPricesFor_AtLeastOneItem(t *testing.T) {
 }
 
 func TestGetPricesFor_MaxItemsExceded(t *testing.T) {
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	path := handler.BasePath + handler.PricesPath
 	query := "items_codes=q,w,e,r,t,y,u,i,o,p,a"
 	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, query)
@@ -91,9 +219,9 @@ func TestGetPricesFor_MaxItemsExceded(t *testing.T) {
 
 func TestGetPricesFor_InternalErr(t *testing.T) {
 	service := serviceMock{}
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	handler.PricesService = &service
-	service.On("GetPricesFor", "p1").Return(map[string]float64{}, errors.InternalError)
+	service.On("GetPricesFor", money.Currency(""), "p1").Return(map[string]items.Price{}, prices.CacheHit, errors.InternalError)
 
 	path := handler.BasePath + handler.PricesPath
 	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p1")
@@ -104,9 +232,9 @@ func TestGetPricesFor_InternalErr(t *testing.T) {
 
 func TestGetPricesFor_NotFound(t *testing.T) {
 	service := serviceMock{}
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	handler.PricesService = &service
-	service.On("GetPricesFor", "p2").Return(map[string]float64{}, errors.NotFoundItems)
+	service.On("GetPricesFor", money.Currency(""), "p2").Return(map[string]items.Price{}, prices.CacheHit, errors.NotFoundItems)
 
 	path := handler.BasePath + handler.PricesPath
 	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p2")
@@ -117,9 +245,9 @@ func TestGetPricesFor_NotFound(t *testing.T) {
 
 func TestGetPricesFor_ReturnPrices(t *testing.T) {
 	service := serviceMock{}
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	handler.PricesService = &service
-	service.On("GetPricesFor", "p2").Return(map[string]float64{"p2": 10}, nil)
+	service.On("GetPricesFor", money.Currency(""), "p2").Return(map[string]items.Price{"p2": usd("10")}, prices.CacheHit, nil)
 
 	path := handler.BasePath + handler.PricesPath
 	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p2")
@@ -127,13 +255,41 @@ func TestGetPricesFor_ReturnPrices(t *testing.T) {
 	response := pricesResponse{}
 	json.Unmarshal(w.Body.Bytes(), &response)
 	assert.Equal(t, http.StatusOK, w.Code)
-	assert.Equal(t, float64(10), response.Items[0].ItemPrice)
+	assert.Equal(t, money.MustParse("10"), response.Items[0].ItemPrice)
 	assert.Equal(t, "p2", response.Items[0].ItemCode)
 }
 
+func TestGetPricesFor_CacheStatusHeader(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("GetPricesFor", money.Currency(""), "p2").Return(map[string]items.Price{"p2": usd("10")}, prices.CacheStale, nil)
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p2")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "STALE", w.Header().Get("X-Cache-Status"))
+}
+
+func TestGetPricesFor_AgeHeader(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	old, recent := usd("10"), usd("3")
+	old.LoadedAt, recent.LoadedAt = time.Now().Add(-time.Minute), time.Now().Add(-time.Second)
+	service.On("GetPricesFor", money.Currency(""), "p2", "p3").Return(map[string]items.Price{"p2": old, "p3": recent}, prices.CacheHit, nil)
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p2,p3")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Age"))
+}
+
 func TestPostPricesFor_InvalidFormat(t *testing.T) {
 	service := serviceMock{}
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	handler.PricesService = &service
 
 	path := handler.BasePath + handler.PricesPath
@@ -145,9 +301,9 @@ func TestPostPricesFor_InvalidFormat(t *testing.T) {
 
 func TestPostPricesFor_InternalErr(t *testing.T) {
 	service := serviceMock{}
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	handler.PricesService = &service
-	service.On("SetPriceFor", "p14", float64(15)).Return(errors.InternalError)
+	service.On("SetPriceFor", "p14", usd("15"), "anonymous").Return(errors.InternalError)
 
 	body := `{"item_code": "p14","item_price": 15}`
 
@@ -160,9 +316,9 @@ func TestPostPricesFor_InternalErr(t *testing.T) {
 
 func TestPostPricesFor_StatusOK(t *testing.T) {
 	service := serviceMock{}
-	handler := StartHandler()
+	handler := NewHandler(nil, nil, nil)
 	handler.PricesService = &service
-	service.On("SetPriceFor", "p14", float64(15)).Return(nil)
+	service.On("SetPriceFor", "p14", usd("15"), "anonymous").Return(nil)
 
 	body := `{"item_code": "p14","item_price": 15}`
 
@@ -172,3 +328,541 @@ func TestPostPricesFor_StatusOK(t *testing.T) {
 	assert.Equal(t, http.StatusNoContent, w.Code)
 	assert.Equal(t, "", w.Body.String())
 }
+
+func TestGetPricesFor_ReturnsExactDecimals(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("GetPricesFor", money.Currency(""), "p2").Return(map[string]items.Price{"p2": usd("19.99")}, prices.CacheHit, nil)
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p2")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"item_price":19.99`)
+}
+
+func TestPostPricesFor_InvalidPricePrecision(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+
+	body := `{"item_code": "p14","item_price": 15.999}`
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(body), handler.SetPricesFor, "")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Item price must have at most two decimal digits.")
+	service.AssertNotCalled(t, "SetPriceFor", "p14", mock.Anything)
+}
+
+func TestGetPricesFor_InvalidCurrency(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p1&currency=EURO")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid currency: EURO.")
+}
+
+func TestGetPricesFor_ReturnConvertedPrices(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	updatedAt := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	rate := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.86"), UpdatedAt: updatedAt}
+	service.On("GetPricesFor", money.Currency("EUR"), "p2").Return(map[string]items.Price{"p2": usd("10").ConvertWith(rate)}, prices.CacheHit, nil)
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p2&currency=eur")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"item_price":8.60`)
+	assert.Contains(t, w.Body.String(), `"currency":"EUR"`)
+	assert.Contains(t, w.Body.String(), `"rate":0.86`)
+	assert.Contains(t, w.Body.String(), `"rate_updated_at":"2020-10-01T12:00:00Z"`)
+}
+
+func TestGetPricesFor_RateNotFound(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("GetPricesFor", money.Currency("GBP"), "p2").Return(map[string]items.Price{}, prices.CacheHit, errors.RateNotFound.WithParams([]string{"USD-GBP"}))
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p2&currency=GBP")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Exchange rates not found: USD-GBP.")
+}
+
+func TestPostPricesFor_WithCurrency(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("SetPriceFor", "p14", items.NewPrice(money.MustParse("15"), "EUR"), "anonymous").Return(nil)
+
+	body := `{"item_code": "p14","item_price": 15, "currency": "eur"}`
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(body), handler.SetPricesFor, "")
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestPostRate_StatusOK(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("SetRate", money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.8625")}).Return(nil)
+
+	body := `{"from": "USD","to": "EUR","rate": 0.8625}`
+
+	path := handler.BasePath + handler.RatesPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(body), handler.SetRate, "")
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestPostRate_InvalidRate(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+
+	body := `{"from": "USD","to": "EUR","rate": -1}`
+
+	path := handler.BasePath + handler.RatesPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(body), handler.SetRate, "")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Rate must be a positive number")
+}
+
+func TestPostRate_InvalidCurrency(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+
+	body := `{"from": "US","to": "EUR","rate": 1.1}`
+
+	path := handler.BasePath + handler.RatesPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(body), handler.SetRate, "")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid currency: US.")
+}
+
+func TestGetPricesFor_AsOf(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	asOf := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	service.On("GetPricesAt", asOf, money.Currency(""), "p1", "p2").Return(map[string]items.Price{"p1": usd("1"), "p2": usd("2")}, nil)
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p1,p2&as_of=2020-10-01T12:00:00Z")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	service.AssertNotCalled(t, "GetPricesFor", mock.Anything)
+}
+
+func TestGetPricesFor_InvalidAsOf(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetPricesFor, "items_codes=p1&as_of=yesterday")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "as_of must be a RFC3339 timestamp.")
+}
+
+func TestGetPriceHistory_ReturnHistory(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	effectiveAt := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	service.On("GetPriceHistory", "p1").Return([]items.PriceRecord{
+		{Price: usd("12"), EffectiveAt: effectiveAt, Actor: "bob"},
+	}, nil)
+
+	route := handler.BasePath + handler.HistoryPath
+	w := utils.ServeTestRequestTo("GET", route, handler.BasePath+"/p1/prices/history", nil, handler.GetPriceHistory, "", nil)
+
+	response := historyResponse{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "p1", response.ItemCode)
+	assert.Equal(t, usd("12").Amount, *response.History[0].ItemPrice)
+	assert.Equal(t, "bob", response.History[0].Actor)
+	assert.True(t, effectiveAt.Equal(response.History[0].EffectiveAt))
+}
+
+func TestGetPriceHistory_NotFound(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("GetPriceHistory", "p1").Return([]items.PriceRecord{}, errors.NotFoundItems.WithParams([]string{"p1"}))
+
+	route := handler.BasePath + handler.HistoryPath
+	w := utils.ServeTestRequestTo("GET", route, handler.BasePath+"/p1/prices/history", nil, handler.GetPriceHistory, "", nil)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Items not found: p1.")
+}
+
+func TestGetPriceHistory_ErrorWithRequestID(t *testing.T) {
+	service := serviceMock{}
+	logged := &bytes.Buffer{}
+	handler := NewHandler(&service, nil, logging.New(logged, logging.LevelInfo, nil))
+	service.On("GetPriceHistory", "p1").Return([]items.PriceRecord{}, errors.InternalError)
+
+	withRequestID := func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logging.ContextWithRequestID(c.Request.Context(), "req-1"))
+		handler.GetPriceHistory(c)
+	}
+	route := handler.BasePath + handler.HistoryPath
+	w := utils.ServeTestRequestTo("GET", route, handler.BasePath+"/p1/prices/history", nil, withRequestID, "", nil)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"code": 0, "message": "Internal server error.", "request_id": "req-1"}`, w.Body.String())
+	assert.Contains(t, logged.String(), `"level":"error","logger":"handlers","msg":"request_failed","request_id":"req-1","status":500`)
+}
+
+func TestPostPricesFor_WithActor(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("SetPriceFor", "p14", usd("15"), "alice").Return(nil)
+
+	body := `{"item_code": "p14","item_price": 15}`
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequestTo("POST", path, path, strings.NewReader(body), handler.SetPricesFor, "", map[string]string{"X-Actor": "alice"})
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	service.AssertExpectations(t)
+}
+
+func TestPostPricesFor_Scheduled(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	from := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	to := from.Add(24 * time.Hour)
+	window := items.Window{From: from, To: to}
+	service.On("SchedulePriceFor", "p14", usd("12"), mock.MatchedBy(func(w items.Window) bool {
+		return w.From.Equal(window.From) && w.To.Equal(window.To)
+	}), "anonymous").Return(nil)
+
+	body := fmt.Sprintf(`{"item_code": "p14","item_price": 12, "effective_from": %q, "effective_to": %q}`,
+		from.Format(time.RFC3339), to.Format(time.RFC3339))
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(body), handler.SetPricesFor, "")
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	service.AssertExpectations(t)
+}
+
+func TestPostPricesFor_InvalidWindow(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+
+	body := `{"item_code": "p14","item_price": 12, "effective_from": "2020-10-02T00:00:00Z", "effective_to": "2020-10-01T00:00:00Z"}`
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(body), handler.SetPricesFor, "")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "effective_to must be after effective_from and in the future.")
+}
+
+func TestPostPricesBatch_PerItemResults(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	changes := []items.PriceChange{
+		{ItemCode: "p1", Price: usd("10")},
+		{ItemCode: "p3", Price: items.NewPrice(money.MustParse("3"), "EUR")},
+	}
+	service.On("SetPricesFor", changes, "anonymous").Return([]*errors.CustomError{nil, errors.InternalError})
+
+	body := `[
+		{"item_code": "p1", "item_price": 10},
+		{"item_code": "p2", "item_price": 1.001},
+		{"item_code": "p3", "item_price": 3, "currency": "EUR"},
+		{"item_code": "pppppp", "item_price": 1},
+		{"item_code": "p5", "item_price": 1, "currency": "EURO"}
+	]`
+
+	route := handler.BasePath + handler.ActionPath
+	path := handler.BasePath + "/prices:batch"
+	w := utils.ServeTestRequestTo("POST", route, path, strings.NewReader(body), handler.PricesAction, "", nil)
+
+	response := batchResponse{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, response.Items, 5)
+	assert.Equal(t, http.StatusNoContent, response.Items[0].Status)
+	assert.Nil(t, response.Items[0].Error)
+	assert.Equal(t, http.StatusBadRequest, response.Items[1].Status)
+	assert.Equal(t, "Item price must have at most two decimal digits.", response.Items[1].Error.Message)
+	assert.Equal(t, http.StatusInternalServerError, response.Items[2].Status)
+	assert.Equal(t, "p3", response.Items[2].ItemCode)
+	assert.Equal(t, http.StatusBadRequest, response.Items[3].Status)
+	assert.Equal(t, "Request invalid format.", response.Items[3].Error.Message)
+	assert.Equal(t, "Invalid currency: EURO.", response.Items[4].Error.Message)
+	service.AssertExpectations(t)
+}
+
+func TestPostPricesBatch_InvalidFormat(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+
+	route := handler.BasePath + handler.ActionPath
+	path := handler.BasePath + "/prices:batch"
+	w := utils.ServeTestRequestTo("POST", route, path, strings.NewReader(`{"item_code": "p1"}`), handler.PricesAction, "", nil)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Request invalid format.")
+}
+
+func TestPostPricesBatch_Empty(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+
+	route := handler.BasePath + handler.ActionPath
+	path := handler.BasePath + "/prices:batch"
+	w := utils.ServeTestRequestTo("POST", route, path, strings.NewReader(`[]`), handler.PricesAction, "", nil)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "You must provide at least one item code.")
+}
+
+func TestPricesAction_UnknownAction(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+
+	route := handler.BasePath + handler.ActionPath
+	path := handler.BasePath + "/prices:purge"
+	w := utils.ServeTestRequestTo("POST", route, path, strings.NewReader(`[]`), handler.PricesAction, "", nil)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetPriceHistory_ReturnDeletion(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("GetPriceHistory", "p1").Return([]items.PriceRecord{
+		{EffectiveAt: time.Now(), Actor: "bob", Deleted: true},
+		{Price: usd("12"), EffectiveAt: time.Now(), Actor: "alice"},
+	}, nil)
+
+	route := handler.BasePath + handler.HistoryPath
+	w := utils.ServeTestRequestTo("GET", route, handler.BasePath+"/p1/prices/history", nil, handler.GetPriceHistory, "", nil)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"item_price":null,`)
+	assert.Contains(t, w.Body.String(), `"deleted":true`)
+}
+
+func TestDeletePricesFor_StatusNoContent(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("DeletePricesFor", []string{"p1", "p2"}, "alice").Return(nil)
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequestTo("DELETE", path, path, nil, handler.DeletePricesFor, "items_codes=p1,p2", map[string]string{"X-Actor": "alice"})
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	service.AssertExpectations(t)
+}
+
+func TestDeletePricesFor_NotFound(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("DeletePricesFor", []string{"p1"}, "anonymous").Return(errors.NotFoundItems.WithParams([]string{"p1"}))
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("DELETE", path, nil, handler.DeletePricesFor, "items_codes=p1")
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Items not found: p1.")
+}
+
+func TestDeletePricesFor_InvalidItems(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+
+	path := handler.BasePath + handler.PricesPath
+	w := utils.ServeTestRequest("DELETE", path, nil, handler.DeletePricesFor, "items_codes=pppppp")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetStats(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	handler.Cache = cache.NewLRU(10, time.Second, 0, 0)
+	service.On("Stats").Return(prices.Stats{CollapsedCalls: 9})
+	handler.Cache.GetPricesFor(context.Background(), "", []string{"p1"})
+
+	path := handler.BasePath + handler.StatsPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetStats, "")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"collapsed_calls": 9, "cache": [{"tier": "lru", "hits": 0, "misses": 1}]}`, w.Body.String())
+}
+
+func TestWarmUpCache(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	startedAt := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	service.On("WarmUp", []string{"p1", "p2"}).Return(nil, nil)
+	service.On("WarmUpProgress").Return(prices.WarmUpProgress{Running: true, StartedAt: startedAt})
+
+	path := handler.BasePath + handler.WarmUpPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(`{"items_codes": ["p1", "p2"]}`), handler.WarmUpCache, "")
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.JSONEq(t, `{"running": true, "batches": 0, "failed": 0, "cached": 0, "started_at": "2020-05-01T10:00:00Z"}`, w.Body.String())
+}
+
+func TestWarmUpCache_AllItems(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	service.On("WarmUp", []string(nil)).Return(nil, errors.WarmUpRunning)
+
+	path := handler.BasePath + handler.WarmUpPath
+	w := utils.ServeTestRequest("POST", path, nil, handler.WarmUpCache, "")
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	service.AssertExpectations(t)
+}
+
+func TestWarmUpCache_InvalidItems(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+
+	path := handler.BasePath + handler.WarmUpPath
+	w := utils.ServeTestRequest("POST", path, strings.NewReader(`{"items_codes": ["p1", "p123456"]}`), handler.WarmUpCache, "")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"code": 2, "message": "Invalid items: p123456."}`, w.Body.String())
+}
+
+func TestGetWarmUp(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(nil, nil, nil)
+	handler.PricesService = &service
+	startedAt := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	progress := prices.WarmUpProgress{Batches: 3, Failed: 1, Cached: 1000, StartedAt: startedAt, FinishedAt: startedAt.Add(time.Minute)}
+	service.On("WarmUpProgress").Return(progress)
+
+	path := handler.BasePath + handler.WarmUpPath
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetWarmUp, "")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"running": false, "batches": 3, "failed": 1, "cached": 1000,
+		"started_at": "2020-05-01T10:00:00Z", "finished_at": "2020-05-01T10:01:00Z"}`, w.Body.String())
+}
+
+// reportingCache is a cache whose circuit breakers are in the given state
+type reportingCache struct {
+	cache.Repository
+	health []cache.BreakerHealth
+}
+
+func (r reportingCache) Health() []cache.BreakerHealth {
+	return r.health
+}
+
+func TestGetHealth(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+	openedAt := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	path := handler.BasePath + handler.HealthPath
+
+	handler.Cache = cache.NewLRU(10, time.Second, 0, 0)
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetHealth, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok", "cache": []}`, w.Body.String())
+
+	handler.Cache = reportingCache{health: []cache.BreakerHealth{{Tier: "redis", State: cache.BreakerOpen, Failures: 5, OpenedAt: openedAt}}}
+	w = utils.ServeTestRequest("GET", path, nil, handler.GetHealth, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "degraded", "cache": [{"tier": "redis", "state": "open", "failures": 5, "opened_at": "2020-05-01T10:00:00Z"}]}`, w.Body.String())
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	service := serviceMock{}
+	handler := NewHandler(&service, nil, nil)
+	lru := cache.NewLRU(10, time.Second, 0, 0)
+	handler.Cache = reportingCache{Repository: lru, health: []cache.BreakerHealth{{Tier: "redis", State: cache.BreakerOpen, Failures: 5}}}
+	service.On("Stats").Return(prices.Stats{CollapsedCalls: 9})
+	lru.GetPricesFor(context.Background(), "", []string{"p1"})
+
+	handler.RegisterMetrics()
+	exposed := bytes.Buffer{}
+	assert.Nil(t, metrics.Write(&exposed))
+
+	assert.Contains(t, exposed.String(), `cache_lookups_total{tier="lru",result="hit"} 0
+cache_lookups_total{tier="lru",result="miss"} 1`)
+	assert.Contains(t, exposed.String(), `prices_collapsed_calls_total 9`)
+	assert.Contains(t, exposed.String(), `cache_breaker_state{tier="redis",state="closed"} 0
+cache_breaker_state{tier="redis",state="half_open"} 0
+cache_breaker_state{tier="redis",state="open"} 1`)
+	assert.Contains(t, exposed.String(), `cache_breaker_failures{tier="redis"} 5`)
+}
+
+// pingerMock is a dependency that fails its pings with err after delay, ignoring the context like go-redis does
+type pingerMock struct {
+	err   error
+	delay time.Duration
+}
+
+func (p pingerMock) Ping(ctx context.Context) error {
+	time.Sleep(p.delay)
+	return p.err
+}
+
+// pingingCache is a cache pinged like the given pinger
+type pingingCache struct {
+	cache.Repository
+	pingerMock
+}
+
+func TestGetLiveness(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+
+	w := utils.ServeTestRequest("GET", handler.LivenessPath, nil, handler.GetLiveness, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, w.Body.String())
+}
+
+func TestGetReadiness(t *testing.T) {
+	handler := NewHandler(nil, nil, nil)
+	handler.ReadinessTimeout = 50 * time.Millisecond
+	path := handler.ReadinessPath
+
+	handler.Storage = pingerMock{}
+	handler.Cache = pingingCache{}
+	w := utils.ServeTestRequest("GET", path, nil, handler.GetReadiness, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok", "dependencies": [{"name": "postgres", "status": "up"}, {"name": "redis", "status": "up"}], "cache": []}`, w.Body.String())
+
+	handler.Cache = pingingCache{pingerMock: pingerMock{err: fmt.Errorf("Redis ping error")}}
+	w = utils.ServeTestRequest("GET", path, nil, handler.GetReadiness, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "degraded", "dependencies": [{"name": "postgres", "status": "up"}, {"name": "redis", "status": "down", "error": "Redis ping error"}], "cache": []}`, w.Body.String())
+
+	handler.Storage = pingerMock{delay: time.Second}
+	w = utils.ServeTestRequest("GET", path, nil, handler.GetReadiness, "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"status": "unavailable", "dependencies": [{"name": "postgres", "status": "down", "error": "context deadline exceeded"}, {"name": "redis", "status": "down", "error": "Redis ping error"}], "cache": []}`, w.Body.String())
+
+	handler.Storage = pingerMock{}
+	handler.Cache = cache.NewLRU(10, time.Second, 0, 0)
+	w = utils.ServeTestRequest("GET", path, nil, handler.GetReadiness, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok", "dependencies": [{"name": "postgres", "status": "up"}], "cache": []}`, w.Body.String())
+}
@@ -0,0 +1,229 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/settings"
+)
+
+// RequestIDHeader is the header carrying the id of a request, generated when the caller does not send one
+const RequestIDHeader = "X-Request-ID"
+
+// Levels, a logger writes the lines of its level and above
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+type (
+	// Level is how severe a log line is
+	Level int8
+
+	// Field is a key and value added to a log line
+	Field struct {
+		Key   string
+		Value interface{}
+	}
+
+	// Logger writes JSON log lines, one object per line, with the request id of the context they are logged with.
+	// Named loggers can have a level of their own, e.g. a debug "cache" logger while the rest log from info.
+	// A nil logger logs nothing, every method on it does nothing.
+	Logger struct {
+		name   string
+		fields []Field
+		out    *output
+	}
+
+	// output is shared by a logger and every logger derived from it
+	output struct {
+		mu     sync.Mutex
+		w      io.Writer
+		level  Level
+		levels map[string]Level
+		now    func() time.Time
+	}
+
+	requestIDKey struct{}
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// New returns a logger writing to w the lines of level and above, levels has the level of the named loggers
+// that log from another one
+func New(w io.Writer, level Level, levels map[string]Level) *Logger {
+	return &Logger{out: &output{w: w, level: level, levels: levels, now: time.Now}}
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for k, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(k), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %s", s)
+}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// F returns a field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err returns the "err" field with the error message
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "err", Value: nil}
+	}
+	return Field{Key: "err", Value: err.Error()}
+}
+
+// Named returns a logger for the named package, logging from the level set for the name if any
+func (l *Logger) Named(name string) *Logger {
+	if l == nil {
+		return nil
+	}
+	return &Logger{name: name, fields: l.fields, out: l.out}
+}
+
+// With returns a logger adding the fields to every line
+func (l *Logger) With(fields ...Field) *Logger {
+	if l == nil {
+		return nil
+	}
+	return &Logger{name: l.name, fields: append(append([]Field{}, l.fields...), fields...), out: l.out}
+}
+
+// Enabled tells if the lines of the level are written, to skip building costly fields
+func (l *Logger) Enabled(level Level) bool {
+	if l == nil {
+		return false
+	}
+	if named, ok := l.out.levels[l.name]; ok {
+		return level >= named
+	}
+	return level >= l.out.level
+}
+
+// Debug logs a debug line
+func (l *Logger) Debug(ctx context.Context, msg string, fields ...Field) {
+	l.log(ctx, LevelDebug, msg, fields)
+}
+
+// Info logs an info line
+func (l *Logger) Info(ctx context.Context, msg string, fields ...Field) {
+	l.log(ctx, LevelInfo, msg, fields)
+}
+
+// Warn logs a warn line
+func (l *Logger) Warn(ctx context.Context, msg string, fields ...Field) {
+	l.log(ctx, LevelWarn, msg, fields)
+}
+
+// Error logs an error line
+func (l *Logger) Error(ctx context.Context, msg string, fields ...Field) {
+	l.log(ctx, LevelError, msg, fields)
+}
+
+// Fatal logs an error line and exits
+func (l *Logger) Fatal(ctx context.Context, msg string, fields ...Field) {
+	l.log(ctx, LevelError, msg, fields)
+	os.Exit(1)
+}
+
+func (l *Logger) log(ctx context.Context, level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	line := strings.Builder{}
+	line.WriteString(`{"time":`)
+	writeValue(&line, l.out.now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeValue(&line, level.String())
+	if l.name != "" {
+		line.WriteString(`,"logger":`)
+		writeValue(&line, l.name)
+	}
+	line.WriteString(`,"msg":`)
+	writeValue(&line, msg)
+	if id := RequestID(ctx); id != "" {
+		line.WriteString(`,"request_id":`)
+		writeValue(&line, id)
+	}
+	for _, fs := range [][]Field{l.fields, fields} {
+		for _, f := range fs {
+			line.WriteString(",")
+			writeValue(&line, f.Key)
+			line.WriteString(":")
+			writeValue(&line, f.Value)
+		}
+	}
+	line.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	io.WriteString(l.out.w, line.String())
+}
+
+// writeValue writes v as JSON, or its string form when it can not be encoded
+func writeValue(line *strings.Builder, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(v))
+	}
+	line.Write(encoded)
+}
+
+// ContextWithRequestID returns a context carrying the request id, added to the lines logged with it
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id carried by ctx, empty if there is none
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+var defaultLogger = fromSettings()
+
+// Default returns the logger writing to stdout from the levels in settings.Log
+func Default() *Logger {
+	return defaultLogger
+}
+
+func fromSettings() *Logger {
+	level, err := ParseLevel(settings.Log.Level)
+	if err != nil {
+		panic(err.Error())
+	}
+	levels := map[string]Level{}
+	for name, s := range settings.Log.Levels {
+		if levels[name], err = ParseLevel(s); err != nil {
+			panic(err.Error())
+		}
+	}
+	return New(os.Stdout, level, levels)
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogger(level Level, levels map[string]Level) (*Logger, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	logger := New(out, level, levels)
+	logger.out.now = func() time.Time { return time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC) }
+	return logger, out
+}
+
+func TestLogger_Format(t *testing.T) {
+	logger, out := newTestLogger(LevelInfo, nil)
+	ctx := ContextWithRequestID(context.Background(), "req-1")
+
+	logger.Named("cache").With(F("tier", "redis")).Error(ctx, "get_redis", Err(errors.New("connection refused")), F("items", []string{"p1", "p2"}))
+
+	assert.Equal(t, `{"time":"2020-10-01T12:00:00Z","level":"error","logger":"cache","msg":"get_redis","request_id":"req-1",`+
+		`"tier":"redis","err":"connection refused","items":["p1","p2"]}`+"\n", out.String())
+	line := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+}
+
+func TestLogger_Levels(t *testing.T) {
+	logger, out := newTestLogger(LevelWarn, map[string]Level{"cache": LevelDebug, "storage": LevelError})
+	ctx := context.Background()
+
+	logger.Info(ctx, "root_info")
+	logger.Warn(ctx, "root_warn")
+	logger.Named("cache").Debug(ctx, "cache_debug")
+	logger.Named("storage").Warn(ctx, "storage_warn")
+	logger.Named("storage").Error(ctx, "storage_error")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[0], `"msg":"root_warn"`)
+	assert.Contains(t, lines[1], `"msg":"cache_debug"`)
+	assert.Contains(t, lines[2], `"msg":"storage_error"`)
+	assert.NotContains(t, out.String(), "request_id")
+	assert.True(t, logger.Named("cache").Enabled(LevelDebug))
+	assert.False(t, logger.Enabled(LevelInfo))
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarn, level)
+	assert.Equal(t, "warn", level.String())
+
+	_, err = ParseLevel("verbose")
+	assert.Equal(t, "unknown log level verbose", err.Error())
+}
+
+func TestRequestID(t *testing.T) {
+	assert.Equal(t, "", RequestID(context.Background()))
+	assert.Equal(t, "req-1", RequestID(ContextWithRequestID(context.Background(), "req-1")))
+}
+
+func TestLogger_Nil(t *testing.T) {
+	var logger *Logger
+
+	assert.Nil(t, logger.Named("cache").With(F("tier", "redis")))
+	assert.False(t, logger.Enabled(LevelError))
+	logger.Error(context.Background(), "get_redis", Err(errors.New("connection refused")))
+}
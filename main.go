@@ -1,9 +1,21 @@
 package main
 
 import (
+	"os"
+
 	"github.com/ldegaetano/go-ddd-example/server"
 )
 
+// Without arguments it serves the api, "check [-repair]" checks the cache against the database
+// and "migrate up|down|status" migrates the database schema
 func main() {
-	server.Start()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(server.Check(os.Args[2:]))
+		case "migrate":
+			os.Exit(server.Migrate(os.Args[2:]))
+		}
+	}
+	os.Exit(server.Start())
 }
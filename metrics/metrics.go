@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// contentType is the Prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds in seconds of the latency histograms
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type (
+	// Counter counts events per combination of label values
+	Counter struct {
+		metric
+		values map[string]*counterValue
+	}
+
+	// Histogram counts observations in buckets per combination of label values
+	Histogram struct {
+		metric
+		buckets []float64
+		values  map[string]*histogramValue
+	}
+
+	// Func writes the values its collect function returns whenever the metrics are written,
+	// for values counted or kept elsewhere
+	Func struct {
+		metric
+		kind    string
+		collect func() []Sample
+	}
+
+	// Sample is a value of a Func with one value per label
+	Sample struct {
+		LabelValues []string
+		Value       float64
+	}
+
+	metric struct {
+		name   string
+		help   string
+		labels []string
+		mu     sync.Mutex
+	}
+
+	counterValue struct {
+		labelValues []string
+		value       float64
+	}
+
+	histogramValue struct {
+		labelValues []string
+		// counts has the observations of each bucket alone, they are added up when written
+		counts []uint64
+		count  uint64
+		sum    float64
+	}
+
+	collector interface {
+		write(w *bufio.Writer)
+	}
+)
+
+var registry = struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}{collectors: map[string]collector{}}
+
+// NewCounter registers a counter, every call to it must give one value per label
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{metric: metric{name: name, help: help, labels: labels}, values: map[string]*counterValue{}}
+	register(name, c)
+	return c
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds, in increasing order
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{metric: metric{name: name, help: help, labels: labels}, buckets: buckets, values: map[string]*histogramValue{}}
+	register(name, h)
+	return h
+}
+
+// NewCounterFunc registers a counter whose values are read from collect, counts it returns must never go down
+func NewCounterFunc(name string, help string, collect func() []Sample, labels ...string) *Func {
+	f := &Func{metric: metric{name: name, help: help, labels: labels}, kind: "counter", collect: collect}
+	register(name, f)
+	return f
+}
+
+// NewGaugeFunc registers a gauge whose values are read from collect
+func NewGaugeFunc(name string, help string, collect func() []Sample, labels ...string) *Func {
+	f := &Func{metric: metric{name: name, help: help, labels: labels}, kind: "gauge", collect: collect}
+	register(name, f)
+	return f
+}
+
+func register(name string, c collector) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.collectors[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	registry.collectors[name] = c
+}
+
+// Inc adds one to the counter of the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter of the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		c.values[key] = value
+	}
+	value.value += v
+}
+
+// Observe counts v in the histogram of the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	if k := sort.SearchFloat64s(h.buckets, v); k < len(h.buckets) {
+		value.counts[k]++
+	}
+	value.count++
+	value.sum += v
+}
+
+func (m *metric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (m *metric) writeHeader(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, escape(m.help, false), m.name, kind)
+}
+
+// labelPairs formats the labels with their values, followed by the extra name and value if any
+func (m *metric) labelPairs(labelValues []string, extra ...string) string {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for k, v := range labelValues {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, m.labels[k], escape(v, true)))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[0], extra[1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		value := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(value.labelValues), formatFloat(value.value))
+	}
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		value := h.values[key]
+		var cumulative uint64
+		for k, bound := range h.buckets {
+			cumulative += value.counts[k]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(value.labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(value.labelValues, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(value.labelValues), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(value.labelValues), value.count)
+	}
+}
+
+func (f *Func) write(w *bufio.Writer) {
+	samples := f.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return f.key(samples[i].LabelValues) < f.key(samples[j].LabelValues)
+	})
+	f.writeHeader(w, f.kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelPairs(s.LabelValues), formatFloat(s.Value))
+	}
+}
+
+// Write writes every registered metric in the Prometheus text format, sorted by name
+func Write(w io.Writer) error {
+	registry.mu.Lock()
+	names := make([]string, 0, len(registry.collectors))
+	for name := range registry.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for k, name := range names {
+		collectors[k] = registry.collectors[name]
+	}
+	registry.mu.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// Handler serves every registered metric in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		Write(w)
+	})
+}
+
+func sortedKeys(values interface{}) []string {
+	keys := []string{}
+	switch v := values.(type) {
+	case map[string]*counterValue:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escape escapes the backslashes and line feeds of help texts, and the double quotes too of label values
+func escape(s string, quotes bool) string {
+	s = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testCounter   = NewCounter("test_calls_total", "Calls by result", "call", "result")
+	testHistogram = NewHistogram("test_duration_seconds", "Time taken\nby call", []float64{0.1, 1}, "call")
+)
+
+func TestWrite(t *testing.T) {
+	testCounter.Inc("get", "hit")
+	testCounter.Add(2, "get", "hit")
+	testCounter.Inc(`say "hi"`, "miss")
+	testHistogram.Observe(0.05, "get")
+	testHistogram.Observe(0.1, "get")
+	testHistogram.Observe(0.5, "get")
+	testHistogram.Observe(3, "get")
+
+	w := bytes.Buffer{}
+	assert.Nil(t, Write(&w))
+	assert.Equal(t, `# HELP test_calls_total Calls by result
+# TYPE test_calls_total counter
+test_calls_total{call="get",result="hit"} 3
+test_calls_total{call="say \"hi\"",result="miss"} 1
+# HELP test_duration_seconds Time taken\nby call
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{call="get",le="0.1"} 2
+test_duration_seconds_bucket{call="get",le="1"} 3
+test_duration_seconds_bucket{call="get",le="+Inf"} 4
+test_duration_seconds_sum{call="get"} 3.65
+test_duration_seconds_count{call="get"} 4
+`, w.String())
+}
+
+func TestFunc(t *testing.T) {
+	hits := 0.0
+	NewCounterFunc("test_func_hits_total", "Hits by tier", func() []Sample {
+		hits++
+		return []Sample{{LabelValues: []string{"redis"}, Value: hits}, {LabelValues: []string{"lru"}, Value: 2 * hits}}
+	}, "tier")
+	NewGaugeFunc("test_func_open", "Open", func() []Sample { return []Sample{{Value: 1}} })
+
+	w := bytes.Buffer{}
+	assert.Nil(t, Write(&w))
+	assert.Contains(t, w.String(), `# HELP test_func_hits_total Hits by tier
+# TYPE test_func_hits_total counter
+test_func_hits_total{tier="lru"} 2
+test_func_hits_total{tier="redis"} 1
+# HELP test_func_open Open
+# TYPE test_func_open gauge
+test_func_open 1
+`)
+}
+
+func TestHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "# HELP test_calls_total"))
+}
+
+func TestWrongLabels(t *testing.T) {
+	assert.Panics(t, func() { testCounter.Inc("get") })
+	assert.Panics(t, func() { NewCounter("test_calls_total", "Registered twice") })
+}
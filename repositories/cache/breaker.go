@@ -0,0 +1,351 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is returned without calling the cache while its circuit is open
+var ErrCircuitOpen = unavailable("Cache circuit open")
+
+type (
+	// HealthReporter is a cache that reports the state of its circuit breakers
+	HealthReporter interface {
+		Health() []BreakerHealth
+	}
+
+	// BreakerHealth is the state of the circuit breaker of a cache tier
+	BreakerHealth struct {
+		Tier  string
+		State string
+		// Failures is how many calls in a row failed
+		Failures int
+		// OpenedAt is when the circuit last opened, zero if it never did
+		OpenedAt time.Time
+	}
+
+	// breakerRepository stops calling the cache it wraps after threshold calls in a row fail to reach it,
+	// failing fast instead so prices are read from the storage without waiting for the cache. Once the
+	// circuit is open for cooldown a single call is let through as a probe, which closes the circuit
+	// if it reaches the cache and opens it again otherwise.
+	// The items whose prices could not be set or dropped are remembered as stale and dropped
+	// from the cache before it is called again, so it does not serve them once reachable.
+	// So are the conversions that could not be dropped after their rate changed.
+	breakerRepository struct {
+		tier      string
+		inner     Repository
+		threshold int
+		cooldown  time.Duration
+
+		mu       sync.Mutex
+		state    string
+		failures int
+		openedAt time.Time
+		probing  bool
+		stale    map[string]struct{}
+		// staleConversions are the currency pairs whose conversions could not be dropped
+		staleConversions map[currencyPair]struct{}
+		logger           *logging.Logger
+	}
+
+	currencyPair struct {
+		from money.Currency
+		to   money.Currency
+	}
+)
+
+// NewBreaker wraps the cache of the tier with a circuit breaker that opens after threshold
+// failures in a row and probes the cache every cooldown while open, logging its changes of state
+func NewBreaker(tier string, inner Repository, threshold int, cooldown time.Duration, logger *logging.Logger) *breakerRepository {
+	return &breakerRepository{
+		tier:             tier,
+		inner:            inner,
+		threshold:        threshold,
+		cooldown:         cooldown,
+		state:            BreakerClosed,
+		stale:            map[string]struct{}{},
+		staleConversions: map[currencyPair]struct{}{},
+		logger:           logger.Named(loggerName),
+	}
+}
+
+// GetPricesFor returns the cached prices unless the circuit is open
+func (br *breakerRepository) GetPricesFor(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, []string, error) {
+	if err := br.pass(ctx); err != nil {
+		return map[string]items.Price{}, []string{}, err
+	}
+	itemsPrice, stale, err := br.inner.GetPricesFor(ctx, currency, itemsCode)
+	br.record(err)
+	return itemsPrice, stale, err
+}
+
+// SetPricesFor caches the prices unless the circuit is open, the items are stale if they are not cached
+func (br *breakerRepository) SetPricesFor(ctx context.Context, itemsPrice map[string]items.Price) error {
+	err := br.call(ctx, func() error { return br.inner.SetPricesFor(ctx, itemsPrice) })
+	if isUnavailable(err) {
+		itemsCode := make([]string, 0, len(itemsPrice))
+		for k := range itemsPrice {
+			itemsCode = append(itemsCode, k)
+		}
+		br.markStale(itemsCode)
+	}
+	return err
+}
+
+// SetConversionsFor caches the conversions unless the circuit is open
+func (br *breakerRepository) SetConversionsFor(ctx context.Context, currency money.Currency, itemsPrice map[string]items.Price) error {
+	return br.call(ctx, func() error { return br.inner.SetConversionsFor(ctx, currency, itemsPrice) })
+}
+
+// DeletePricesFor drops the items unless the circuit is open, the items are stale if they are not dropped
+func (br *breakerRepository) DeletePricesFor(ctx context.Context, itemsCode []string) error {
+	err := br.call(ctx, func() error { return br.inner.DeletePricesFor(ctx, itemsCode) })
+	if isUnavailable(err) {
+		br.markStale(itemsCode)
+	}
+	return err
+}
+
+// DeleteConversionsFor drops the conversions unless the circuit is open, they are stale if they are not dropped
+func (br *breakerRepository) DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error {
+	err := br.call(ctx, func() error { return br.inner.DeleteConversionsFor(ctx, from, to) })
+	if isUnavailable(err) {
+		br.markStaleConversions([]currencyPair{{from, to}})
+	}
+	return err
+}
+
+// GetMissingFor returns the items known to have no price unless the circuit is open
+func (br *breakerRepository) GetMissingFor(ctx context.Context, itemsCode []string) ([]string, error) {
+	if err := br.pass(ctx); err != nil {
+		return []string{}, err
+	}
+	missing, err := br.inner.GetMissingFor(ctx, itemsCode)
+	br.record(err)
+	return missing, err
+}
+
+// SetMissingFor remembers the items have no price unless the circuit is open
+func (br *breakerRepository) SetMissingFor(ctx context.Context, itemsCode []string) error {
+	return br.call(ctx, func() error { return br.inner.SetMissingFor(ctx, itemsCode) })
+}
+
+// InvalidateFor tells the other instances about the items through the wrapped cache. Neither the circuit
+// is checked nor the outcome counted, the caches wrapped invalidate nothing and a nil error would close it.
+func (br *breakerRepository) InvalidateFor(ctx context.Context, itemsCode []string) error {
+	return br.inner.InvalidateFor(ctx, itemsCode)
+}
+
+// InspectPricesFor returns the cached entries unless the circuit is open
+func (br *breakerRepository) InspectPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, []string, error) {
+	inspector, ok := br.inner.(Inspector)
+	if !ok {
+		return map[string]items.Price{}, []string{}, errNotInspectable(br.inner)
+	}
+	if err := br.pass(ctx); err != nil {
+		return map[string]items.Price{}, []string{}, err
+	}
+	itemsPrice, missing, err := inspector.InspectPricesFor(ctx, itemsCode)
+	br.record(err)
+	return itemsPrice, missing, err
+}
+
+// ScanItemCodes returns the cached item codes unless the circuit is open
+func (br *breakerRepository) ScanItemCodes(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	inspector, ok := br.inner.(Inspector)
+	if !ok {
+		return []string{}, 0, errNotInspectable(br.inner)
+	}
+	if err := br.pass(ctx); err != nil {
+		return []string{}, 0, err
+	}
+	itemsCode, next, err := inspector.ScanItemCodes(ctx, cursor, count)
+	br.record(err)
+	return itemsCode, next, err
+}
+
+// Stats returns the stats of the wrapped cache
+func (br *breakerRepository) Stats() []TierStats {
+	return br.inner.Stats()
+}
+
+// Close closes the wrapped cache
+func (br *breakerRepository) Close() error {
+	if closer, ok := br.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Ping pings the wrapped cache even while the circuit is open, without counting the outcome
+func (br *breakerRepository) Ping(ctx context.Context) error {
+	if pinger, ok := br.inner.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Health returns the state of the circuit
+func (br *breakerRepository) Health() []BreakerHealth {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	return []BreakerHealth{{Tier: br.tier, State: br.state, Failures: br.failures, OpenedAt: br.openedAt}}
+}
+
+func (br *breakerRepository) call(ctx context.Context, f func() error) error {
+	if err := br.pass(ctx); err != nil {
+		return err
+	}
+	err := f()
+	br.record(err)
+	return err
+}
+
+// pass tells if a call can go through, failing with ErrCircuitOpen otherwise. The stale items and conversions
+// are dropped first, the call fails as the cache did if they can not be, and they are left stale.
+func (br *breakerRepository) pass(ctx context.Context) error {
+	if !br.allow() {
+		return ErrCircuitOpen
+	}
+	itemsCode, conversions := br.takeStale()
+	if len(itemsCode) == 0 && len(conversions) == 0 {
+		return nil
+	}
+	if err := br.dropStale(ctx, itemsCode, conversions); err != nil {
+		br.markStale(itemsCode)
+		br.markStaleConversions(conversions)
+		br.record(err)
+		return err
+	}
+	br.logger.Info(ctx, "cache_breaker_stale", logging.F("tier", br.tier),
+		logging.F("items", len(itemsCode)), logging.F("conversions", len(conversions)))
+	return nil
+}
+
+func (br *breakerRepository) dropStale(ctx context.Context, itemsCode []string, conversions []currencyPair) error {
+	if len(itemsCode) > 0 {
+		if err := br.inner.DeletePricesFor(ctx, itemsCode); err != nil {
+			return err
+		}
+	}
+	for _, c := range conversions {
+		if err := br.inner.DeleteConversionsFor(ctx, c.from, c.to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markStale remembers the items may be cached with a price they do not have anymore
+func (br *breakerRepository) markStale(itemsCode []string) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	for _, i := range itemsCode {
+		br.stale[i] = struct{}{}
+	}
+}
+
+// markStaleConversions remembers the prices converted between the currencies may be cached with a previous rate
+func (br *breakerRepository) markStaleConversions(conversions []currencyPair) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	for _, c := range conversions {
+		br.staleConversions[c] = struct{}{}
+	}
+}
+
+func (br *breakerRepository) takeStale() ([]string, []currencyPair) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	var itemsCode []string
+	for i := range br.stale {
+		itemsCode = append(itemsCode, i)
+	}
+	var conversions []currencyPair
+	for c := range br.staleConversions {
+		conversions = append(conversions, c)
+	}
+	br.stale = map[string]struct{}{}
+	br.staleConversions = map[currencyPair]struct{}{}
+	return itemsCode, conversions
+}
+
+// allow tells if a call can go through, half opening the circuit once it was open for cooldown
+// and letting a single probe through while it is half open
+func (br *breakerRepository) allow() bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	switch br.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if time.Since(br.openedAt) < br.cooldown {
+			return false
+		}
+		br.setState(BreakerHalfOpen)
+	}
+	if br.probing {
+		return false
+	}
+	br.probing = true
+	return true
+}
+
+// record counts the failures in a row, only the ones about reaching the cache count.
+// Calls given up by their caller tell nothing about the cache.
+func (br *breakerRepository) record(err error) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.probing = false
+
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return
+	}
+	if !isUnavailable(err) {
+		br.failures = 0
+		if br.state != BreakerClosed {
+			br.setState(BreakerClosed)
+		}
+		return
+	}
+
+	br.failures++
+	if br.state == BreakerHalfOpen || br.state == BreakerClosed && br.failures >= br.threshold {
+		br.openedAt = time.Now()
+		br.setState(BreakerOpen)
+	}
+}
+
+func (br *breakerRepository) setState(state string) {
+	if state == BreakerOpen {
+		br.logger.Warn(context.Background(), "cache_breaker", logging.F("tier", br.tier), logging.F("state", state), logging.F("failures", br.failures))
+	} else {
+		br.logger.Info(context.Background(), "cache_breaker", logging.F("tier", br.tier), logging.F("state", state))
+	}
+	br.state = state
+}
+
+// Health returns the state of the circuit breakers of both tiers
+func (tr tieredRepository) Health() []BreakerHealth {
+	health := []BreakerHealth{}
+	for _, r := range []Repository{tr.l1, tr.l2} {
+		if reporter, ok := r.(HealthReporter); ok {
+			health = append(health, reporter.Health()...)
+		}
+	}
+	return health
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unreachableRepository is an LRU that can not be reached while down
+type unreachableRepository struct {
+	*lruRepository
+	down  bool
+	calls int
+}
+
+func (u *unreachableRepository) GetPricesFor(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, []string, error) {
+	u.calls++
+	if u.down {
+		return map[string]items.Price{}, []string{}, unavailable("Redis get error")
+	}
+	return u.lruRepository.GetPricesFor(context.Background(), currency, itemsCode)
+}
+
+func (u *unreachableRepository) SetPricesFor(ctx context.Context, itemsPrice map[string]items.Price) error {
+	u.calls++
+	if u.down {
+		return &WriteError{ItemsCode: []string{"c1"}}
+	}
+	return u.lruRepository.SetPricesFor(context.Background(), itemsPrice)
+}
+
+func (u *unreachableRepository) DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error {
+	u.calls++
+	if u.down {
+		return unavailable("Delete cache error")
+	}
+	return u.lruRepository.DeleteConversionsFor(context.Background(), from, to)
+}
+
+func TestBreaker_OpensAfterThreshold(t *testing.T) {
+	inner := &unreachableRepository{lruRepository: NewLRU(10, time.Second, 0, 0), down: true}
+	breaker := NewBreaker("redis", inner, 2, time.Minute, nil)
+
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, BreakerClosed, breaker.Health()[0].State)
+	breaker.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")})
+	assert.Equal(t, BreakerOpen, breaker.Health()[0].State)
+	assert.Equal(t, 2, breaker.Health()[0].Failures)
+
+	_, _, err := breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, 2, inner.calls, "the cache should not be called while the circuit is open")
+}
+
+func TestBreaker_MissesAreNotFailures(t *testing.T) {
+	inner := &unreachableRepository{lruRepository: NewLRU(10, time.Second, 0, 0)}
+	breaker := NewBreaker("redis", inner, 1, time.Minute, nil)
+
+	_, _, err := breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Contains(t, err.Error(), "Item c1 do not exist")
+	assert.Equal(t, BreakerClosed, breaker.Health()[0].State)
+}
+
+func TestBreaker_CancelledCallsAreNotFailures(t *testing.T) {
+	inner := &unreachableRepository{lruRepository: NewLRU(10, time.Second, 0, 0), down: true}
+	breaker := NewBreaker("redis", inner, 1, 0, nil)
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.True(t, breaker.allow())
+
+	breaker.record(context.Canceled)
+	assert.Equal(t, BreakerHalfOpen, breaker.Health()[0].State, "a cancelled probe should not close the circuit")
+	assert.True(t, breaker.allow(), "another probe should be let through")
+}
+
+func TestBreaker_ProbesWhileOpen(t *testing.T) {
+	inner := &unreachableRepository{lruRepository: NewLRU(10, time.Second, 0, 0), down: true}
+	breaker := NewBreaker("redis", inner, 1, time.Millisecond*50, nil)
+
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	openedAt := breaker.Health()[0].OpenedAt
+	time.Sleep(time.Millisecond * 60)
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, 2, inner.calls, "a probe should be let through after the cooldown")
+	assert.Equal(t, BreakerOpen, breaker.Health()[0].State)
+	assert.True(t, breaker.Health()[0].OpenedAt.After(openedAt), "a failed probe should open the circuit again")
+
+	inner.down = false
+	time.Sleep(time.Millisecond * 60)
+	assert.Nil(t, breaker.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")}))
+	assert.Equal(t, BreakerClosed, breaker.Health()[0].State)
+	assert.Equal(t, 0, breaker.Health()[0].Failures)
+
+	prices, _, err := breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, err)
+	assert.Equal(t, usd("1"), prices["c1"])
+}
+
+func TestBreaker_InvalidationsDoNotCloseTheCircuit(t *testing.T) {
+	inner := &unreachableRepository{lruRepository: NewLRU(10, time.Second, 0, 0), down: true}
+	breaker := NewBreaker("redis", inner, 2, time.Millisecond*50, nil)
+
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, breaker.InvalidateFor(context.Background(), []string{"c1"}))
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, BreakerOpen, breaker.Health()[0].State, "an invalidation should not reset the failures")
+
+	time.Sleep(time.Millisecond * 60)
+	assert.Nil(t, breaker.InvalidateFor(context.Background(), []string{"c1"}))
+	assert.Equal(t, BreakerOpen, breaker.Health()[0].State, "an invalidation should not be taken as a probe")
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, 3, inner.calls, "the probe should still be let through after the invalidation")
+}
+
+func TestBreaker_SingleProbeWhileHalfOpen(t *testing.T) {
+	inner := &unreachableRepository{lruRepository: NewLRU(10, time.Second, 0, 0), down: true}
+	breaker := NewBreaker("redis", inner, 1, 0, nil)
+
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.True(t, breaker.allow(), "the first call after the cooldown should be a probe")
+	assert.Equal(t, BreakerHalfOpen, breaker.Health()[0].State)
+	assert.False(t, breaker.allow(), "only one probe should be in flight")
+}
+
+func TestBreaker_DropsStaleItemsOnceReachable(t *testing.T) {
+	inner := &unreachableRepository{lruRepository: NewLRU(10, time.Minute, 0, 0)}
+	breaker := NewBreaker("redis", inner, 1, time.Millisecond*50, nil)
+	breaker.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1"), "c2": usd("2")})
+
+	inner.down = true
+	breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, BreakerOpen, breaker.Health()[0].State)
+	// changed in the storage while the circuit is open
+	assert.Equal(t, ErrCircuitOpen, breaker.DeletePricesFor(context.Background(), []string{"c1"}))
+	assert.Equal(t, ErrCircuitOpen, breaker.SetPricesFor(context.Background(), map[string]items.Price{"c2": usd("3")}))
+
+	inner.down = false
+	time.Sleep(time.Millisecond * 60)
+	prices, _, _ := breaker.GetPricesFor(context.Background(), "", []string{"c1", "c2"})
+	assert.Empty(t, prices, "the items changed while the circuit was open should not be served")
+	assert.Equal(t, BreakerClosed, breaker.Health()[0].State)
+	itemsCode, conversions := breaker.takeStale()
+	assert.Empty(t, itemsCode)
+	assert.Empty(t, conversions)
+}
+
+func TestBreaker_DropsStaleConversionsOnceReachable(t *testing.T) {
+	inner := &unreachableRepository{lruRepository: NewLRU(10, time.Minute, 0, 0)}
+	breaker := NewBreaker("redis", inner, 1, time.Millisecond*50, nil)
+	rate := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5")}
+	breaker.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("10")})
+	breaker.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c1": usd("10").ConvertWith(rate)})
+
+	// the rate changes while the cache can not be reached
+	inner.down = true
+	assert.NotNil(t, breaker.DeleteConversionsFor(context.Background(), "USD", "EUR"))
+	assert.Equal(t, BreakerOpen, breaker.Health()[0].State)
+
+	inner.down = false
+	time.Sleep(time.Millisecond * 60)
+	prices, _, _ := breaker.GetPricesFor(context.Background(), "EUR", []string{"c1"})
+	assert.Empty(t, prices, "the conversions with the previous rate should not be served")
+	prices, _, _ = breaker.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, usd("10"), prices["c1"])
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/settings"
+)
+
+// Inspector is a cache whose entries can be listed and read as they are, without counting
+// as lookups, to check them against the storage
+type Inspector interface {
+	Repository
+	// InspectPricesFor returns the items own prices cached and the items known to have no price
+	InspectPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, []string, error)
+	// ScanItemCodes returns about count cached item codes from cursor on and the cursor to go on from,
+	// 0 once every item was returned. Items may be returned more than once.
+	ScanItemCodes(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error)
+}
+
+// InspectPricesFor returns the items own prices cached, stale ones included, and the items known to have no price.
+// Entries that can not be decoded are left out.
+func (cr cacheRepository) InspectPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, []string, error) {
+	itemsPrice := map[string]items.Price{}
+	missing := []string{}
+
+	cmds := make([]*redis.SliceCmd, len(itemsCode))
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+			for k, i := range itemsCode {
+				cmds[k] = pipe.HMGet(buildPriceKey(i), rawField, missingField)
+			}
+			return nil
+		})
+		return err
+	})
+	if cancelled(err) {
+		return itemsPrice, missing, err
+	}
+	if err != nil {
+		cr.logger.Error(ctx, "inspect_redis", logging.Err(err))
+		return itemsPrice, missing, unavailable("Redis get error")
+	}
+
+	for k, cmd := range cmds {
+		raw, marker := cmd.Val()[0], cmd.Val()[1]
+		if marker != nil {
+			missing = append(missing, itemsCode[k])
+		}
+		if raw == nil {
+			continue
+		}
+		price, err := decodePrice(raw.(string))
+		if err != nil {
+			cr.logger.Error(ctx, "inspect_redis", logging.F("item_code", itemsCode[k]), logging.Err(err))
+			continue
+		}
+		itemsPrice[itemsCode[k]] = price
+	}
+	return itemsPrice, missing, nil
+}
+
+// ScanItemCodes returns about count item codes with a cached hash from cursor on
+func (cr cacheRepository) ScanItemCodes(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	keys, next, err := cr.scanKeys(ctx, cursor, count)
+	if cancelled(err) {
+		return []string{}, 0, err
+	}
+	if err != nil {
+		cr.logger.Error(ctx, "scan_redis", logging.Err(err))
+		return []string{}, 0, unavailable("Redis scan error")
+	}
+
+	// the item code is what the key has in place of the %s of settings.Redis.PriceKey
+	parts := strings.SplitN(settings.Redis.PriceKey, "%s", 2)
+	itemsCode := make([]string, len(keys))
+	for k, key := range keys {
+		itemsCode[k] = strings.TrimSuffix(strings.TrimPrefix(key, parts[0]), parts[1])
+	}
+	return itemsCode, next, nil
+}
+
+// InspectPricesFor returns the entries of l2, the shared tier
+func (tr tieredRepository) InspectPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, []string, error) {
+	inspector, ok := tr.l2.(Inspector)
+	if !ok {
+		return map[string]items.Price{}, []string{}, errNotInspectable(tr.l2)
+	}
+	return inspector.InspectPricesFor(ctx, itemsCode)
+}
+
+// ScanItemCodes returns the item codes of l2, the shared tier
+func (tr tieredRepository) ScanItemCodes(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	inspector, ok := tr.l2.(Inspector)
+	if !ok {
+		return []string{}, 0, errNotInspectable(tr.l2)
+	}
+	return inspector.ScanItemCodes(ctx, cursor, count)
+}
+
+func errNotInspectable(r Repository) error {
+	return fmt.Errorf("%T entries can not be inspected", r)
+}
+
+// scanKeys scans the price keys of a single node from cursor on. A Cluster spreads the keys across its masters,
+// which have a cursor each, so all of them are scanned at once and there is nothing to go on from.
+func (cr cacheRepository) scanKeys(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	var keys []string
+	var next uint64
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		cluster, ok := client.(*redis.ClusterClient)
+		if !ok {
+			var err error
+			keys, next, err = client.Scan(cursor, buildPriceKey("*"), count).Result()
+			return err
+		}
+
+		var mu sync.Mutex
+		keys = []string{}
+		return cluster.ForEachMaster(func(master *redis.Client) error {
+			var cursor uint64
+			for {
+				page, next, err := master.Scan(cursor, buildPriceKey("*"), count).Result()
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				keys = append(keys, page...)
+				mu.Unlock()
+				if next == 0 {
+					return nil
+				}
+				cursor = next
+			}
+		})
+	})
+	if err != nil {
+		return []string{}, 0, err
+	}
+	return keys, next, nil
+}
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
+)
+
+const (
+	// healthCheckInterval is how long the subscription waits for a message before pinging Redis,
+	// a ping without answer for as long means the subscription dropped
+	healthCheckInterval = 30 * time.Second
+	maxResubscribeDelay = 10 * time.Second
+)
+
+type (
+	// Subscriber is a cache that keeps prices in process and has to listen to the
+	// invalidations published by other instances
+	Subscriber interface {
+		// Subscribe starts listening in the background until the returned func is called
+		Subscribe() (unsubscribe func())
+	}
+
+	// localCache is the in process tier evicted by the invalidations
+	localCache interface {
+		DeletePricesFor(ctx context.Context, itemsCode []string) error
+		DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error
+		Flush()
+	}
+
+	// invalidator publishes on a Redis channel the items changed by this instance and
+	// evicts from the local cache the ones changed by the others
+	invalidator struct {
+		client   redis.UniversalClient
+		channel  string
+		instance string
+		local    localCache
+		interval time.Duration
+		logger   *logging.Logger
+
+		mu      sync.Mutex
+		pubsub  *redis.PubSub
+		stopped bool
+	}
+
+	// invalidation evicts either the items or, when Conversion is set, the prices converted with a rate
+	invalidation struct {
+		Instance   string                  `json:"instance"`
+		ItemsCodes []string                `json:"items_codes"`
+		Conversion *conversionInvalidation `json:"conversion,omitempty"`
+	}
+
+	conversionInvalidation struct {
+		From money.Currency `json:"from"`
+		To   money.Currency `json:"to"`
+	}
+)
+
+func newInvalidator(client redis.UniversalClient, channel string, local localCache, logger *logging.Logger) *invalidator {
+	hostname, _ := os.Hostname()
+	return &invalidator{
+		client:   client,
+		channel:  channel,
+		instance: fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		local:    local,
+		interval: healthCheckInterval,
+		logger:   logger,
+	}
+}
+
+// publish tells the other instances to evict the items
+func (iv *invalidator) publish(ctx context.Context, itemsCode []string) error {
+	return iv.send(ctx, invalidation{Instance: iv.instance, ItemsCodes: itemsCode})
+}
+
+// publishConversions tells the other instances to evict the prices converted from one currency into another
+func (iv *invalidator) publishConversions(ctx context.Context, from money.Currency, to money.Currency) error {
+	return iv.send(ctx, invalidation{Instance: iv.instance, Conversion: &conversionInvalidation{From: from, To: to}})
+}
+
+func (iv *invalidator) send(ctx context.Context, message invalidation) error {
+	payload, _ := json.Marshal(message)
+	err := call(ctx, iv.client, func(client redis.UniversalClient) error {
+		return client.Publish(iv.channel, payload).Err()
+	})
+	if cancelled(err) {
+		return err
+	}
+	if err != nil {
+		iv.logger.Error(ctx, "publish_invalidation_redis", logging.Err(err))
+		return errors.New("Publish invalidation error")
+	}
+	return nil
+}
+
+// Subscribe listens to the invalidations in the background, subscribing again whenever the
+// subscription drops. The local cache is flushed on every subscription because the
+// invalidations published while it was down are lost.
+func (iv *invalidator) Subscribe() func() {
+	go func() {
+		attempt := 0
+		for {
+			iv.mu.Lock()
+			if iv.stopped {
+				iv.mu.Unlock()
+				return
+			}
+			iv.pubsub = iv.client.Subscribe(iv.channel)
+			pubsub := iv.pubsub
+			iv.mu.Unlock()
+
+			if iv.receive(pubsub) {
+				attempt = 0
+			}
+			pubsub.Close()
+			time.Sleep(resubscribeDelay(attempt))
+			attempt++
+		}
+	}()
+
+	return func() {
+		iv.mu.Lock()
+		defer iv.mu.Unlock()
+		iv.stopped = true
+		if iv.pubsub != nil {
+			iv.pubsub.Close()
+		}
+	}
+}
+
+// receive handles the messages until the subscription drops, it returns if it ever subscribed
+func (iv *invalidator) receive(pubsub *redis.PubSub) (subscribed bool) {
+	pinged := false
+	for {
+		msg, err := pubsub.ReceiveTimeout(iv.interval)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !pinged {
+				if err = pubsub.Ping(); err == nil {
+					pinged = true
+					continue
+				}
+			}
+			if !iv.isStopped() {
+				iv.logger.Error(context.Background(), "subscribe_invalidations_redis", logging.Err(err))
+			}
+			return
+		}
+		pinged = false
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				subscribed = true
+				iv.local.Flush()
+			}
+		case *redis.Message:
+			iv.handle(m.Payload)
+		}
+	}
+}
+
+// handle evicts the items or the conversions of an invalidation published by another instance
+func (iv *invalidator) handle(payload string) {
+	message := invalidation{}
+	if err := json.Unmarshal([]byte(payload), &message); err != nil {
+		iv.logger.Error(context.Background(), "invalidation_redis", logging.Err(err))
+		return
+	}
+	if message.Instance == iv.instance {
+		return
+	}
+	if message.Conversion != nil {
+		iv.local.DeleteConversionsFor(context.Background(), message.Conversion.From, message.Conversion.To)
+		return
+	}
+	iv.local.DeletePricesFor(context.Background(), message.ItemsCodes)
+}
+
+func (iv *invalidator) isStopped() bool {
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
+	return iv.stopped
+}
+
+// resubscribeDelay doubles on every failed attempt up to maxResubscribeDelay
+func resubscribeDelay(attempt int) time.Duration {
+	delay := 100 * time.Millisecond
+	for k := 0; k < attempt && delay < maxResubscribeDelay; k++ {
+		delay *= 2
+	}
+	if delay > maxResubscribeDelay {
+		return maxResubscribeDelay
+	}
+	return delay
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/settings"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidation_HandleSkipsOwnMessages(t *testing.T) {
+	local := NewLRU(10, time.Second, 0, 0)
+	local.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1"), "c2": usd("2")})
+	iv := newInvalidator(nil, "channel", local, nil)
+
+	iv.handle(`{"instance": "` + iv.instance + `", "items_codes": ["c1"]}`)
+	iv.handle(`{"instance": "other", "items_codes": ["c2"]}`)
+	iv.handle(`invalid`)
+
+	prices, _, _ := local.GetPricesFor(context.Background(), "", []string{"c1", "c2"})
+	assert.Len(t, prices, 1)
+	assert.Equal(t, usd("1"), prices["c1"])
+}
+
+func TestInvalidation_HandleConversions(t *testing.T) {
+	local := NewLRU(10, time.Second, 0, 0)
+	rate := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5")}
+	local.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")})
+	local.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c1": usd("1").ConvertWith(rate)})
+	iv := newInvalidator(nil, "channel", local, nil)
+
+	iv.handle(`{"instance": "other", "conversion": {"from": "USD", "to": "EUR"}}`)
+
+	_, _, err := local.GetPricesFor(context.Background(), "EUR", []string{"c1"})
+	assert.Equal(t, "Item c1 do not exist", err.Error())
+	prices, _, _ := local.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, usd("1"), prices["c1"], "only the conversion should be evicted")
+}
+
+func TestInvalidation_EvictsOtherInstances(t *testing.T) {
+	l2 := New(time.Second, 0, 0, nil)
+	local1 := NewLRU(10, time.Second, 0, 0)
+	local2 := NewLRU(10, time.Second, 0, 0)
+	instance1 := newInvalidator(l2.client, settings.Redis.InvalidationChannel, local1, nil)
+	instance2 := newInvalidator(l2.client, settings.Redis.InvalidationChannel, local2, nil)
+	defer instance1.Subscribe()()
+	defer instance2.Subscribe()()
+	time.Sleep(time.Millisecond * 100)
+
+	local1.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")})
+	local2.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")})
+	assert.Nil(t, instance1.publish(context.Background(), []string{"c1"}))
+	time.Sleep(time.Millisecond * 100)
+
+	_, _, err := local1.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, err)
+	_, _, err = local2.GetPricesFor(context.Background(), "", []string{"c1"})
+	if assert.NotNil(t, err, "the other instance should have evicted c1") {
+		assert.Contains(t, err.Error(), "Item c1 do not exist")
+	}
+}
+
+func TestInvalidation_ResubscribeDelay(t *testing.T) {
+	assert.Equal(t, time.Millisecond*100, resubscribeDelay(0))
+	assert.Equal(t, time.Millisecond*400, resubscribeDelay(2))
+	assert.Equal(t, maxResubscribeDelay, resubscribeDelay(20))
+}
@@ -0,0 +1,228 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+)
+
+type (
+	// lruRepository caches prices in process, holding at most size items and
+	// dropping the least recently used ones when it is full. Entries follow the
+	// same rules as the Redis hashes: the item own price and its conversions
+	// expire together, and an item known to have no price is an entry without prices.
+	lruRepository struct {
+		mu             sync.Mutex
+		size           int
+		entries        map[string]*list.Element
+		order          *list.List // front is the most recently used
+		defaultTimeout time.Duration
+		staleTimeout   time.Duration
+		missingTimeout time.Duration
+		counters       tierCounters
+	}
+
+	lruEntry struct {
+		itemCode  string
+		prices    map[money.Currency]items.Price // by currency, the item own price under ""
+		staleAt   time.Time
+		expiresAt time.Time
+	}
+)
+
+// NewLRU returns an in process cache of at most size items, where prices are fresh for defaultTime
+// and then stale for staleTime before they expire, items without price are remembered as missing for missingTime
+func NewLRU(size int, defaultTime time.Duration, staleTime time.Duration, missingTime time.Duration) *lruRepository {
+	return &lruRepository{
+		size:           size,
+		entries:        map[string]*list.Element{},
+		order:          list.New(),
+		defaultTimeout: defaultTime,
+		staleTimeout:   staleTime,
+		missingTimeout: missingTime,
+	}
+}
+
+// GetPricesFor returns the cached prices in the given currency, an empty currency
+// means the price in the item own currency. It also returns the items whose price is stale.
+func (lr *lruRepository) GetPricesFor(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, []string, error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	itemsPrice := map[string]items.Price{}
+	stale := []string{}
+	errorList := []string{}
+	now := time.Now()
+	for _, i := range itemsCode {
+		entry := lr.get(i, now)
+		if entry == nil {
+			errorList = append(errorList, fmt.Sprintf("Item %s do not exist", i))
+			continue
+		}
+		price, ok := entry.prices[currency]
+		if !ok {
+			errorList = append(errorList, fmt.Sprintf("Item %s do not exist", i))
+			continue
+		}
+		itemsPrice[i] = price
+		if !now.Before(entry.staleAt) {
+			stale = append(stale, i)
+		}
+	}
+
+	lr.counters.count(len(itemsPrice), len(itemsCode)-len(itemsPrice))
+	if len(errorList) > 0 {
+		return itemsPrice, stale, errors.New(strings.Join(errorList, ","))
+	}
+	return itemsPrice, stale, nil
+}
+
+// SetPricesFor caches the items own prices, dropping any conversion cached for them.
+// A price is never cached past its ValidUntil, not even as a stale one.
+func (lr *lruRepository) SetPricesFor(ctx context.Context, itemsPrice map[string]items.Price) error {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range itemsPrice {
+		lr.remove(k)
+		if fresh, ttl := ttlFor(v, lr.defaultTimeout, lr.staleTimeout); ttl > 0 {
+			lr.add(&lruEntry{
+				itemCode:  k,
+				prices:    map[money.Currency]items.Price{"": v},
+				staleAt:   now.Add(fresh),
+				expiresAt: now.Add(ttl),
+			})
+		}
+	}
+	return nil
+}
+
+// SetConversionsFor caches prices converted into currency next to the items own prices,
+// only while the item own price is cached
+func (lr *lruRepository) SetConversionsFor(ctx context.Context, currency money.Currency, itemsPrice map[string]items.Price) error {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range itemsPrice {
+		if entry := lr.get(k, now); entry != nil && len(entry.prices) > 0 {
+			entry.prices[currency] = v
+		}
+	}
+	return nil
+}
+
+// DeletePricesFor drops the items prices along with every conversion cached for them
+func (lr *lruRepository) DeletePricesFor(ctx context.Context, itemsCode []string) error {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for _, i := range itemsCode {
+		lr.remove(i)
+	}
+	return nil
+}
+
+// DeleteConversionsFor drops the prices converted from one currency into another, whatever the item
+func (lr *lruRepository) DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for _, element := range lr.entries {
+		entry := element.Value.(*lruEntry)
+		if price, ok := entry.prices[to]; ok && price.Conversion != nil && price.Conversion.From == from {
+			delete(entry.prices, to)
+		}
+	}
+	return nil
+}
+
+// GetMissingFor returns the items known to have no price
+func (lr *lruRepository) GetMissingFor(ctx context.Context, itemsCode []string) ([]string, error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	missing := []string{}
+	now := time.Now()
+	for _, i := range itemsCode {
+		if entry := lr.get(i, now); entry != nil && len(entry.prices) == 0 {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// SetMissingFor remembers the items have no price, caching a price for them clears it
+func (lr *lruRepository) SetMissingFor(ctx context.Context, itemsCode []string) error {
+	if lr.missingTimeout <= 0 {
+		return nil
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	now := time.Now()
+	for _, i := range itemsCode {
+		if lr.get(i, now) == nil {
+			lr.add(&lruEntry{itemCode: i, staleAt: now.Add(lr.missingTimeout), expiresAt: now.Add(lr.missingTimeout)})
+		}
+	}
+	return nil
+}
+
+// InvalidateFor does nothing, alone the in process cache is only meant for a single instance
+func (lr *lruRepository) InvalidateFor(ctx context.Context, itemsCode []string) error {
+	return nil
+}
+
+// Flush drops every item
+func (lr *lruRepository) Flush() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	lr.entries = map[string]*list.Element{}
+	lr.order.Init()
+}
+
+// Stats returns the lookups served and not served in process
+func (lr *lruRepository) Stats() []TierStats {
+	return []TierStats{lr.counters.stats("lru")}
+}
+
+// get returns the entry of the item marking it as recently used, expired entries are dropped
+func (lr *lruRepository) get(itemCode string, now time.Time) *lruEntry {
+	element, ok := lr.entries[itemCode]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*lruEntry)
+	if !now.Before(entry.expiresAt) {
+		lr.remove(itemCode)
+		return nil
+	}
+	lr.order.MoveToFront(element)
+	return entry
+}
+
+// add inserts the entry as the most recently used one, dropping the least recently used if full
+func (lr *lruRepository) add(entry *lruEntry) {
+	lr.entries[entry.itemCode] = lr.order.PushFront(entry)
+	for lr.size > 0 && lr.order.Len() > lr.size {
+		lr.remove(lr.order.Back().Value.(*lruEntry).itemCode)
+	}
+}
+
+func (lr *lruRepository) remove(itemCode string) {
+	if element, ok := lr.entries[itemCode]; ok {
+		lr.order.Remove(element)
+		delete(lr.entries, itemCode)
+	}
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU_GetPricesFor(t *testing.T) {
+	cache := NewLRU(10, time.Second, 0, 0)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("19.99")})
+
+	prices, stale, err := cache.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, err)
+	assert.Empty(t, stale)
+	assert.Equal(t, usd("19.99"), prices["c1"])
+
+	prices, _, err = cache.GetPricesFor(context.Background(), "", []string{"c1", "c2"})
+	assert.Equal(t, "Item c2 do not exist", err.Error())
+	assert.Equal(t, usd("19.99"), prices["c1"])
+}
+
+func TestLRU_ValueExpired(t *testing.T) {
+	cache := NewLRU(10, time.Millisecond*100, time.Millisecond*100, 0)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("5")})
+
+	time.Sleep(time.Millisecond * 150)
+	_, stale, err := cache.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c1"}, stale)
+
+	time.Sleep(time.Millisecond * 100)
+	_, _, err = cache.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, "Item c1 do not exist", err.Error())
+}
+
+func TestLRU_TTLClippedToValidUntil(t *testing.T) {
+	cache := NewLRU(10, time.Minute, time.Minute, 0)
+	price := usd("8")
+	price.ValidUntil = time.Now().Add(time.Millisecond * 100)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": price})
+
+	time.Sleep(time.Millisecond * 150)
+	_, _, err := cache.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Equal(t, "Item c1 do not exist", err.Error())
+}
+
+func TestLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewLRU(2, time.Second, 0, 0)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")})
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c2": usd("2")})
+	cache.GetPricesFor(context.Background(), "", []string{"c1"})
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c3": usd("3")})
+
+	prices, _, err := cache.GetPricesFor(context.Background(), "", []string{"c1", "c2", "c3"})
+	assert.Equal(t, "Item c2 do not exist", err.Error())
+	assert.Len(t, prices, 2)
+}
+
+func TestLRU_Conversions(t *testing.T) {
+	cache := NewLRU(10, time.Second, 0, 0)
+	rate := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5")}
+	cache.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c1": usd("10").ConvertWith(rate)})
+	_, _, err := cache.GetPricesFor(context.Background(), "EUR", []string{"c1"})
+	assert.Equal(t, "Item c1 do not exist", err.Error())
+
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("10")})
+	cache.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c1": usd("10").ConvertWith(rate)})
+	prices, _, err := cache.GetPricesFor(context.Background(), "EUR", []string{"c1"})
+	assert.Nil(t, err)
+	assert.Equal(t, usd("10").ConvertWith(rate), prices["c1"])
+
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("12")})
+	_, _, err = cache.GetPricesFor(context.Background(), "EUR", []string{"c1"})
+	assert.Equal(t, "Item c1 do not exist", err.Error())
+}
+
+func TestLRU_DeleteConversions(t *testing.T) {
+	cache := NewLRU(10, time.Second, 0, 0)
+	gbp := items.NewPrice(money.MustParse("10"), "GBP")
+	fromUSD := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5")}
+	fromGBP := money.ExchangeRate{From: "GBP", To: "EUR", Rate: money.MustParseRate("1.2")}
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("10"), "c2": gbp})
+	cache.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c1": usd("10").ConvertWith(fromUSD), "c2": gbp.ConvertWith(fromGBP)})
+
+	assert.Nil(t, cache.DeleteConversionsFor(context.Background(), "USD", "EUR"))
+
+	prices, _, err := cache.GetPricesFor(context.Background(), "EUR", []string{"c1", "c2"})
+	assert.Equal(t, "Item c1 do not exist", err.Error())
+	assert.Equal(t, map[string]items.Price{"c2": gbp.ConvertWith(fromGBP)}, prices)
+	prices, _, err = cache.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, err)
+	assert.Equal(t, usd("10"), prices["c1"])
+}
+
+func TestLRU_Missing(t *testing.T) {
+	cache := NewLRU(10, time.Second, 0, time.Millisecond*100)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c2": usd("3")})
+	cache.SetMissingFor(context.Background(), []string{"c1", "c2"})
+
+	missing, _ := cache.GetMissingFor(context.Background(), []string{"c1", "c2", "c3"})
+	assert.Equal(t, []string{"c1"}, missing)
+
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("4")})
+	missing, _ = cache.GetMissingFor(context.Background(), []string{"c1"})
+	assert.Empty(t, missing)
+
+	cache.SetMissingFor(context.Background(), []string{"c3"})
+	time.Sleep(time.Millisecond * 150)
+	missing, _ = cache.GetMissingFor(context.Background(), []string{"c3"})
+	assert.Empty(t, missing)
+}
+
+func TestLRU_Delete(t *testing.T) {
+	cache := NewLRU(10, time.Second, 0, 0)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("10"), "c2": usd("4")})
+
+	cache.DeletePricesFor(context.Background(), []string{"c1"})
+	prices, _, err := cache.GetPricesFor(context.Background(), "", []string{"c1", "c2"})
+	assert.Equal(t, "Item c1 do not exist", err.Error())
+	assert.Equal(t, usd("4"), prices["c2"])
+}
+
+func TestLRU_Stats(t *testing.T) {
+	cache := NewLRU(10, time.Second, 0, 0)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("10")})
+	cache.GetPricesFor(context.Background(), "", []string{"c1", "c2", "c3"})
+
+	assert.Equal(t, []TierStats{{Tier: "lru", Hits: 1, Misses: 2}}, cache.Stats())
+}
@@ -0,0 +1,6 @@
+package cache
+
+import "github.com/ldegaetano/go-ddd-example/metrics"
+
+// redisErrors counts the failed calls, the lookups of every tier are in the Stats of the caches
+var redisErrors = metrics.NewCounter("cache_errors_total", "Redis calls that could not reach Redis by call", "call")
@@ -1,63 +1,569 @@
 package cache
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/labstack/gommon/log"
+	"github.com/go-redis/redis"
 
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
 	"github.com/ldegaetano/go-ddd-example/settings"
+	"github.com/ldegaetano/go-ddd-example/tracing"
 )
 
-func (cr cacheRepository) GetPricesFor(itemsCode []string) (map[string]float64, error) {
-	itemsPrice := map[string]float64{}
+// Every item is a hash holding its own price in rawField and its conversions
+// in one field per currency, so replacing the price drops every conversion.
+// staleAtField has the unix milliseconds after which the hash is stale, the key
+// itself expires later on so stale prices can be served while they are refreshed.
+// An item known to have no price is a hash with only missingField.
+const (
+	rawField     = "raw"
+	staleAtField = "stale_at"
+	missingField = "missing"
 
-	cmd := cr.client.MGet(buildPricesKeys(itemsCode)...)
-	if err := cmd.Err(); err != nil {
-		log.Errorf("[process:get_redis][err:%s]", err.Error())
-		return itemsPrice, errors.New("Redis get error")
+	// scanCount is how many keys are scanned at once when every item has to be changed
+	scanCount = 500
+
+	// entryVersion prefixes the entries, entries without it were written by older instances
+	entryVersion = "v2"
+)
+
+// setConversionScript only adds a conversion while the item price is cached,
+// this way conversions never outlive the price they were computed from
+var setConversionScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0`)
+
+// deleteConversionScript drops a conversion unless it was replaced in the meantime
+var deleteConversionScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call("HDEL", KEYS[1], ARGV[1])
+end
+return 0`)
+
+// setMissingScript marks an item as missing unless a price was cached for it in the meantime
+var setMissingScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("HSET", KEYS[1], ARGV[1], "1")
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// GetPricesFor returns the cached prices in the given currency, an empty currency
+// means the price in the item own currency. It also returns the items whose price is stale.
+func (cr cacheRepository) GetPricesFor(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, []string, error) {
+	ctx, span := tracing.Start(ctx, "redis.GetPricesFor", tracing.Int("items.count", len(itemsCode)))
+	defer span.End()
+
+	itemsPrice := map[string]items.Price{}
+	stale := []string{}
+
+	field := buildPriceField(currency)
+	cmds := make([]*redis.SliceCmd, len(itemsCode))
+	legacyCmds := make([]*redis.StringCmd, len(itemsCode))
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+			for k, i := range itemsCode {
+				cmds[k] = pipe.HMGet(buildPriceKey(i), field, staleAtField)
+				// legacy entries only hold the price in the default currency, never conversions
+				if settings.Redis.LegacyKeys && field == rawField {
+					legacyCmds[k] = pipe.Get(buildLegacyPriceKey(i))
+				}
+			}
+			return nil
+		})
+		if err == redis.Nil {
+			// a legacy entry missing, only the errors of the versioned entries fail the lookup
+			for _, cmd := range cmds {
+				if err := cmd.Err(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return err
+	})
+	if cancelled(err) {
+		span.RecordError(err)
+		return itemsPrice, stale, err
+	}
+	if err != nil {
+		cr.logger.Error(ctx, "get_redis", logging.Err(err))
+		redisErrors.Inc("get_prices")
+		span.RecordError(err)
+		cr.counters.count(0, len(itemsCode))
+		return itemsPrice, stale, unavailable("Redis get error")
 	}
 
+	now := time.Now()
 	errorList := []string{}
-	for k, v := range cmd.Val() {
+	for k, cmd := range cmds {
+		v := cmd.Val()[0]
+		if v == nil && legacyCmds[k] != nil && legacyCmds[k].Err() == nil {
+			v = legacyCmds[k].Val()
+		}
 		if v == nil {
 			errorList = append(errorList, fmt.Sprintf("Item %s do not exist", itemsCode[k]))
 			continue
 		}
-		price, err := strconv.ParseFloat(v.(string), 64)
+		price, err := decodePrice(v.(string))
 		if err != nil {
 			errorList = append(errorList, fmt.Sprintf("Invalid value for %s", itemsCode[k]))
 			continue
 		}
 		itemsPrice[itemsCode[k]] = price
+		if isStale(cmd.Val()[1], now) {
+			stale = append(stale, itemsCode[k])
+		}
 	}
 
+	cr.counters.count(len(itemsPrice), len(itemsCode)-len(itemsPrice))
+	span.SetAttributes(tracing.Int("cache.hits", len(itemsPrice)), tracing.Int("cache.stale", len(stale)))
 	if len(errorList) > 0 {
-		return itemsPrice, errors.New(strings.Join(errorList, ","))
+		return itemsPrice, stale, errors.New(strings.Join(errorList, ","))
+	}
+	return itemsPrice, stale, nil
+}
+
+// SetPricesFor caches the items own prices, dropping any conversion cached for them, in a single
+// MULTI/EXEC transaction. A price is never cached past its ValidUntil, not even as a stale one.
+// Expirations get a random jitter so prices cached together do not expire together.
+// When some items could not be cached the error is a *WriteError listing them.
+func (cr cacheRepository) SetPricesFor(ctx context.Context, itemsPrice map[string]items.Price) error {
+	ctx, span := tracing.Start(ctx, "redis.SetPricesFor", tracing.Int("items.count", len(itemsPrice)))
+	defer span.End()
+
+	if len(itemsPrice) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	cmds := map[string][]redis.Cmder{}
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+			for k, v := range itemsPrice {
+				key := buildPriceKey(k)
+				cmds[k] = append(cmds[k], pipe.Del(key))
+				if settings.Redis.LegacyKeys {
+					cmds[k] = append(cmds[k], pipe.Del(buildLegacyPriceKey(k)))
+				}
+				if fresh, ttl := cr.ttlFor(v); ttl > 0 {
+					cmds[k] = append(cmds[k],
+						pipe.HMSet(key, map[string]interface{}{
+							rawField:     encodePrice(v),
+							staleAtField: strconv.FormatInt(toMillis(now.Add(fresh)), 10),
+						}),
+						pipe.PExpire(key, ttl),
+					)
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	span.RecordError(err)
+	if cancelled(err) {
+		return err
 	}
-	return itemsPrice, nil
+
+	cr.logger.Error(ctx, "set_redis", logging.Err(err))
+	redisErrors.Inc("set_prices")
+	failed := []string{}
+	// a transaction given up on may still be running, its commands can not be read
+	if err != errCommandTimeout {
+		for k, keyCmds := range cmds {
+			for _, cmd := range keyCmds {
+				if cmd.Err() != nil {
+					failed = append(failed, k)
+					break
+				}
+			}
+		}
+	}
+	if len(failed) == 0 {
+		for k := range itemsPrice {
+			failed = append(failed, k)
+		}
+	}
+	sort.Strings(failed)
+	return &WriteError{ItemsCode: failed}
 }
 
-func (cr cacheRepository) SetPricesFor(itemsPrice map[string]float64) error {
-	for k, v := range itemsPrice {
-		cmd := cr.client.Set(buildPriceKey(k), v, cr.defaultTimeout)
-		if err := cmd.Err(); err != nil {
-			log.Errorf("[process:set_redis][err:%s]", err.Error())
-			return errors.New("Set cache error")
+// SetConversionsFor caches prices converted into currency next to the items own prices
+func (cr cacheRepository) SetConversionsFor(ctx context.Context, currency money.Currency, itemsPrice map[string]items.Price) error {
+	ctx, span := tracing.Start(ctx, "redis.SetConversionsFor", tracing.Int("items.count", len(itemsPrice)))
+	defer span.End()
+
+	field := buildPriceField(currency)
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		for k, v := range itemsPrice {
+			cmd := setConversionScript.Run(client, []string{buildPriceKey(k)}, field, encodePrice(v))
+			if err := cmd.Err(); err != nil && err != redis.Nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	span.RecordError(err)
+	if cancelled(err) {
+		return err
+	}
+	cr.logger.Error(ctx, "set_conversion_redis", logging.Err(err))
+	redisErrors.Inc("set_conversions")
+	return unavailable("Set cache error")
+}
+
+// GetMissingFor returns the items known to have no price
+func (cr cacheRepository) GetMissingFor(ctx context.Context, itemsCode []string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "redis.GetMissingFor", tracing.Int("items.count", len(itemsCode)))
+	defer span.End()
+
+	missing := []string{}
+
+	cmds := make([]*redis.BoolCmd, len(itemsCode))
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+			for k, i := range itemsCode {
+				cmds[k] = pipe.HExists(buildPriceKey(i), missingField)
+			}
+			return nil
+		})
+		return err
+	})
+	if cancelled(err) {
+		span.RecordError(err)
+		return missing, err
+	}
+	if err != nil {
+		cr.logger.Error(ctx, "get_missing_redis", logging.Err(err))
+		redisErrors.Inc("get_missing")
+		span.RecordError(err)
+		return missing, unavailable("Redis get error")
+	}
+	for k, cmd := range cmds {
+		if cmd.Val() {
+			missing = append(missing, itemsCode[k])
+		}
+	}
+	span.SetAttributes(tracing.Int("items.missing", len(missing)))
+	return missing, nil
+}
+
+// SetMissingFor remembers the items have no price, caching a price for them clears it
+func (cr cacheRepository) SetMissingFor(ctx context.Context, itemsCode []string) error {
+	ctx, span := tracing.Start(ctx, "redis.SetMissingFor", tracing.Int("items.count", len(itemsCode)))
+	defer span.End()
+
+	if cr.missingTimeout <= 0 {
+		return nil
+	}
+
+	ttl := strconv.FormatInt(int64(cr.missingTimeout/time.Millisecond), 10)
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		for _, i := range itemsCode {
+			cmd := setMissingScript.Run(client, []string{buildPriceKey(i)}, missingField, ttl)
+			if err := cmd.Err(); err != nil && err != redis.Nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	span.RecordError(err)
+	if cancelled(err) {
+		return err
+	}
+	cr.logger.Error(ctx, "set_missing_redis", logging.Err(err))
+	redisErrors.Inc("set_missing")
+	return unavailable("Set cache error")
+}
+
+// DeletePricesFor drops the items prices along with every conversion cached for them, and their legacy entries
+func (cr cacheRepository) DeletePricesFor(ctx context.Context, itemsCode []string) error {
+	ctx, span := tracing.Start(ctx, "redis.DeletePricesFor", tracing.Int("items.count", len(itemsCode)))
+	defer span.End()
+
+	if len(itemsCode) == 0 {
+		return nil
+	}
+
+	// one DEL per key, a Cluster can not delete keys of different slots at once
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, i := range itemsCode {
+				pipe.Del(buildPriceKey(i))
+				if settings.Redis.LegacyKeys {
+					pipe.Del(buildLegacyPriceKey(i))
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	if cancelled(err) {
+		span.RecordError(err)
+		return err
+	}
+	if err != nil {
+		cr.logger.Error(ctx, "delete_redis", logging.Err(err))
+		redisErrors.Inc("delete_prices")
+		span.RecordError(err)
+		return unavailable("Delete cache error")
 	}
 	return nil
 }
 
-func buildPricesKeys(itemsCode []string) (keys []string) {
-	for _, i := range itemsCode {
-		keys = append(keys, buildPriceKey(i))
+// DeleteConversionsFor drops the prices converted from one currency into another, scanning every cached item.
+// Conversions cached in the meantime are kept, they were converted with the rate as it is now.
+func (cr cacheRepository) DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error {
+	ctx, span := tracing.Start(ctx, "redis.DeleteConversionsFor")
+	defer span.End()
+
+	field := buildPriceField(to)
+	var cursor uint64
+	for {
+		keys, next, err := cr.scanKeys(ctx, cursor, scanCount)
+		if err == nil {
+			err = cr.deleteConversions(ctx, keys, field, from)
+		}
+		if cancelled(err) {
+			span.RecordError(err)
+			return err
+		}
+		if err != nil {
+			cr.logger.Error(ctx, "delete_conversions_redis", logging.Err(err))
+			redisErrors.Inc("delete_conversions")
+			span.RecordError(err)
+			return unavailable("Delete cache error")
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// deleteConversions drops the field of the keys when it holds a price converted from currency,
+// entries that can not be decoded are dropped as well
+func (cr cacheRepository) deleteConversions(ctx context.Context, keys []string, field string, from money.Currency) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return call(ctx, cr.client, func(client redis.UniversalClient) error {
+		cmds := make([]*redis.StringCmd, len(keys))
+		_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+			for k, key := range keys {
+				cmds[k] = pipe.HGet(key, field)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		for k, cmd := range cmds {
+			v, err := cmd.Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if price, err := decodePrice(v); err == nil && (price.Conversion == nil || price.Conversion.From != from) {
+				continue
+			}
+			if err := deleteConversionScript.Run(client, []string{keys[k]}, field, v).Err(); err != nil && err != redis.Nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// InvalidateFor does nothing, Redis is shared by every instance
+func (cr cacheRepository) InvalidateFor(ctx context.Context, itemsCode []string) error {
+	return nil
+}
+
+// Stats returns the lookups served and not served by Redis
+func (cr cacheRepository) Stats() []TierStats {
+	return []TierStats{cr.counters.stats("redis")}
+}
+
+func (cr cacheRepository) ttlFor(p items.Price) (time.Duration, time.Duration) {
+	return ttlFor(p, cr.defaultTimeout+jitterFor(cr.defaultTimeout, cr.jitter), cr.staleTimeout)
+}
+
+// jitterFor returns a random duration up to the fraction of d
+func jitterFor(d time.Duration, fraction float64) time.Duration {
+	max := int64(float64(d) * fraction)
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(max + 1))
+}
+
+// ttlFor returns for how long the price is fresh and for how long it is kept at all,
+// both clipped so the price does not outlive its window
+func ttlFor(p items.Price, defaultTimeout time.Duration, staleTimeout time.Duration) (fresh time.Duration, ttl time.Duration) {
+	fresh, ttl = defaultTimeout, defaultTimeout+staleTimeout
+	if p.ValidUntil.IsZero() {
+		return
+	}
+	untilEnd := time.Until(p.ValidUntil)
+	if untilEnd < fresh {
+		fresh = untilEnd
+	}
+	if untilEnd < ttl {
+		ttl = untilEnd
 	}
 	return
 }
 
+// isStale tells if the stale_at value of a hash is already past, hashes without it are fresh
+func isStale(staleAt interface{}, now time.Time) bool {
+	s, ok := staleAt.(string)
+	if !ok {
+		return false
+	}
+	millis, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return false
+	}
+	return toMillis(now) >= millis
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 func buildPriceKey(itemsCode string) string {
 	return fmt.Sprintf(settings.Redis.PriceKey, itemsCode)
 }
+
+func buildLegacyPriceKey(itemsCode string) string {
+	return fmt.Sprintf(settings.Redis.LegacyPriceKey, itemsCode)
+}
+
+func buildPriceField(currency money.Currency) string {
+	if currency == "" {
+		return rawField
+	}
+	return currency.String()
+}
+
+// encodePrice writes the versioned entry "v2|amount|currency|loaded_at|version" where loaded_at
+// is in unix milliseconds and, for converted prices, "|from|rate|updated_at" after it
+func encodePrice(p items.Price) string {
+	loadedAt := int64(0)
+	if !p.LoadedAt.IsZero() {
+		loadedAt = toMillis(p.LoadedAt)
+	}
+	fields := []string{entryVersion, p.Amount.String(), p.Currency.String(),
+		strconv.FormatInt(loadedAt, 10), strconv.FormatInt(p.Version, 10)}
+	if c := p.Conversion; c != nil {
+		fields = append(fields, c.From.String(), c.Rate.String(), strconv.FormatInt(c.UpdatedAt.Unix(), 10))
+	}
+	return strings.Join(fields, "|")
+}
+
+// decodePrice reads the entries written by encodePrice along with the ones written before
+// entries were versioned: "amount|currency[|from|rate|updated_at]" and the bare amount
+func decodePrice(v string) (items.Price, error) {
+	fields := strings.Split(v, "|")
+	if fields[0] != entryVersion {
+		return decodeLegacyPrice(fields)
+	}
+	if len(fields) != 5 && len(fields) != 8 {
+		return items.Price{}, errors.New("invalid price format")
+	}
+
+	price, err := decodeAmount(fields[1], fields[2])
+	if err != nil {
+		return items.Price{}, err
+	}
+	loadedAt, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return items.Price{}, err
+	}
+	if loadedAt > 0 {
+		price.LoadedAt = time.Unix(0, loadedAt*int64(time.Millisecond)).UTC()
+	}
+	if price.Version, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+		return items.Price{}, err
+	}
+	if len(fields) == 8 {
+		err = decodeConversion(&price, fields[5:])
+	}
+	return price, err
+}
+
+func decodeLegacyPrice(fields []string) (items.Price, error) {
+	switch len(fields) {
+	case 1:
+		// written back when every price was in the default currency
+		return decodeAmount(fields[0], money.DefaultCurrency.String())
+	case 2:
+		return decodeAmount(fields[0], fields[1])
+	case 5:
+		price, err := decodeAmount(fields[0], fields[1])
+		if err != nil {
+			return price, err
+		}
+		return price, decodeConversion(&price, fields[2:])
+	}
+	return items.Price{}, errors.New("invalid price format")
+}
+
+func decodeAmount(amountField, currencyField string) (items.Price, error) {
+	amount, err := money.Parse(amountField)
+	if err != nil {
+		return items.Price{}, err
+	}
+	currency, err := money.ParseCurrency(currencyField)
+	if err != nil {
+		return items.Price{}, err
+	}
+	return items.NewPrice(amount, currency), nil
+}
+
+// decodeConversion reads the "from|rate|updated_at" fields of a converted price
+func decodeConversion(price *items.Price, fields []string) error {
+	from, err := money.ParseCurrency(fields[0])
+	if err != nil {
+		return err
+	}
+	rate, err := money.ParseRate(fields[1])
+	if err != nil {
+		return err
+	}
+	updatedAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	price.Conversion = &money.ExchangeRate{
+		From:      from,
+		To:        price.Currency,
+		Rate:      rate,
+		UpdatedAt: time.Unix(updatedAt, 0).UTC(),
+	}
+	return nil
+}
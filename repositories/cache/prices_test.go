@@ -1,18 +1,24 @@
 package cache
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
 	"github.com/ldegaetano/go-ddd-example/settings"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestPriceFor_RedisNil(t *testing.T) {
-	cache := New(time.Second)
-	_, err := cache.GetPricesFor([]string{"c1"})
+	cache := New(time.Second, 0, 0, nil)
+	_, _, err := cache.GetPricesFor(context.Background(), "", []string{"c1"})
 
 	assert.Contains(t, err.Error(), "Item c1 do not exist")
 }
@@ -20,8 +26,8 @@ func TestPriceFor_RedisNil(t *testing.T) {
 func TestPriceFor_RedisGetError(t *testing.T) {
 	aux := settings.Redis.Host
 	settings.Redis.Host = "invalid_host"
-	cache := New(time.Second)
-	_, err := cache.GetPricesFor([]string{"c1"})
+	cache := New(time.Second, 0, 0, nil)
+	_, _, err := cache.GetPricesFor(context.Background(), "", []string{"c1"})
 
 	assert.Contains(t, err.Error(), "Redis get error")
 	settings.Redis.Host = aux
@@ -30,46 +36,352 @@ func TestPriceFor_RedisGetError(t *testing.T) {
 func TestPriceFor_RedisSetError(t *testing.T) {
 	aux := settings.Redis.Host
 	settings.Redis.Host = "invalid_host"
-	cache := New(time.Second)
-	itemsPrices := map[string]float64{
-		"c3": 1,
-		"c5": 3,
+	cache := New(time.Second, 0, 0, nil)
+	itemsPrices := map[string]items.Price{
+		"c3": usd("1"),
+		"c5": usd("3"),
 	}
-	err := cache.SetPricesFor(itemsPrices)
+	err := cache.SetPricesFor(context.Background(), itemsPrices)
 
-	assert.NotNil(t, err)
+	writeErr, ok := err.(*WriteError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"c3", "c5"}, writeErr.ItemsCode)
+	assert.Equal(t, "Set cache error: c3,c5", err.Error())
 	settings.Redis.Host = aux
 }
 
+func TestPriceFor_ExpirationJitter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), jitterFor(time.Minute, 0))
+	for k := 0; k < 100; k++ {
+		jitter := jitterFor(time.Second, 0.1)
+		assert.True(t, jitter >= 0 && jitter <= 100*time.Millisecond)
+	}
+}
+
+func TestPriceFor_CancelledContext(t *testing.T) {
+	aux := settings.Redis.Host
+	settings.Redis.Host = "invalid_host"
+	defer func() { settings.Redis.Host = aux }()
+	cache := New(time.Second, 0, 0, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := cache.GetPricesFor(ctx, "", []string{"c1"})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, cache.SetPricesFor(ctx, map[string]items.Price{"c1": usd("1")}))
+	assert.Equal(t, uint64(0), cache.Stats()[0].Misses, "a cancelled lookup should not count")
+}
+
+func TestPriceFor_CancelledContextDuringCall(t *testing.T) {
+	// a Redis that never answers, the read timeout alone would keep the calls waiting for a minute
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	aux := settings.Redis
+	defer func() { settings.Redis = aux }()
+	settings.Redis.Host, settings.Redis.Port, _ = net.SplitHostPort(listener.Addr().String())
+	settings.Redis.ReadTimeout = time.Minute
+	settings.Redis.CommandTimeout = 0
+	cache := New(time.Second, 0, 0, nil)
+	defer cache.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = cache.GetPricesFor(ctx, "", []string{"c1"})
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second, "the call should return once cancelled")
+
+	settings.Redis.CommandTimeout = 50 * time.Millisecond
+	start = time.Now()
+	err = cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1"), "c2": usd("2")})
+	assert.Equal(t, "Set cache error: c1,c2", err.Error())
+	assert.True(t, time.Since(start) < time.Second, "the call should be given up on after the command timeout")
+}
+
+func TestPriceFor_Topology(t *testing.T) {
+	aux := settings.Redis
+	defer func() { settings.Redis = aux }()
+
+	settings.Redis.TLS = true
+	client, ok := newClient().(*redis.Client)
+	assert.True(t, ok)
+	assert.Equal(t, settings.Redis.Host, client.Options().TLSConfig.ServerName)
+
+	settings.Redis.ClusterAddrs = []string{"node1:6379", "node2:6379"}
+	cluster, ok := newClient().(*redis.ClusterClient)
+	assert.True(t, ok)
+	assert.Equal(t, "", cluster.Options().TLSConfig.ServerName, "every node should be verified against its own host")
+
+	settings.Redis.SentinelMaster = "prices"
+	settings.Redis.SentinelAddrs = []string{"sentinel1:26379"}
+	client, ok = newClient().(*redis.Client)
+	assert.True(t, ok, "Sentinel should take precedence over the Cluster")
+	assert.Equal(t, "", client.Options().TLSConfig.ServerName, "the master should be verified against its own host")
+
+	settings.Redis.TLSServerName = "redis.internal"
+	client, _ = newClient().(*redis.Client)
+	assert.Equal(t, "redis.internal", client.Options().TLSConfig.ServerName)
+}
+
 func TestPriceFor_InvalidFormat(t *testing.T) {
-	cache := New(time.Second)
-	cache.client.Set(fmt.Sprintf(settings.Redis.PriceKey, "c3"), "invalid_format", time.Second)
-	_, err := cache.GetPricesFor([]string{"c3"})
+	cache := New(time.Second, 0, 0, nil)
+	cache.client.HSet(fmt.Sprintf(settings.Redis.PriceKey, "c3"), rawField, "invalid_format")
+	_, _, err := cache.GetPricesFor(context.Background(), "", []string{"c3"})
 
 	assert.Contains(t, err.Error(), "Invalid value for c3")
 }
 
+func TestPriceFor_KeepsExactDecimals(t *testing.T) {
+	cache := New(time.Second, 0, 0, nil)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c6": usd("19.99")})
+	prices, _, err := cache.GetPricesFor(context.Background(), "", []string{"c6"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "19.99", prices["c6"].Amount.String())
+}
+
+func TestPriceFor_Conversions(t *testing.T) {
+	cache := New(time.Second, 0, 0, nil)
+	rate := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5"), UpdatedAt: time.Unix(1600000000, 0).UTC()}
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c8": usd("10")})
+	cache.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c8": usd("10").ConvertWith(rate)})
+
+	prices, _, err := cache.GetPricesFor(context.Background(), "EUR", []string{"c8"})
+	assert.Nil(t, err)
+	assert.Equal(t, usd("10").ConvertWith(rate), prices["c8"])
+
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c8": usd("12")})
+	_, _, err = cache.GetPricesFor(context.Background(), "EUR", []string{"c8"})
+	assert.Contains(t, err.Error(), "Item c8 do not exist")
+}
+
+func TestPriceFor_DeleteConversions(t *testing.T) {
+	cache := New(time.Second, 0, 0, nil)
+	gbp := items.NewPrice(money.MustParse("10"), "GBP")
+	updatedAt := time.Unix(1600000000, 0).UTC()
+	fromUSD := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5"), UpdatedAt: updatedAt}
+	fromGBP := money.ExchangeRate{From: "GBP", To: "EUR", Rate: money.MustParseRate("1.2"), UpdatedAt: updatedAt}
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c10": usd("10"), "c11": gbp})
+	cache.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c10": usd("10").ConvertWith(fromUSD), "c11": gbp.ConvertWith(fromGBP)})
+
+	assert.Nil(t, cache.DeleteConversionsFor(context.Background(), "USD", "EUR"))
+
+	prices, _, err := cache.GetPricesFor(context.Background(), "EUR", []string{"c10", "c11"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Item c10 do not exist")
+	}
+	assert.Equal(t, gbp.ConvertWith(fromGBP), prices["c11"])
+	prices, _, err = cache.GetPricesFor(context.Background(), "", []string{"c10"})
+	assert.Nil(t, err)
+	assert.Equal(t, usd("10"), prices["c10"])
+}
+
+func TestPriceFor_ConversionsNeedCachedPrice(t *testing.T) {
+	cache := New(time.Second, 0, 0, nil)
+	rate := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5")}
+	cache.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c9": usd("10").ConvertWith(rate)})
+
+	_, _, err := cache.GetPricesFor(context.Background(), "EUR", []string{"c9"})
+	assert.Contains(t, err.Error(), "Item c9 do not exist")
+}
+
 func TestPriceFor_ValueExpired(t *testing.T) {
-	cache := New(time.Millisecond * 100)
+	cache := New(time.Millisecond*100, 0, 0, nil)
 	delay := time.Millisecond * 200
-	itemsPrices := map[string]float64{
-		"c3": 10.5,
-		"c5": 3,
+	itemsPrices := map[string]items.Price{
+		"c3": usd("10.5"),
+		"c5": usd("3"),
 	}
-	cache.SetPricesFor(itemsPrices)
-	price, err := cache.GetPricesFor([]string{"c3"})
+	cache.SetPricesFor(context.Background(), itemsPrices)
+	price, _, err := cache.GetPricesFor(context.Background(), "", []string{"c3"})
 
 	assert.Nil(t, err)
-	assert.Equal(t, 10.5, price["c3"])
+	assert.Equal(t, usd("10.50"), price["c3"])
 
 	time.Sleep(delay)
-	itemsPrices = map[string]float64{
-		"c4": 9,
-		"c7": 3,
+	itemsPrices = map[string]items.Price{
+		"c4": usd("9"),
+		"c7": usd("3"),
 	}
-	cache.SetPricesFor(itemsPrices)
+	cache.SetPricesFor(context.Background(), itemsPrices)
 
-	prices, err := cache.GetPricesFor([]string{"c4", "c3"})
+	prices, _, err := cache.GetPricesFor(context.Background(), "", []string{"c4", "c3"})
 	assert.Contains(t, "Item c3 do not exist", err.Error())
-	assert.Equal(t, float64(9), prices["c4"])
+	assert.Equal(t, usd("9"), prices["c4"])
+}
+
+func TestPriceFor_TTLClippedToValidUntil(t *testing.T) {
+	cache := New(time.Minute, 0, 0, nil)
+	price := usd("8")
+	price.ValidUntil = time.Now().Add(time.Millisecond * 100)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c10": price})
+
+	_, _, err := cache.GetPricesFor(context.Background(), "", []string{"c10"})
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 200)
+	_, _, err = cache.GetPricesFor(context.Background(), "", []string{"c10"})
+	assert.Contains(t, err.Error(), "Item c10 do not exist")
+}
+
+func TestPriceFor_StaleBeforeExpired(t *testing.T) {
+	cache := New(time.Millisecond*100, time.Millisecond*200, 0, nil)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c14": usd("5")})
+
+	prices, stale, err := cache.GetPricesFor(context.Background(), "", []string{"c14"})
+	assert.Nil(t, err)
+	assert.Empty(t, stale)
+	assert.Equal(t, usd("5"), prices["c14"])
+
+	time.Sleep(time.Millisecond * 150)
+	prices, stale, err = cache.GetPricesFor(context.Background(), "", []string{"c14"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c14"}, stale)
+	assert.Equal(t, usd("5"), prices["c14"])
+
+	time.Sleep(time.Millisecond * 200)
+	_, _, err = cache.GetPricesFor(context.Background(), "", []string{"c14"})
+	assert.Contains(t, err.Error(), "Item c14 do not exist")
+}
+
+func TestPriceFor_StaleNotPastValidUntil(t *testing.T) {
+	cache := New(time.Minute, time.Minute, 0, nil)
+	price := usd("8")
+	price.ValidUntil = time.Now().Add(time.Millisecond * 100)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c15": price})
+
+	time.Sleep(time.Millisecond * 200)
+	_, _, err := cache.GetPricesFor(context.Background(), "", []string{"c15"})
+	assert.Contains(t, err.Error(), "Item c15 do not exist")
+}
+
+func TestPriceFor_Missing(t *testing.T) {
+	cache := New(time.Second, 0, time.Millisecond*100, nil)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c17": usd("3")})
+	cache.SetMissingFor(context.Background(), []string{"c16", "c17"})
+
+	missing, err := cache.GetMissingFor(context.Background(), []string{"c16", "c17", "c18"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c16"}, missing)
+	_, _, err = cache.GetPricesFor(context.Background(), "", []string{"c16"})
+	assert.Contains(t, err.Error(), "Item c16 do not exist")
+
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c16": usd("4")})
+	missing, _ = cache.GetMissingFor(context.Background(), []string{"c16"})
+	assert.Empty(t, missing)
+
+	cache.SetMissingFor(context.Background(), []string{"c18"})
+	time.Sleep(time.Millisecond * 150)
+	missing, _ = cache.GetMissingFor(context.Background(), []string{"c18"})
+	assert.Empty(t, missing)
+}
+
+func TestPriceFor_Delete(t *testing.T) {
+	cache := New(time.Second, 0, 0, nil)
+	rate := money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5")}
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c11": usd("10"), "c12": usd("4")})
+	cache.SetConversionsFor(context.Background(), "EUR", map[string]items.Price{"c11": usd("10").ConvertWith(rate)})
+
+	err := cache.DeletePricesFor(context.Background(), []string{"c11", "c13"})
+	assert.Nil(t, err)
+
+	prices, _, err := cache.GetPricesFor(context.Background(), "", []string{"c11", "c12"})
+	assert.Contains(t, err.Error(), "Item c11 do not exist")
+	assert.Equal(t, usd("4"), prices["c12"])
+	_, _, err = cache.GetPricesFor(context.Background(), "EUR", []string{"c11"})
+	assert.Contains(t, err.Error(), "Item c11 do not exist")
+}
+
+func TestPriceFor_Inspect(t *testing.T) {
+	cache := New(time.Minute, 0, time.Minute, nil)
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c16": usd("6")})
+	cache.SetMissingFor(context.Background(), []string{"c17"})
+
+	prices, missing, err := cache.InspectPricesFor(context.Background(), []string{"c16", "c17", "c18"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]items.Price{"c16": usd("6")}, prices)
+	assert.Equal(t, []string{"c17"}, missing)
+
+	scanned := []string{}
+	var cursor uint64
+	for {
+		itemsCode, next, err := cache.ScanItemCodes(context.Background(), cursor, 100)
+		assert.Nil(t, err)
+		scanned = append(scanned, itemsCode...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	assert.Contains(t, scanned, "c16")
+	assert.Contains(t, scanned, "c17")
+}
+
+func TestPriceFor_EncodesVersionedEntries(t *testing.T) {
+	loadedAt := time.Date(2020, 5, 1, 10, 0, 0, int(time.Millisecond)*250, time.UTC)
+	price := usd("10.5")
+	price.LoadedAt, price.Version = loadedAt, 3
+	converted := price.ConvertWith(money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.9"), UpdatedAt: loadedAt.Truncate(time.Second)})
+
+	assert.Equal(t, "v2|10.50|USD|1588327200250|3", encodePrice(price))
+	for _, p := range []items.Price{price, converted, usd("4")} {
+		decoded, err := decodePrice(encodePrice(p))
+		assert.Nil(t, err)
+		assert.Equal(t, p, decoded)
+	}
+}
+
+func TestPriceFor_DecodesLegacyEntries(t *testing.T) {
+	price, err := decodePrice("10.5")
+	assert.Nil(t, err)
+	assert.Equal(t, usd("10.50"), price)
+
+	price, err = decodePrice("8|EUR")
+	assert.Nil(t, err)
+	assert.Equal(t, items.NewPrice(money.MustParse("8"), "EUR"), price)
+
+	price, err = decodePrice("9|EUR|USD|0.9|1588327200")
+	assert.Nil(t, err)
+	assert.Equal(t, money.Currency("USD"), price.Conversion.From)
+
+	for _, v := range []string{"", "v2|8|EUR", "v2|8|EUR|x|1", "8|EUR|USD", "v3|8|EUR|0|1"} {
+		_, err = decodePrice(v)
+		assert.NotNil(t, err, v)
+	}
+}
+
+func TestPriceFor_LegacyKeys(t *testing.T) {
+	cache := New(time.Minute, 0, 0, nil)
+	ctx := context.Background()
+	defer cache.DeletePricesFor(ctx, []string{"l1", "l2"})
+	// written by an instance from before versioned entries
+	cache.client.Set(buildLegacyPriceKey("l1"), "10.5", time.Minute)
+	cache.client.Set(buildLegacyPriceKey("l2"), "3", time.Minute)
+
+	itemsPrice, _, err := cache.GetPricesFor(ctx, "", []string{"l1", "l2"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]items.Price{"l1": usd("10.5"), "l2": usd("3")}, itemsPrice)
+	_, _, err = cache.GetPricesFor(ctx, "EUR", []string{"l1"})
+	if assert.NotNil(t, err, "legacy entries have no conversions") {
+		assert.Contains(t, err.Error(), "Item l1 do not exist")
+	}
+
+	assert.Nil(t, cache.SetPricesFor(ctx, map[string]items.Price{"l1": usd("11")}))
+	assert.Nil(t, cache.DeletePricesFor(ctx, []string{"l2"}))
+	assert.Equal(t, int64(0), cache.client.Exists(buildLegacyPriceKey("l1"), buildLegacyPriceKey("l2")).Val())
+	itemsPrice, _, _ = cache.GetPricesFor(ctx, "", []string{"l1", "l2"})
+	assert.Equal(t, map[string]items.Price{"l1": usd("11")}, itemsPrice)
+}
+
+func usd(price string) items.Price {
+	return items.NewPrice(money.MustParse(price), money.DefaultCurrency)
 }
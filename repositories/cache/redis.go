@@ -1,25 +1,161 @@
 package cache
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/ldegaetano/go-ddd-example/settings"
 	"github.com/go-redis/redis"
+
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/settings"
 )
 
+// errCommandTimeout is returned by call when Redis takes longer than settings.Redis.CommandTimeout
+var errCommandTimeout = errors.New("Redis command timeout")
+
 type cacheRepository struct {
-	client         *redis.Client
+	client         redis.UniversalClient
 	defaultTimeout time.Duration
+	staleTimeout   time.Duration
+	missingTimeout time.Duration
+	// jitter is the fraction of defaultTimeout prices may randomly be kept longer
+	jitter   float64
+	counters *tierCounters
+	logger   *logging.Logger
+}
+
+// New returns a cache where prices are fresh for defaultTime and then stale for staleTime before they expire,
+// items without price are remembered as missing for missingTime. Errors are logged through logger.
+func New(defaultTime time.Duration, staleTime time.Duration, missingTime time.Duration, logger *logging.Logger) cacheRepository {
+	return cacheRepository{newClient(), defaultTime, staleTime, missingTime, settings.Redis.ExpirationJitter, &tierCounters{}, logger.Named(loggerName)}
+}
+
+// Close closes the connections to Redis
+func (cr cacheRepository) Close() error {
+	return cr.client.Close()
+}
+
+// Ping tells if Redis can be reached
+func (cr cacheRepository) Ping(ctx context.Context) error {
+	err := call(ctx, cr.client, func(client redis.UniversalClient) error {
+		return client.Ping().Err()
+	})
+	if cancelled(err) {
+		return err
+	}
+	if err != nil {
+		cr.logger.Error(ctx, "ping_redis", logging.Err(err))
+		return unavailable("Redis ping error")
+	}
+	return nil
+}
+
+// call runs f with the client bound to ctx and returns as soon as ctx is done or settings.Redis.CommandTimeout
+// is reached, failing with ctx.Err() or errCommandTimeout. go-redis v6 can not interrupt a command in flight,
+// so f runs apart and a command given up on finishes in the background, bounded by the read and write
+// timeouts. Whatever f collects can only be read once call returned the error of f.
+func call(ctx context.Context, client redis.UniversalClient, f func(client redis.UniversalClient) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	commandCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f(bind(commandCtx, client))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-commandCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return errCommandTimeout
+	}
 }
 
-func New(defaultTime time.Duration) cacheRepository {
-	url := fmt.Sprintf("%s:%s", settings.Redis.Host, settings.Redis.Port)
-	options := &redis.Options{
-		Addr:     url,
-		Password: "",
+// commandContext bounds the commands made with ctx by settings.Redis.CommandTimeout,
+// they are given up on along with ctx anyway
+func commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if settings.Redis.CommandTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	rc := redis.NewClient(options)
+	return context.WithTimeout(ctx, settings.Redis.CommandTimeout)
+}
 
-	return cacheRepository{rc, defaultTime}
+func bind(ctx context.Context, client redis.UniversalClient) redis.UniversalClient {
+	switch c := client.(type) {
+	case *redis.Client:
+		return c.WithContext(ctx)
+	case *redis.ClusterClient:
+		return c.WithContext(ctx)
+	}
+	return client
+}
+
+// cancelled tells if a call failed because its context was done, which says nothing about Redis
+func cancelled(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// newClient connects to the master behind Sentinel when a master name is set, to a Cluster when
+// its addresses are set and to the single node at Host:Port otherwise.
+// Over TLS the certificates are verified against TLSServerName, or else against the host of each
+// sentinel or node dialed, Host being only the one of the single node.
+func newClient() redis.UniversalClient {
+	s := settings.Redis
+	var tlsConfig *tls.Config
+	if s.TLS {
+		tlsConfig = &tls.Config{ServerName: s.TLSServerName, InsecureSkipVerify: s.TLSInsecureSkipVerify}
+	}
+
+	switch {
+	case s.SentinelMaster != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    s.SentinelMaster,
+			SentinelAddrs: s.SentinelAddrs,
+			Password:      s.Password,
+			DB:            s.DB,
+			DialTimeout:   s.DialTimeout,
+			ReadTimeout:   s.ReadTimeout,
+			WriteTimeout:  s.WriteTimeout,
+			PoolSize:      s.PoolSize,
+			MinIdleConns:  s.MinIdleConns,
+			PoolTimeout:   s.PoolTimeout,
+			TLSConfig:     tlsConfig,
+		})
+	case len(s.ClusterAddrs) > 0:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        s.ClusterAddrs,
+			Password:     s.Password,
+			DialTimeout:  s.DialTimeout,
+			ReadTimeout:  s.ReadTimeout,
+			WriteTimeout: s.WriteTimeout,
+			PoolSize:     s.PoolSize,
+			MinIdleConns: s.MinIdleConns,
+			PoolTimeout:  s.PoolTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	default:
+		if tlsConfig != nil && tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = s.Host
+		}
+		return redis.NewClient(&redis.Options{
+			Addr:         fmt.Sprintf("%s:%s", s.Host, s.Port),
+			Password:     s.Password,
+			DB:           s.DB,
+			DialTimeout:  s.DialTimeout,
+			ReadTimeout:  s.ReadTimeout,
+			WriteTimeout: s.WriteTimeout,
+			PoolSize:     s.PoolSize,
+			MinIdleConns: s.MinIdleConns,
+			PoolTimeout:  s.PoolTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	}
 }
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/settings"
+)
+
+type (
+	// Repository is a prices cache, either Redis, the in process LRU or the LRU in front of Redis
+	Repository interface {
+		GetPricesFor(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, []string, error)
+		SetPricesFor(ctx context.Context, itemsPrice map[string]items.Price) error
+		SetConversionsFor(ctx context.Context, currency money.Currency, itemsPrice map[string]items.Price) error
+		DeletePricesFor(ctx context.Context, itemsCode []string) error
+		DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error
+		GetMissingFor(ctx context.Context, itemsCode []string) ([]string, error)
+		SetMissingFor(ctx context.Context, itemsCode []string) error
+		InvalidateFor(ctx context.Context, itemsCode []string) error
+		Stats() []TierStats
+	}
+
+	// Pinger is a cache that can tell if it is reachable
+	Pinger interface {
+		Ping(ctx context.Context) error
+	}
+
+	// TierStats counts the item lookups a cache tier could and could not serve
+	TierStats struct {
+		Tier   string
+		Hits   uint64
+		Misses uint64
+	}
+
+	// WriteError is returned when some items could not be cached
+	WriteError struct {
+		ItemsCode []string
+	}
+
+	// unavailableError is returned when the cache could not be reached, unlike the errors about missing items
+	unavailableError struct {
+		message string
+	}
+
+	tierCounters struct {
+		hits   uint64
+		misses uint64
+	}
+)
+
+// loggerName names the logger of the cache package
+const loggerName = "cache"
+
+// FromSettings builds the cache selected by settings.Cache.Mode, logging through logger
+func FromSettings(logger *logging.Logger) Repository {
+	redis := settings.Redis
+	switch settings.Cache.Mode {
+	case settings.CacheModeLRU:
+		return NewLRU(settings.Cache.LRUSize, redis.DefaultExpiration, redis.StaleExpiration, redis.MissingExpiration)
+	case settings.CacheModeTiered:
+		l1 := NewLRU(settings.Cache.LRUSize, settings.Cache.LRUExpiration, 0, minDuration(settings.Cache.LRUExpiration, redis.MissingExpiration))
+		l2 := New(redis.DefaultExpiration, redis.StaleExpiration, redis.MissingExpiration, logger)
+		tiered := NewTiered(l1, withBreaker(l2, logger))
+		tiered.invalidator = newInvalidator(l2.client, redis.InvalidationChannel, l1, logger.Named(loggerName))
+		return tiered
+	default:
+		return withBreaker(New(redis.DefaultExpiration, redis.StaleExpiration, redis.MissingExpiration, logger), logger)
+	}
+}
+
+// withBreaker wraps Redis with the circuit breaker set up in settings.Cache, if any
+func withBreaker(r cacheRepository, logger *logging.Logger) Repository {
+	if settings.Cache.BreakerThreshold <= 0 {
+		return r
+	}
+	return NewBreaker("redis", r, settings.Cache.BreakerThreshold, settings.Cache.BreakerCooldown, logger)
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("Set cache error: %s", strings.Join(e.ItemsCode, ","))
+}
+
+// FailedItems returns the items that could not be cached
+func (e *WriteError) FailedItems() []string {
+	return e.ItemsCode
+}
+
+func unavailable(message string) error {
+	return &unavailableError{message}
+}
+
+func (e *unavailableError) Error() string {
+	return e.message
+}
+
+// isUnavailable tells if the error means the cache could not be reached
+func isUnavailable(err error) bool {
+	switch err.(type) {
+	case *unavailableError, *WriteError:
+		return true
+	}
+	return false
+}
+
+func (c *tierCounters) count(hits int, misses int) {
+	atomic.AddUint64(&c.hits, uint64(hits))
+	atomic.AddUint64(&c.misses, uint64(misses))
+}
+
+func (c *tierCounters) stats(tier string) TierStats {
+	return TierStats{
+		Tier:   tier,
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
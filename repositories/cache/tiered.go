@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"context"
+	"io"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+)
+
+// tieredRepository reads from l1 first and from l2 only what l1 does not have,
+// writes go to both. l1 is meant to be a small in process cache with a short
+// expiration in front of a shared one, kept in sync with the other instances
+// through the invalidator when there is one.
+type tieredRepository struct {
+	l1          Repository
+	l2          Repository
+	invalidator *invalidator
+}
+
+// NewTiered returns a cache that puts l1 in front of l2
+func NewTiered(l1 Repository, l2 Repository) tieredRepository {
+	return tieredRepository{l1: l1, l2: l2}
+}
+
+// GetPricesFor returns the prices found in l1 along with the rest found in l2, which are copied into l1
+// unless they are stale in l2, so they keep being refreshed
+func (tr tieredRepository) GetPricesFor(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, []string, error) {
+	itemsPrice, stale, err := tr.l1.GetPricesFor(ctx, currency, itemsCode)
+	if err == nil {
+		return itemsPrice, stale, nil
+	}
+
+	l2Prices, l2Stale, err := tr.l2.GetPricesFor(ctx, currency, getMissing(itemsCode, itemsPrice))
+	fresh := map[string]items.Price{}
+	for k, v := range l2Prices {
+		itemsPrice[k] = v
+		fresh[k] = v
+	}
+	for _, i := range l2Stale {
+		delete(fresh, i)
+	}
+	if currency == "" {
+		tr.l1.SetPricesFor(ctx, fresh)
+	} else {
+		tr.l1.SetConversionsFor(ctx, currency, fresh)
+	}
+
+	return itemsPrice, append(stale, l2Stale...), err
+}
+
+// SetPricesFor caches the prices in both tiers, failing if l2 does
+func (tr tieredRepository) SetPricesFor(ctx context.Context, itemsPrice map[string]items.Price) error {
+	tr.l1.SetPricesFor(ctx, itemsPrice)
+	return tr.l2.SetPricesFor(ctx, itemsPrice)
+}
+
+// SetConversionsFor caches the conversions in both tiers, failing if l2 does
+func (tr tieredRepository) SetConversionsFor(ctx context.Context, currency money.Currency, itemsPrice map[string]items.Price) error {
+	tr.l1.SetConversionsFor(ctx, currency, itemsPrice)
+	return tr.l2.SetConversionsFor(ctx, currency, itemsPrice)
+}
+
+// DeletePricesFor drops the items from both tiers, failing if l2 does
+func (tr tieredRepository) DeletePricesFor(ctx context.Context, itemsCode []string) error {
+	tr.l1.DeletePricesFor(ctx, itemsCode)
+	return tr.l2.DeletePricesFor(ctx, itemsCode)
+}
+
+// DeleteConversionsFor drops the conversions from both tiers, failing if l2 does, and tells the
+// other instances to drop them from their l1
+func (tr tieredRepository) DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error {
+	tr.l1.DeleteConversionsFor(ctx, from, to)
+	err := tr.l2.DeleteConversionsFor(ctx, from, to)
+	if tr.invalidator == nil {
+		return err
+	}
+	if publishErr := tr.invalidator.publishConversions(ctx, from, to); err == nil {
+		err = publishErr
+	}
+	return err
+}
+
+// GetMissingFor returns the items known to have no price in l1 along with the rest known in l2,
+// which are copied into l1
+func (tr tieredRepository) GetMissingFor(ctx context.Context, itemsCode []string) ([]string, error) {
+	missing, _ := tr.l1.GetMissingFor(ctx, itemsCode)
+	if len(missing) == len(itemsCode) {
+		return missing, nil
+	}
+
+	known := map[string]items.Price{}
+	for _, i := range missing {
+		known[i] = items.Price{}
+	}
+	l2Missing, err := tr.l2.GetMissingFor(ctx, getMissing(itemsCode, known))
+	tr.l1.SetMissingFor(ctx, l2Missing)
+	return append(missing, l2Missing...), err
+}
+
+// SetMissingFor remembers the items have no price in both tiers, failing if l2 does
+func (tr tieredRepository) SetMissingFor(ctx context.Context, itemsCode []string) error {
+	tr.l1.SetMissingFor(ctx, itemsCode)
+	return tr.l2.SetMissingFor(ctx, itemsCode)
+}
+
+// InvalidateFor tells the other instances to evict the items from their l1
+func (tr tieredRepository) InvalidateFor(ctx context.Context, itemsCode []string) error {
+	if tr.invalidator == nil {
+		return nil
+	}
+	return tr.invalidator.publish(ctx, itemsCode)
+}
+
+// Subscribe listens to the invalidations published by the other instances
+func (tr tieredRepository) Subscribe() func() {
+	if tr.invalidator == nil {
+		return func() {}
+	}
+	return tr.invalidator.Subscribe()
+}
+
+// Close closes both tiers, l1 after l2
+func (tr tieredRepository) Close() error {
+	err := closeTier(tr.l2)
+	if l1Err := closeTier(tr.l1); err == nil {
+		err = l1Err
+	}
+	return err
+}
+
+// Ping pings both tiers, failing as soon as one of them does
+func (tr tieredRepository) Ping(ctx context.Context) error {
+	for _, r := range []Repository{tr.l1, tr.l2} {
+		if pinger, ok := r.(Pinger); ok {
+			if err := pinger.Ping(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stats returns the stats of l1 followed by the ones of l2
+func (tr tieredRepository) Stats() []TierStats {
+	return append(tr.l1.Stats(), tr.l2.Stats()...)
+}
+
+func getMissing(itemsCode []string, itemsPrice map[string]items.Price) []string {
+	missing := []string{}
+	for _, i := range itemsCode {
+		if _, ok := itemsPrice[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+func closeTier(r Repository) error {
+	if closer, ok := r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
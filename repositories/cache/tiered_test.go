@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTiered_ReadsL2OnlyWhatL1Misses(t *testing.T) {
+	l1 := NewLRU(10, time.Second, 0, 0)
+	l2 := NewLRU(10, time.Second, 0, 0)
+	cache := NewTiered(l1, l2)
+	l2.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1"), "c2": usd("2")})
+	l1.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")})
+
+	prices, _, err := cache.GetPricesFor(context.Background(), "", []string{"c1", "c2", "c3"})
+	assert.Equal(t, "Item c3 do not exist", err.Error())
+	assert.Len(t, prices, 2)
+	assert.Equal(t, []TierStats{{Tier: "lru", Hits: 1, Misses: 2}, {Tier: "lru", Hits: 1, Misses: 1}}, cache.Stats())
+
+	prices, _, err = cache.GetPricesFor(context.Background(), "", []string{"c1", "c2"})
+	assert.Nil(t, err)
+	assert.Equal(t, usd("2"), prices["c2"])
+	assert.Equal(t, uint64(3), cache.Stats()[0].Hits, "prices read from l2 should be copied into l1")
+}
+
+func TestTiered_StaleL2PricesAreNotCopied(t *testing.T) {
+	l1 := NewLRU(10, time.Second, 0, 0)
+	l2 := NewLRU(10, time.Millisecond*50, time.Second, 0)
+	cache := NewTiered(l1, l2)
+	l2.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")})
+	time.Sleep(time.Millisecond * 100)
+
+	_, stale, err := cache.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c1"}, stale)
+	_, _, err = l1.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.NotNil(t, err)
+}
+
+func TestTiered_WritesBothTiers(t *testing.T) {
+	l1 := NewLRU(10, time.Second, 0, time.Second)
+	l2 := NewLRU(10, time.Second, 0, time.Second)
+	cache := NewTiered(l1, l2)
+
+	cache.SetPricesFor(context.Background(), map[string]items.Price{"c1": usd("1")})
+	_, _, err := l1.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, err)
+	_, _, err = l2.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.Nil(t, err)
+
+	cache.DeletePricesFor(context.Background(), []string{"c1"})
+	_, _, err = l1.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.NotNil(t, err)
+	_, _, err = l2.GetPricesFor(context.Background(), "", []string{"c1"})
+	assert.NotNil(t, err)
+
+	l2.SetMissingFor(context.Background(), []string{"c2"})
+	missing, _ := cache.GetMissingFor(context.Background(), []string{"c1", "c2"})
+	assert.Equal(t, []string{"c2"}, missing)
+	missing, _ = l1.GetMissingFor(context.Background(), []string{"c2"})
+	assert.Equal(t, []string{"c2"}, missing)
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ldegaetano/go-ddd-example/logging"
+)
+
+// itemCodesQuery pages through the codes of the items that may have a price, either
+// their own or a scheduled one, in code order
+const itemCodesQuery = `SELECT item_code FROM (
+		SELECT item_code FROM items WHERE deleted_at IS NULL
+		UNION
+		SELECT item_code FROM scheduled_prices WHERE deleted_at IS NULL
+	) c
+	WHERE item_code > $1
+	ORDER BY item_code LIMIT $2;`
+
+// GetItemCodes returns up to limit item codes that sort after the given one, an empty one starts from the first
+func (sr storageRepository) GetItemCodes(ctx context.Context, after string, limit int) (_ []string, err error) {
+	ctx, q := startQuery(ctx, "get_item_codes")
+	defer q.end(&err)
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	codes := []string{}
+
+	rows, err := sr.db.QueryContext(ctx, itemCodesQuery, after, limit)
+	if err != nil {
+		sr.logger.Error(ctx, "item_codes_query", logging.Err(err))
+		return codes, errors.New("Item codes query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemCode string
+		if err := rows.Scan(&itemCode); err != nil {
+			sr.logger.Error(ctx, "item_codes_scan", logging.Err(err))
+			return codes, errors.New("Item codes scan error")
+		}
+		codes = append(codes, itemCode)
+	}
+	if err := rows.Err(); err != nil {
+		sr.logger.Error(ctx, "item_codes_scan", logging.Err(err))
+		return codes, errors.New("Item codes scan error")
+	}
+	return codes, nil
+}
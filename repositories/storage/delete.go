@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lib/pq"
+
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/tracing"
+)
+
+const (
+	deleteItemsQuery = `UPDATE items SET deleted_at = NOW(), version = version + 1
+		WHERE item_code = ANY ($1) AND deleted_at IS NULL
+		RETURNING item_code;`
+	deleteScheduledQuery = `UPDATE scheduled_prices SET deleted_at = NOW()
+		WHERE item_code = ANY ($1) AND deleted_at IS NULL AND (effective_to IS NULL OR effective_to > NOW())
+		RETURNING item_code;`
+	insertDeletionQuery = "INSERT INTO price_history (item_code, item_price, currency, actor) VALUES ($1, NULL, NULL, $2);"
+)
+
+// DeletePricesFor soft deletes the items prices, including their current and future scheduled prices,
+// and records the deletion in the price history. It returns the codes of the items that had a price.
+func (sr storageRepository) DeletePricesFor(ctx context.Context, itemsCode []string, actor string) (_ []string, err error) {
+	ctx, q := startQuery(ctx, "delete_prices", tracing.Int("items.count", len(itemsCode)))
+	defer q.end(&err)
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	deleted := []string{}
+
+	tx, err := sr.db.BeginTx(ctx, nil)
+	if err != nil {
+		sr.logger.Error(ctx, "price_delete", logging.Err(err))
+		return deleted, errors.New("Price delete error")
+	}
+	defer tx.Rollback()
+
+	seen := map[string]bool{}
+	for _, query := range []string{deleteItemsQuery, deleteScheduledQuery} {
+		rows, err := tx.QueryContext(ctx, query, pq.Array(itemsCode))
+		if err != nil {
+			sr.logger.Error(ctx, "price_delete", logging.Err(err))
+			return []string{}, errors.New("Price delete error")
+		}
+		for rows.Next() {
+			var itemCode string
+			if err := rows.Scan(&itemCode); err != nil {
+				rows.Close()
+				sr.logger.Error(ctx, "price_delete", logging.Err(err))
+				return []string{}, errors.New("Price delete error")
+			}
+			if !seen[itemCode] {
+				seen[itemCode] = true
+				deleted = append(deleted, itemCode)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			sr.logger.Error(ctx, "price_delete", logging.Err(err))
+			return []string{}, errors.New("Price delete error")
+		}
+		rows.Close()
+	}
+
+	for _, itemCode := range deleted {
+		if _, err := tx.ExecContext(ctx, insertDeletionQuery, itemCode, actor); err != nil {
+			sr.logger.Error(ctx, "price_delete", logging.Err(err))
+			return []string{}, errors.New("Price delete error")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		sr.logger.Error(ctx, "price_delete", logging.Err(err))
+		return []string{}, errors.New("Price delete error")
+	}
+	return deleted, nil
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/tracing"
+)
+
+const (
+	insertHistoryQuery = "INSERT INTO price_history (item_code, item_price, currency, actor) VALUES ($1, $2::decimal, $3, $4);"
+	// priceAtQuery resolves the price effective at $2 the same way priceQuery does for the current time,
+	// taking the item price from the history, where a deletion is recorded as a NULL price.
+	// Scheduled prices only count from when they were created, a backdated one does not rewrite the past.
+	priceAtQuery = `SELECT c.item_code, COALESCE(s.item_price, h.item_price), COALESCE(s.currency, h.currency)
+		FROM UNNEST ($1::varchar[]) AS c (item_code)
+		LEFT JOIN LATERAL (
+			SELECT item_price, currency FROM price_history ph
+			WHERE ph.item_code = c.item_code AND ph.effective_at <= $2
+			ORDER BY ph.effective_at DESC, ph.id DESC LIMIT 1
+		) h ON TRUE
+		LEFT JOIN LATERAL (
+			SELECT item_price, currency FROM scheduled_prices sp
+			WHERE sp.item_code = c.item_code AND sp.created_at <= $2 AND (sp.deleted_at IS NULL OR sp.deleted_at > $2)
+				AND sp.effective_from <= $2 AND (sp.effective_to IS NULL OR sp.effective_to > $2)
+			ORDER BY sp.effective_from DESC, sp.id DESC LIMIT 1
+		) s ON TRUE
+		WHERE COALESCE(s.item_price, h.item_price) IS NOT NULL;`
+	historyQuery = `SELECT item_price, currency, effective_at, actor FROM price_history
+		WHERE item_code = $1
+		ORDER BY effective_at DESC, id DESC;`
+)
+
+// GetPricesAt returns the prices the items had at the given moment
+func (sr storageRepository) GetPricesAt(ctx context.Context, itemsCode []string, asOf time.Time) (_ map[string]items.Price, err error) {
+	ctx, q := startQuery(ctx, "get_prices_at", tracing.Int("items.count", len(itemsCode)))
+	defer q.end(&err)
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	res := map[string]items.Price{}
+
+	rows, err := sr.db.QueryContext(ctx, priceAtQuery, pq.Array(itemsCode), asOf)
+	if err != nil {
+		sr.logger.Error(ctx, "price_at_query", logging.Err(err))
+		return res, errors.New("Price history query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemCode, currency string
+		var itemPrice money.Amount
+		if err := rows.Scan(&itemCode, &itemPrice, &currency); err != nil {
+			sr.logger.Error(ctx, "price_at_scan", logging.Err(err))
+			return res, errors.New("Price history scan error")
+		}
+		res[itemCode] = items.NewPrice(itemPrice, money.Currency(currency))
+	}
+	if err := rows.Err(); err != nil {
+		sr.logger.Error(ctx, "price_at_scan", logging.Err(err))
+		return res, errors.New("Price history scan error")
+	}
+	return res, nil
+}
+
+// GetPriceHistory returns every price the item had, newest first
+func (sr storageRepository) GetPriceHistory(ctx context.Context, itemCode string) (_ []items.PriceRecord, err error) {
+	ctx, q := startQuery(ctx, "get_price_history")
+	defer q.end(&err)
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	res := []items.PriceRecord{}
+
+	rows, err := sr.db.QueryContext(ctx, historyQuery, itemCode)
+	if err != nil {
+		sr.logger.Error(ctx, "price_history_query", logging.Err(err))
+		return res, errors.New("Price history query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemPrice, currency sql.NullString
+		record := items.PriceRecord{}
+		if err := rows.Scan(&itemPrice, &currency, &record.EffectiveAt, &record.Actor); err != nil {
+			sr.logger.Error(ctx, "price_history_scan", logging.Err(err))
+			return res, errors.New("Price history scan error")
+		}
+		if !itemPrice.Valid {
+			record.Deleted = true
+			res = append(res, record)
+			continue
+		}
+		amount, err := money.Parse(itemPrice.String)
+		if err != nil {
+			sr.logger.Error(ctx, "price_history_scan", logging.Err(err))
+			return res, errors.New("Price history scan error")
+		}
+		record.Price = items.NewPrice(amount, money.Currency(currency.String))
+		res = append(res, record)
+	}
+	if err := rows.Err(); err != nil {
+		sr.logger.Error(ctx, "price_history_scan", logging.Err(err))
+		return res, errors.New("Price history scan error")
+	}
+	return res, nil
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/metrics"
+	"github.com/ldegaetano/go-ddd-example/tracing"
+)
+
+var (
+	queryDuration = metrics.NewHistogram("storage_query_duration_seconds",
+		"Time taken by the storage calls by query", metrics.DefaultBuckets, "query")
+	queryErrors = metrics.NewCounter("storage_query_errors_total",
+		"Storage calls that failed by query", "query")
+)
+
+// query is a storage call being measured and traced
+type query struct {
+	name  string
+	start time.Time
+	span  *tracing.Span
+}
+
+// startQuery starts measuring and tracing the query, the returned context carries its span
+func startQuery(ctx context.Context, name string, attributes ...tracing.Attribute) (context.Context, query) {
+	ctx, span := tracing.Start(ctx, "postgres."+name, attributes...)
+	return ctx, query{name: name, start: time.Now(), span: span}
+}
+
+// end records the time taken by the query and whether it failed, it is deferred with the error returned by the query
+func (q query) end(err *error) {
+	queryDuration.Observe(time.Since(q.start).Seconds(), q.name)
+	if *err != nil {
+		queryErrors.Inc(q.name)
+		q.span.RecordError(*err)
+	}
+	q.span.End()
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/logging"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const (
+	// migrationLockKey is the advisory lock held while migrating, so replicas starting at once migrate one at a time
+	migrationLockKey = 4207001
+
+	createMigrationsQuery = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    BIGINT NOT NULL,
+	name       VARCHAR NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+	CONSTRAINT schema_migrations_pk PRIMARY KEY (version)
+);`
+	migrationsTableQuery   = "SELECT to_regclass('schema_migrations') IS NOT NULL;"
+	appliedMigrationsQuery = "SELECT version, applied_at FROM schema_migrations;"
+	insertMigrationQuery   = "INSERT INTO schema_migrations (version, name) VALUES ($1, $2);"
+	deleteMigrationQuery   = "DELETE FROM schema_migrations WHERE version = $1;"
+)
+
+type (
+	// Migration is a change of the schema, applied by its up SQL and reverted by its down SQL
+	Migration struct {
+		Version int64
+		Name    string
+		up      string
+		down    string
+	}
+
+	// MigrationStatus is a migration along with when it was applied, zero while it is pending
+	MigrationStatus struct {
+		Migration
+		AppliedAt time.Time
+	}
+
+	// queryer runs queries on the database or on one of its connections
+	queryer interface {
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	}
+
+	// Migrator applies and reverts the migrations embedded in the binary, in order of version
+	Migrator struct {
+		db         *sql.DB
+		migrations []Migration
+		logger     *logging.Logger
+	}
+)
+
+// NewMigrator connects to the database in settings to migrate it
+func NewMigrator(logger *logging.Logger) (*Migrator, error) {
+	logger = logger.Named(loggerName)
+	db, err := connect(logger)
+	if err != nil {
+		return nil, err
+	}
+	return newMigrator(db, logger), nil
+}
+
+func newMigrator(db *sql.DB, logger *logging.Logger) *Migrator {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		// the migrations are embedded, they can only be wrong if the binary is
+		panic(err.Error())
+	}
+	return &Migrator{db, migrations, logger}
+}
+
+// loadMigrations reads the <version>_<name>.up.sql and <version>_<name>.down.sql files of the migrations
+// directory, every version needs both
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, file := range files {
+		name := path.Base(file)
+		base, direction := strings.TrimSuffix(name, ".sql"), ""
+		switch {
+		case strings.HasSuffix(base, ".up"):
+			base, direction = strings.TrimSuffix(base, ".up"), "up"
+		case strings.HasSuffix(base, ".down"):
+			base, direction = strings.TrimSuffix(base, ".down"), "down"
+		default:
+			return nil, fmt.Errorf("migration %s is neither up nor down", name)
+		}
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) < 2 {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>", name)
+		}
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[1] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, parts[1])
+		}
+		if direction == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies every pending migration in order and returns them, each in its own transaction.
+// It stops at the first one failing.
+func (m *Migrator) Up() ([]Migration, error) {
+	migrated := []Migration{}
+	err := m.locked(func(ctx context.Context, conn *sql.Conn, applied map[int64]time.Time) error {
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := migrate(ctx, conn, migration.up, insertMigrationQuery, migration.Version, migration.Name); err != nil {
+				m.logger.Error(ctx, "migrate_up", logging.Err(err), logging.F("version", migration.Version))
+				return fmt.Errorf("Migration %d_%s error", migration.Version, migration.Name)
+			}
+			m.logger.Info(ctx, "migrate_up", logging.F("version", migration.Version), logging.F("name", migration.Name))
+			migrated = append(migrated, migration)
+		}
+		return nil
+	})
+	return migrated, err
+}
+
+// Down reverts the last steps migrations applied, the latest first, and returns them
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	migrated := []Migration{}
+	err := m.locked(func(ctx context.Context, conn *sql.Conn, applied map[int64]time.Time) error {
+		for k := len(m.migrations) - 1; k >= 0 && len(migrated) < steps; k-- {
+			migration := m.migrations[k]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := migrate(ctx, conn, migration.down, deleteMigrationQuery, migration.Version); err != nil {
+				m.logger.Error(ctx, "migrate_down", logging.Err(err), logging.F("version", migration.Version))
+				return fmt.Errorf("Migration %d_%s error", migration.Version, migration.Name)
+			}
+			m.logger.Info(ctx, "migrate_down", logging.F("version", migration.Version), logging.F("name", migration.Name))
+			migrated = append(migrated, migration)
+		}
+		return nil
+	})
+	return migrated, err
+}
+
+// Status returns every migration with when it was applied. It only reads, without waiting for the lock
+// of a migration running, and reports every migration pending on a database never migrated.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	ctx := context.Background()
+	var tracked bool
+	if err := m.db.QueryRowContext(ctx, migrationsTableQuery).Scan(&tracked); err != nil {
+		m.logger.Error(ctx, "migrate_query", logging.Err(err))
+		return nil, errors.New("Migration query error")
+	}
+	applied := map[int64]time.Time{}
+	if tracked {
+		var err error
+		if applied, err = appliedMigrations(ctx, m.db); err != nil {
+			m.logger.Error(ctx, "migrate_query", logging.Err(err))
+			return nil, errors.New("Migration query error")
+		}
+	}
+
+	status := make([]MigrationStatus, len(m.migrations))
+	for k, migration := range m.migrations {
+		status[k] = MigrationStatus{Migration: migration, AppliedAt: applied[migration.Version]}
+	}
+	return status, nil
+}
+
+// Close closes the connections to the database
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// locked runs f holding the migration lock, with the migrations already applied. The advisory lock
+// belongs to the session, so everything runs on the same connection.
+func (m *Migrator) locked(f func(ctx context.Context, conn *sql.Conn, applied map[int64]time.Time) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		m.logger.Error(ctx, "migrate_conn", logging.Err(err))
+		return errors.New("Migration lock error")
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", migrationLockKey); err != nil {
+		m.logger.Error(ctx, "migrate_lock", logging.Err(err))
+		return errors.New("Migration lock error")
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1);", migrationLockKey)
+
+	if _, err := conn.ExecContext(ctx, createMigrationsQuery); err != nil {
+		m.logger.Error(ctx, "migrate_table", logging.Err(err))
+		return errors.New("Migration table error")
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		m.logger.Error(ctx, "migrate_query", logging.Err(err))
+		return errors.New("Migration query error")
+	}
+	return f(ctx, conn, applied)
+}
+
+func appliedMigrations(ctx context.Context, q queryer) (map[int64]time.Time, error) {
+	rows, err := q.QueryContext(ctx, appliedMigrationsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// migrate runs the migration SQL and records it with trackQuery in the same transaction
+func migrate(ctx context.Context, conn *sql.Conn, migrationSQL string, trackQuery string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migrationSQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, trackQuery, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/settings"
+)
+
+func TestMigrations_Embedded(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "init", migrations[0].Name)
+	for k, migration := range migrations {
+		assert.Equal(t, int64(k+1), migration.Version, "every change of the schema should have its own version")
+	}
+}
+
+func TestMigrations_Invalid(t *testing.T) {
+	migrations, err := loadMigrations(fstest.MapFS{
+		"migrations/0002_prices.up.sql":   {Data: []byte("ALTER TABLE b;")},
+		"migrations/0002_prices.down.sql": {Data: []byte("ALTER TABLE b;")},
+		"migrations/0001_init.up.sql":     {Data: []byte("CREATE TABLE a;")},
+		"migrations/0001_init.down.sql":   {Data: []byte("DROP TABLE a;")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2}, []int64{migrations[0].Version, migrations[1].Version})
+
+	_, err = loadMigrations(fstest.MapFS{"migrations/0001_init.up.sql": {Data: []byte("CREATE TABLE a;")}})
+	assert.Equal(t, "migration 1_init needs both up and down", err.Error())
+
+	_, err = loadMigrations(fstest.MapFS{"migrations/init.up.sql": {Data: []byte("CREATE TABLE a;")}})
+	assert.Equal(t, "migration init.up.sql is not named <version>_<name>", err.Error())
+}
+
+func TestMigrator_DownAndUp(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+	migrator := newMigrator(storage.db, storage.logger)
+
+	status, err := migrator.Status()
+	assert.Nil(t, err)
+	for _, s := range status {
+		assert.False(t, s.AppliedAt.IsZero(), "every migration should be applied on start")
+	}
+
+	migrated, err := migrator.Down(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []Migration{status[len(status)-1].Migration}, migrated)
+
+	migrated, err = migrator.Up()
+	assert.Nil(t, err)
+	assert.Equal(t, []Migration{status[len(status)-1].Migration}, migrated)
+
+	migrated, err = migrator.Up()
+	assert.Nil(t, err)
+	assert.Empty(t, migrated)
+}
+
+func TestMigrator_StatusDoesNotWaitForTheLock(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+	migrator := newMigrator(storage.db, storage.logger)
+
+	ctx := context.Background()
+	conn, err := storage.db.Conn(ctx)
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", migrationLockKey)
+	assert.Nil(t, err)
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1);", migrationLockKey)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := migrator.Status()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("status waited for the migration lock")
+	}
+}
+
+func TestMigrator_HistoryOfItemsSetBeforeIt(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+	migrator := newMigrator(storage.db, storage.logger)
+	status, err := migrator.Status()
+	assert.Nil(t, err)
+
+	// back to the schema before the price history
+	var reverted int
+	for _, s := range status {
+		if s.Version >= 4 {
+			reverted++
+		}
+	}
+	_, err = migrator.Down(reverted)
+	assert.Nil(t, err)
+	_, err = storage.db.Exec("INSERT INTO items (item_code, item_price, currency) VALUES ('p1', 10, 'EUR');")
+	assert.Nil(t, err)
+	_, err = migrator.Up()
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	itemsPrice, err := storage.GetPricesAt(ctx, []string{"p1"}, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, items.NewPrice(money.MustParse("10"), "EUR"), itemsPrice["p1"])
+	history, err := storage.GetPriceHistory(ctx, "p1")
+	assert.Nil(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, items.NewPrice(money.MustParse("10"), "EUR"), history[0].Price)
+		assert.Equal(t, "migration", history[0].Actor)
+	}
+}
+
+func TestMigrator_ConnectDoesNotMigrate(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+	migrator := newMigrator(storage.db, storage.logger)
+	reverted, err := migrator.Down(1)
+	assert.Nil(t, err)
+	defer migrator.Up()
+	if !assert.Len(t, reverted, 1) {
+		return
+	}
+
+	aux := settings.Postgres
+	defer func() { settings.Postgres = aux }()
+	settings.Postgres.MigrateOnStart = true
+	connected, err := Connect(logging.Default())
+	assert.Nil(t, err)
+	assert.Nil(t, connected.Close())
+
+	status, err := migrator.Status()
+	assert.Nil(t, err)
+	for _, s := range status {
+		if s.Version == reverted[0].Version {
+			assert.True(t, s.AppliedAt.IsZero(), "connecting should not apply the pending migrations")
+		}
+	}
+	// closing the connection opened by Connect leaves the one of New open
+	assert.Nil(t, storage.Ping(context.Background()))
+}
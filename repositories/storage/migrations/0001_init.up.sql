@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS items (
+	item_code  VARCHAR NOT NULL,
+	item_price NUMERIC(10,2) NOT NULL,
+
+	CONSTRAINT items_pk PRIMARY KEY (item_code)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS fx_rates (
+	base_currency  CHAR(3) NOT NULL,
+	quote_currency CHAR(3) NOT NULL,
+	rate           NUMERIC(18,8) NOT NULL,
+	updated_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+	CONSTRAINT fx_rates_pk PRIMARY KEY (base_currency, quote_currency)
+);
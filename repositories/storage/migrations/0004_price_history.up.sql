@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS price_history (
+	id           BIGSERIAL NOT NULL,
+	item_code    VARCHAR NOT NULL,
+	item_price   NUMERIC(10,2) NOT NULL,
+	currency     CHAR(3) NOT NULL,
+	effective_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	actor        VARCHAR NOT NULL,
+
+	CONSTRAINT price_history_pk PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS price_history_item_idx ON price_history (item_code, effective_at DESC);
+
+-- the prices set before the history existed are its first entries, items already in it were taken over as they are
+INSERT INTO price_history (item_code, item_price, currency, effective_at, actor)
+	SELECT item_code, item_price, currency, NOW(), 'migration' FROM items i
+	WHERE NOT EXISTS (SELECT 1 FROM price_history ph WHERE ph.item_code = i.item_code);
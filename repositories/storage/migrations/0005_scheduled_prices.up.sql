@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS scheduled_prices (
+	id             BIGSERIAL NOT NULL,
+	item_code      VARCHAR NOT NULL,
+	item_price     NUMERIC(10,2) NOT NULL,
+	currency       CHAR(3) NOT NULL,
+	effective_from TIMESTAMPTZ NOT NULL,
+	effective_to   TIMESTAMPTZ,
+	actor          VARCHAR NOT NULL,
+	created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+	CONSTRAINT scheduled_prices_pk PRIMARY KEY (id),
+	CONSTRAINT scheduled_prices_window_ck CHECK (effective_to IS NULL OR effective_to > effective_from)
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_prices_item_idx ON scheduled_prices (item_code, effective_from DESC);
@@ -0,0 +1,7 @@
+-- without deleted_at the deleted prices would be served again
+DELETE FROM items WHERE deleted_at IS NOT NULL;
+DELETE FROM scheduled_prices WHERE deleted_at IS NOT NULL;
+DELETE FROM price_history WHERE item_price IS NULL OR currency IS NULL;
+ALTER TABLE price_history ALTER COLUMN item_price SET NOT NULL, ALTER COLUMN currency SET NOT NULL;
+ALTER TABLE scheduled_prices DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE items DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,4 @@
+ALTER TABLE items ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE scheduled_prices ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+-- deletions are recorded in the history without price nor currency
+ALTER TABLE price_history ALTER COLUMN item_price DROP NOT NULL, ALTER COLUMN currency DROP NOT NULL;
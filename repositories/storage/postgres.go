@@ -1,50 +1,120 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-
-	"github.com/labstack/gommon/log"
+	"errors"
+	"net"
+	"net/url"
 
 	_ "github.com/jinzhu/gorm/dialects/postgres" //postgres driver
+	"github.com/ldegaetano/go-ddd-example/logging"
 	"github.com/ldegaetano/go-ddd-example/settings"
 )
 
-const initQuery = `CREATE TABLE IF NOT EXISTS items (
-	item_code  VARCHAR NOT NULL,
-	item_price NUMERIC(10,2) NOT NULL,
-			
-	CONSTRAINT items_pk PRIMARY KEY (item_code)
-);`
-
 type storageRepository struct {
-	db *sql.DB
+	db     *sql.DB
+	logger *logging.Logger
 }
 
 var storage *storageRepository
 
-func New() storageRepository {
+// loggerName names the logger of the storage package
+const loggerName = "storage"
+
+// New connects to the database in settings, applying the migrations pending when settings.Postgres.MigrateOnStart
+// is set. It fails when the database can not be reached within settings.Postgres.ConnectTimeout.
+func New(logger *logging.Logger) (storageRepository, error) {
 	if storage != nil {
-		return *storage
-	}
-
-	c := fmt.Sprintf(
-		"postgres://%s:%s@%s:%s/%s?sslmode=%s",
-		settings.Postgres.UserName,
-		settings.Postgres.Password,
-		settings.Postgres.Host,
-		settings.Postgres.Port,
-		settings.Postgres.DBName,
-		"disable",
-	)
-	db, err := sql.Open("postgres", c)
+		return *storage, nil
+	}
+
+	logger = logger.Named(loggerName)
+	db, err := connect(logger)
+	if err != nil {
+		return storageRepository{}, err
+	}
+	if settings.Postgres.MigrateOnStart {
+		if _, err := newMigrator(db, logger).Up(); err != nil {
+			db.Close()
+			return storageRepository{}, err
+		}
+	}
+
+	storage = &storageRepository{db, logger}
+	return *storage, nil
+}
+
+// Connect connects to the database in settings without applying any migration, for the commands which must
+// not change the schema. Unlike New, every call opens its own connections, closed by Close.
+func Connect(logger *logging.Logger) (storageRepository, error) {
+	logger = logger.Named(loggerName)
+	db, err := connect(logger)
+	if err != nil {
+		return storageRepository{}, err
+	}
+	return storageRepository{db, logger}, nil
+}
+
+// connect opens the pool of connections to the database and pings it
+func connect(logger *logging.Logger) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dataSourceName())
 	if err != nil {
-		log.Errorf("[build_db_err:%s]", err.Error())
-		return *storage
+		logger.Error(context.Background(), "build_db", logging.Err(err))
+		return nil, errors.New("Database connection error")
+	}
+	db.SetMaxOpenConns(settings.Postgres.MaxOpenConns)
+	db.SetMaxIdleConns(settings.Postgres.MaxIdleConns)
+	db.SetConnMaxLifetime(settings.Postgres.ConnMaxLifetime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Postgres.ConnectTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		logger.Error(ctx, "ping_db", logging.Err(err))
+		db.Close()
+		return nil, errors.New("Database connection error")
+	}
+	return db, nil
+}
+
+// Ping tells if the database can be reached
+func (sr storageRepository) Ping(ctx context.Context) error {
+	if err := sr.db.PingContext(ctx); err != nil {
+		sr.logger.Error(ctx, "ping_db", logging.Err(err))
+		return errors.New("Database ping error")
+	}
+	return nil
+}
+
+// Close closes the connections to the database, New connects again afterwards
+func (sr storageRepository) Close() error {
+	if storage != nil && storage.db == sr.db {
+		storage = nil
 	}
+	return sr.db.Close()
+}
 
-	db.Exec(initQuery)
+func dataSourceName() string {
+	query := url.Values{}
+	query.Set("sslmode", settings.Postgres.SSLMode)
+	if settings.Postgres.SSLRootCert != "" {
+		query.Set("sslrootcert", settings.Postgres.SSLRootCert)
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(settings.Postgres.UserName, settings.Postgres.Password),
+		Host:     net.JoinHostPort(settings.Postgres.Host, settings.Postgres.Port),
+		Path:     settings.Postgres.DBName,
+		RawQuery: query.Encode(),
+	}
+	return dsn.String()
+}
 
-	storage = &storageRepository{db}
-	return *storage
+// queryContext bounds the queries made with ctx by settings.Postgres.QueryTimeout,
+// they are cancelled along with ctx anyway
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if settings.Postgres.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, settings.Postgres.QueryTimeout)
 }
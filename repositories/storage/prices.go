@@ -1,41 +1,150 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"time"
 
-	"github.com/labstack/gommon/log"
 	"github.com/lib/pq"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/tracing"
 )
 
 const (
-	priceQuery  = "SELECT item_code, item_price FROM items WHERE item_code = ANY ($1);"
-	insertQuery = "INSERT INTO items (item_code, item_price) VALUES ($1, $2::decimal) ON CONFLICT (item_code) DO UPDATE SET item_price = EXCLUDED.item_price;"
+	// priceQuery resolves the effective price of each item: the latest scheduled price whose
+	// window contains the current time or else the item price. valid_until is when that
+	// price stops being effective, either because its window ends or a scheduled one starts.
+	priceQuery = `SELECT c.item_code, COALESCE(s.item_price, i.item_price), COALESCE(s.currency, i.currency),
+			LEAST(s.effective_to, n.effective_from), COALESCE(i.version, 0)
+		FROM UNNEST ($1::varchar[]) AS c (item_code)
+		LEFT JOIN items i ON i.item_code = c.item_code AND i.deleted_at IS NULL
+		LEFT JOIN LATERAL (
+			SELECT item_price, currency, effective_to FROM scheduled_prices sp
+			WHERE sp.item_code = c.item_code AND sp.deleted_at IS NULL
+				AND sp.effective_from <= NOW() AND (sp.effective_to IS NULL OR sp.effective_to > NOW())
+			ORDER BY sp.effective_from DESC, sp.id DESC LIMIT 1
+		) s ON TRUE
+		LEFT JOIN LATERAL (
+			SELECT MIN(effective_from) AS effective_from FROM scheduled_prices sp
+			WHERE sp.item_code = c.item_code AND sp.deleted_at IS NULL AND sp.effective_from > NOW()
+		) n ON TRUE
+		WHERE COALESCE(s.item_price, i.item_price) IS NOT NULL;`
+	insertQuery = "INSERT INTO items (item_code, item_price, currency) VALUES ($1, $2::decimal, $3) ON CONFLICT (item_code) DO UPDATE SET item_price = EXCLUDED.item_price, currency = EXCLUDED.currency, deleted_at = NULL, version = items.version + 1;"
 )
 
-func (sr storageRepository) GetPricesFor(itemsCode []string) (map[string]float64, error) {
-	res := map[string]float64{}
+func (sr storageRepository) GetPricesFor(ctx context.Context, itemsCode []string) (_ map[string]items.Price, err error) {
+	ctx, q := startQuery(ctx, "get_prices", tracing.Int("items.count", len(itemsCode)))
+	defer q.end(&err)
+	res := map[string]items.Price{}
 
-	rows, err := sr.db.Query(priceQuery, pq.Array(itemsCode))
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	rows, err := sr.db.QueryContext(ctx, priceQuery, pq.Array(itemsCode))
 	if err != nil {
-		log.Errorf("[price_query_err:%s]", err.Error())
+		sr.logger.Error(ctx, "price_query", logging.Err(err))
 		return res, errors.New("Price query error")
 	}
 	defer rows.Close()
 
+	loadedAt := time.Now()
 	for rows.Next() {
-		var itemCode string
-		var itemPrice float64
-		rows.Scan(&itemCode, &itemPrice)
-		res[itemCode] = itemPrice
+		var itemCode, currency string
+		var itemPrice money.Amount
+		var validUntil sql.NullTime
+		var version int64
+		if err := rows.Scan(&itemCode, &itemPrice, &currency, &validUntil, &version); err != nil {
+			sr.logger.Error(ctx, "price_scan", logging.Err(err))
+			return res, errors.New("Price scan error")
+		}
+		price := items.NewPrice(itemPrice, money.Currency(currency))
+		if validUntil.Valid {
+			price.ValidUntil = validUntil.Time
+		}
+		price.LoadedAt, price.Version = loadedAt, version
+		res[itemCode] = price
+	}
+	if err := rows.Err(); err != nil {
+		sr.logger.Error(ctx, "price_scan", logging.Err(err))
+		return res, errors.New("Price scan error")
 	}
 	return res, nil
 }
 
-func (sr storageRepository) SetPriceFor(itemCode string, price float64) error {
-	_, err := sr.db.Exec(insertQuery, itemCode, price)
+// SetPriceFor replaces the item price and appends it to the item price history
+func (sr storageRepository) SetPriceFor(ctx context.Context, itemCode string, price items.Price, actor string) error {
+	return sr.SetPricesFor(ctx, []items.PriceChange{{ItemCode: itemCode, Price: price}}, actor)
+}
+
+// SetPricesFor applies every change in a single transaction, either all of them are written or none
+func (sr storageRepository) SetPricesFor(ctx context.Context, changes []items.PriceChange, actor string) (err error) {
+	ctx, q := startQuery(ctx, "set_prices", tracing.Int("items.count", len(changes)))
+	defer q.end(&err)
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	tx, err := sr.db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Errorf("[price_insert_err:%s]", err.Error())
+		sr.logger.Error(ctx, "price_insert", logging.Err(err))
+		return errors.New("Price insert error")
+	}
+	defer tx.Rollback()
+
+	stmts, err := prepareChangeStatements(ctx, tx)
+	if err != nil {
+		sr.logger.Error(ctx, "price_insert", logging.Err(err))
+		return errors.New("Price insert error")
+	}
+
+	for _, change := range changes {
+		if err := stmts.apply(ctx, change, actor); err != nil {
+			sr.logger.Error(ctx, "price_insert", logging.Err(err), logging.F("item_code", change.ItemCode))
+			return errors.New("Price insert error")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		sr.logger.Error(ctx, "price_insert", logging.Err(err))
 		return errors.New("Price insert error")
 	}
 	return nil
 }
+
+// changeStatements are the statements needed to apply price changes, prepared once per transaction
+type changeStatements struct {
+	insert    *sql.Stmt
+	history   *sql.Stmt
+	scheduled *sql.Stmt
+}
+
+func prepareChangeStatements(ctx context.Context, tx *sql.Tx) (stmts changeStatements, err error) {
+	if stmts.insert, err = tx.PrepareContext(ctx, insertQuery); err != nil {
+		return
+	}
+	if stmts.history, err = tx.PrepareContext(ctx, insertHistoryQuery); err != nil {
+		return
+	}
+	stmts.scheduled, err = tx.PrepareContext(ctx, insertScheduledQuery)
+	return
+}
+
+func (s changeStatements) apply(ctx context.Context, change items.PriceChange, actor string) error {
+	amount, currency := change.Price.Amount, change.Price.Currency.String()
+
+	if w := change.Window; w != nil {
+		var effectiveTo interface{}
+		if !w.To.IsZero() {
+			effectiveTo = w.To
+		}
+		_, err := s.scheduled.ExecContext(ctx, change.ItemCode, amount, currency, w.From, effectiveTo, actor)
+		return err
+	}
+
+	if _, err := s.insert.ExecContext(ctx, change.ItemCode, amount, currency); err != nil {
+		return err
+	}
+	_, err := s.history.ExecContext(ctx, change.ItemCode, amount, currency, actor)
+	return err
+}
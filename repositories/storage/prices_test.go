@@ -1,34 +1,94 @@
 package storage
 
 import (
+	"context"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/settings"
 )
 
 func clearDB(storage storageRepository) {
-	storage.db.Exec(`TRUNCATE TABLE items;`)
+	storage.db.Exec(`TRUNCATE TABLE items, fx_rates, price_history, scheduled_prices;`)
+}
+
+func newStorage(t *testing.T) storageRepository {
+	storage, err := New(logging.Default())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return storage
+}
+
+func TestStorage_NewUnreachable(t *testing.T) {
+	aux := settings.Postgres
+	defer func() { settings.Postgres = aux }()
+	settings.Postgres.Host = "invalid_host"
+	settings.Postgres.ConnectTimeout = time.Second
+
+	_, err := New(logging.Default())
+
+	assert.Equal(t, "Database connection error", err.Error())
+}
+
+func TestStorage_ConnectUnreachable(t *testing.T) {
+	aux := settings.Postgres
+	defer func() { settings.Postgres = aux }()
+	settings.Postgres.Host = "invalid_host"
+	settings.Postgres.ConnectTimeout = time.Second
+
+	_, err := Connect(logging.Default())
+
+	assert.Equal(t, "Database connection error", err.Error())
+}
+
+func TestStorage_DataSourceName(t *testing.T) {
+	aux := settings.Postgres
+	defer func() { settings.Postgres = aux }()
+	settings.Postgres.Password = "p@ss/word"
+	settings.Postgres.SSLMode = "verify-full"
+	settings.Postgres.SSLRootCert = "/etc/ssl/ca.pem"
+
+	dsn, err := url.Parse(dataSourceName())
+
+	assert.Nil(t, err)
+	password, _ := dsn.User.Password()
+	assert.Equal(t, "p@ss/word", password)
+	assert.Equal(t, "verify-full", dsn.Query().Get("sslmode"))
+	assert.Equal(t, "/etc/ssl/ca.pem", dsn.Query().Get("sslrootcert"))
 }
 
 func TestStorage_GetPricesFor(t *testing.T) {
-	storage := New()
+	storage := newStorage(t)
 	defer clearDB(storage)
 
-	storage.SetPriceFor("p1", 10)
-	storage.SetPriceFor("p2", 3)
-	storage.SetPriceFor("p3", 4)
+	storage.SetPriceFor(context.Background(), "p1", usd("10"), "tester")
+	storage.SetPriceFor(context.Background(), "p2", usd("0.1"), "tester")
+	storage.SetPriceFor(context.Background(), "p3", items.NewPrice(money.MustParse("19.99"), "EUR"), "tester")
+	storage.SetPriceFor(context.Background(), "p3", items.NewPrice(money.MustParse("19.99"), "EUR"), "tester")
 
-	itemsPrice, err := storage.GetPricesFor([]string{"p1", "p2", "p3"})
+	before := time.Now()
+	itemsPrice, err := storage.GetPricesFor(context.Background(), []string{"p1", "p2", "p3"})
 
 	assert.Nil(t, err)
+	assert.Equal(t, int64(1), itemsPrice["p1"].Version)
+	assert.Equal(t, int64(2), itemsPrice["p3"].Version)
+	assert.False(t, itemsPrice["p1"].LoadedAt.Before(before))
+	itemsPrice = withoutSource(itemsPrice)
 
-	assert.Equal(t, float64(10), itemsPrice["p1"])
-	assert.Equal(t, float64(3), itemsPrice["p2"])
-	assert.Equal(t, float64(4), itemsPrice["p3"])
+	assert.Equal(t, usd("10"), itemsPrice["p1"])
+	assert.Equal(t, usd("0.10"), itemsPrice["p2"])
+	assert.Equal(t, items.NewPrice(money.MustParse("19.99"), "EUR"), itemsPrice["p3"])
 }
 
 func TestStorage_GetPricesForErr(t *testing.T) {
-	storageRepo := New()
+	storageRepo := newStorage(t)
 	defer clearDB(storageRepo)
 	defer func() {
 		storage = nil
@@ -36,13 +96,13 @@ func TestStorage_GetPricesForErr(t *testing.T) {
 
 	storage.db.Close()
 
-	_, err := storageRepo.GetPricesFor([]string{"p1", "p2", "p3"})
+	_, err := storageRepo.GetPricesFor(context.Background(), []string{"p1", "p2", "p3"})
 
 	assert.Equal(t, "Price query error", err.Error())
 }
 
 func TestStorage_SetPricesForErr(t *testing.T) {
-	storageRepo := New()
+	storageRepo := newStorage(t)
 	defer clearDB(storageRepo)
 	defer func() {
 		storage = nil
@@ -50,7 +110,193 @@ func TestStorage_SetPricesForErr(t *testing.T) {
 
 	storage.db.Close()
 
-	err := storageRepo.SetPriceFor("p1", 10)
+	err := storageRepo.SetPriceFor(context.Background(), "p1", usd("10"), "tester")
 
 	assert.Equal(t, "Price insert error", err.Error())
 }
+
+func TestStorage_GetRatesFor(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+
+	storage.SetRate(context.Background(), money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.8625")})
+	storage.SetRate(context.Background(), money.ExchangeRate{From: "GBP", To: "EUR", Rate: money.MustParseRate("1.1")})
+	storage.SetRate(context.Background(), money.ExchangeRate{From: "USD", To: "GBP", Rate: money.MustParseRate("0.77")})
+
+	rates, err := storage.GetRatesFor(context.Background(), "EUR", []money.Currency{"USD", "GBP", "JPY"})
+
+	assert.Nil(t, err)
+	assert.Len(t, rates, 2)
+	assert.Equal(t, money.MustParseRate("0.8625"), rates["USD"].Rate)
+	assert.Equal(t, money.MustParseRate("1.1"), rates["GBP"].Rate)
+	assert.False(t, rates["USD"].UpdatedAt.IsZero())
+}
+
+func TestStorage_PriceHistory(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+
+	storage.SetPriceFor(context.Background(), "p1", usd("10"), "alice")
+	time.Sleep(time.Millisecond * 10)
+	between := time.Now()
+	time.Sleep(time.Millisecond * 10)
+	storage.SetPriceFor(context.Background(), "p1", usd("12"), "bob")
+	storage.SetPriceFor(context.Background(), "p2", usd("3"), "bob")
+
+	history, err := storage.GetPriceHistory(context.Background(), "p1")
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, usd("12"), history[0].Price)
+	assert.Equal(t, "bob", history[0].Actor)
+	assert.Equal(t, usd("10"), history[1].Price)
+
+	prices, err := storage.GetPricesAt(context.Background(), []string{"p1", "p2"}, between)
+	assert.Nil(t, err)
+	assert.Equal(t, usd("10"), prices["p1"])
+	_, ok := prices["p2"]
+	assert.False(t, ok)
+
+	current, _ := storage.GetPricesFor(context.Background(), []string{"p1"})
+	assert.Equal(t, usd("12"), withoutSource(current)["p1"])
+}
+
+func TestStorage_ScheduledPrices(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+
+	now := time.Now()
+	storage.SetPriceFor(context.Background(), "p1", usd("10"), "alice")
+	storage.SchedulePriceFor(context.Background(), "p1", usd("8"), items.Window{From: now.Add(-time.Hour), To: now.Add(time.Hour)}, "alice")
+	storage.SchedulePriceFor(context.Background(), "p2", usd("5"), items.Window{From: now.Add(time.Hour)}, "alice")
+	storage.SetPriceFor(context.Background(), "p3", usd("3"), "alice")
+	storage.SchedulePriceFor(context.Background(), "p3", usd("2"), items.Window{From: now.Add(time.Hour)}, "alice")
+
+	prices, err := storage.GetPricesFor(context.Background(), []string{"p1", "p2", "p3"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, money.MustParse("8"), prices["p1"].Amount)
+	assert.WithinDuration(t, now.Add(time.Hour), prices["p1"].ValidUntil, time.Second)
+	_, ok := prices["p2"]
+	assert.False(t, ok)
+	assert.Equal(t, money.MustParse("3"), prices["p3"].Amount)
+	assert.WithinDuration(t, now.Add(time.Hour), prices["p3"].ValidUntil, time.Second)
+
+	pricesAt, err := storage.GetPricesAt(context.Background(), []string{"p1", "p2"}, now.Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, money.MustParse("10"), pricesAt["p1"].Amount)
+	assert.Equal(t, money.MustParse("5"), pricesAt["p2"].Amount)
+}
+
+func TestStorage_BackdatedScheduleDoesNotRewriteThePast(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+
+	now := time.Now()
+	storage.SchedulePriceFor(context.Background(), "p1", usd("8"), items.Window{From: now.Add(-time.Hour)}, "alice")
+
+	pricesAt, err := storage.GetPricesAt(context.Background(), []string{"p1"}, now.Add(-30*time.Minute))
+	assert.Nil(t, err)
+	_, ok := pricesAt["p1"]
+	assert.False(t, ok, "the schedule did not exist yet")
+
+	pricesAt, err = storage.GetPricesAt(context.Background(), []string{"p1"}, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, money.MustParse("8"), pricesAt["p1"].Amount)
+}
+
+func TestStorage_SetPricesForIsAtomic(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+
+	err := storage.SetPricesFor(context.Background(), []items.PriceChange{
+		{ItemCode: "p1", Price: usd("1")},
+		{ItemCode: "p2", Price: items.NewPrice(money.MustParse("2"), "EURO")},
+	}, "alice")
+	assert.Equal(t, "Price insert error", err.Error())
+
+	prices, _ := storage.GetPricesFor(context.Background(), []string{"p1", "p2"})
+	assert.Len(t, prices, 0)
+
+	now := time.Now()
+	err = storage.SetPricesFor(context.Background(), []items.PriceChange{
+		{ItemCode: "p1", Price: usd("1")},
+		{ItemCode: "p2", Price: usd("2"), Window: &items.Window{From: now.Add(-time.Hour)}},
+	}, "alice")
+	assert.Nil(t, err)
+
+	prices, _ = storage.GetPricesFor(context.Background(), []string{"p1", "p2"})
+	assert.Equal(t, usd("1"), withoutSource(prices)["p1"])
+	assert.Equal(t, money.MustParse("2"), prices["p2"].Amount)
+}
+
+func TestStorage_DeletePricesFor(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+
+	now := time.Now()
+	storage.SetPriceFor(context.Background(), "p1", usd("10"), "alice")
+	storage.SchedulePriceFor(context.Background(), "p1", usd("8"), items.Window{From: now.Add(-time.Hour), To: now.Add(time.Hour)}, "alice")
+	storage.SchedulePriceFor(context.Background(), "p2", usd("5"), items.Window{From: now.Add(time.Hour)}, "alice")
+	storage.SetPriceFor(context.Background(), "p3", usd("3"), "alice")
+	time.Sleep(time.Millisecond * 10)
+	beforeDelete := time.Now()
+
+	deleted, err := storage.DeletePricesFor(context.Background(), []string{"p1", "p2", "p4"}, "bob")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"p1", "p2"}, deleted)
+
+	prices, err := storage.GetPricesFor(context.Background(), []string{"p1", "p2", "p3"})
+	assert.Nil(t, err)
+	assert.Len(t, prices, 1)
+	assert.Equal(t, usd("3"), withoutSource(prices)["p3"])
+
+	pricesAt, _ := storage.GetPricesAt(context.Background(), []string{"p1", "p2"}, beforeDelete)
+	assert.Equal(t, money.MustParse("8"), pricesAt["p1"].Amount)
+	pricesAt, _ = storage.GetPricesAt(context.Background(), []string{"p1", "p2"}, now.Add(2*time.Hour))
+	assert.Len(t, pricesAt, 0)
+
+	history, _ := storage.GetPriceHistory(context.Background(), "p1")
+	assert.True(t, history[0].Deleted)
+	assert.Equal(t, "bob", history[0].Actor)
+
+	deleted, err = storage.DeletePricesFor(context.Background(), []string{"p1"}, "bob")
+	assert.Nil(t, err)
+	assert.Len(t, deleted, 0)
+
+	storage.SetPriceFor(context.Background(), "p1", usd("11"), "alice")
+	prices, _ = storage.GetPricesFor(context.Background(), []string{"p1"})
+	assert.Equal(t, int64(3), prices["p1"].Version)
+	assert.Equal(t, usd("11"), withoutSource(prices)["p1"])
+}
+
+func TestStorage_GetItemCodes(t *testing.T) {
+	storage := newStorage(t)
+	defer clearDB(storage)
+
+	storage.SetPriceFor(context.Background(), "p3", usd("3"), "alice")
+	storage.SetPriceFor(context.Background(), "p1", usd("1"), "alice")
+	storage.SetPriceFor(context.Background(), "p4", usd("4"), "alice")
+	storage.SchedulePriceFor(context.Background(), "p2", usd("2"), items.Window{From: time.Now().Add(time.Hour)}, "alice")
+	storage.DeletePricesFor(context.Background(), []string{"p4"}, "bob")
+
+	codes, err := storage.GetItemCodes(context.Background(), "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"p1", "p2"}, codes)
+
+	codes, err = storage.GetItemCodes(context.Background(), "p2", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"p3"}, codes)
+}
+
+// withoutSource drops when and from which item version the prices were read
+func withoutSource(prices map[string]items.Price) map[string]items.Price {
+	for k, v := range prices {
+		v.LoadedAt, v.Version = time.Time{}, 0
+		prices[k] = v
+	}
+	return prices
+}
+
+func usd(price string) items.Price {
+	return items.NewPrice(money.MustParse(price), money.DefaultCurrency)
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lib/pq"
+
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/tracing"
+)
+
+const (
+	ratesQuery      = "SELECT base_currency, rate, updated_at FROM fx_rates WHERE quote_currency = $1 AND base_currency = ANY ($2);"
+	insertRateQuery = "INSERT INTO fx_rates (base_currency, quote_currency, rate, updated_at) VALUES ($1, $2, $3::decimal, NOW()) ON CONFLICT (base_currency, quote_currency) DO UPDATE SET rate = EXCLUDED.rate, updated_at = EXCLUDED.updated_at;"
+)
+
+// GetRatesFor returns the rates to convert each one of the from currencies into the to currency
+func (sr storageRepository) GetRatesFor(ctx context.Context, to money.Currency, from []money.Currency) (_ map[money.Currency]money.ExchangeRate, err error) {
+	ctx, q := startQuery(ctx, "get_rates", tracing.Int("currencies.count", len(from)))
+	defer q.end(&err)
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	res := map[money.Currency]money.ExchangeRate{}
+
+	codes := make([]string, len(from))
+	for i, c := range from {
+		codes[i] = c.String()
+	}
+
+	rows, err := sr.db.QueryContext(ctx, ratesQuery, to.String(), pq.Array(codes))
+	if err != nil {
+		sr.logger.Error(ctx, "rate_query", logging.Err(err))
+		return res, errors.New("Rate query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var base string
+		rate := money.ExchangeRate{To: to}
+		if err := rows.Scan(&base, &rate.Rate, &rate.UpdatedAt); err != nil {
+			sr.logger.Error(ctx, "rate_scan", logging.Err(err))
+			return res, errors.New("Rate scan error")
+		}
+		rate.From = money.Currency(base)
+		res[rate.From] = rate
+	}
+	if err := rows.Err(); err != nil {
+		sr.logger.Error(ctx, "rate_scan", logging.Err(err))
+		return res, errors.New("Rate scan error")
+	}
+	return res, nil
+}
+
+// SetRate creates or replaces the rate between two currencies
+func (sr storageRepository) SetRate(ctx context.Context, rate money.ExchangeRate) (err error) {
+	ctx, q := startQuery(ctx, "set_rate")
+	defer q.end(&err)
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	_, err = sr.db.ExecContext(ctx, insertRateQuery, rate.From.String(), rate.To.String(), rate.Rate)
+	if err != nil {
+		sr.logger.Error(ctx, "rate_insert", logging.Err(err))
+		return errors.New("Rate insert error")
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package storage
+
+import (
+	"context"
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+)
+
+const insertScheduledQuery = `INSERT INTO scheduled_prices (item_code, item_price, currency, effective_from, effective_to, actor)
+	VALUES ($1, $2::decimal, $3, $4, $5, $6);`
+
+// SchedulePriceFor adds a price that is effective for the item during the window,
+// overriding the item price and any older scheduled price with an overlapping window
+func (sr storageRepository) SchedulePriceFor(ctx context.Context, itemCode string, price items.Price, window items.Window, actor string) error {
+	return sr.SetPricesFor(ctx, []items.PriceChange{{ItemCode: itemCode, Price: price, Window: &window}}, actor)
+}
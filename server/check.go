@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/repositories/cache"
+	"github.com/ldegaetano/go-ddd-example/repositories/storage"
+	"github.com/ldegaetano/go-ddd-example/services/consistency"
+	"github.com/ldegaetano/go-ddd-example/settings"
+)
+
+type checkReport struct {
+	Checked    int       `json:"checked"`
+	Mismatched []string  `json:"mismatched"`
+	Missing    []string  `json:"missing"`
+	Orphaned   []string  `json:"orphaned"`
+	Repaired   int       `json:"repaired"`
+	Failed     int       `json:"failed"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Check runs the "check" command: it checks the cache against the database once, repairing
+// it with -repair, and prints the report as JSON. It returns the exit code, 1 when the cache
+// is left inconsistent.
+func Check(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix the inconsistencies found")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := logging.Default()
+	pricesCache := cache.FromSettings(logger)
+	if closer, ok := pricesCache.(io.Closer); ok {
+		defer closer.Close()
+	}
+	inspector, err := inspectorOf(pricesCache)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	// a check only reads the schema, it never migrates it
+	pricesStorage, err := storage.Connect(logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	defer pricesStorage.Close()
+	checker := consistency.NewChecker(pricesStorage, inspector, settings.Cache.CheckBatchSize)
+
+	report := checker.Check(context.Background(), *repair)
+	logReport(logger.Named(loggerName), report)
+	out, _ := json.MarshalIndent(checkReport{
+		Checked:    report.Checked,
+		Mismatched: report.Mismatched,
+		Missing:    report.Missing,
+		Orphaned:   report.Orphaned,
+		Repaired:   report.Repaired,
+		Failed:     report.Failed,
+		StartedAt:  report.StartedAt,
+		FinishedAt: report.FinishedAt,
+	}, "", "  ")
+	fmt.Println(string(out))
+
+	if report.Failed > 0 || !report.Consistent() && !*repair {
+		return 1
+	}
+	return 0
+}
+
+// scheduleChecks checks the cache against the database every settings.Cache.CheckInterval
+// in the background until the returned func is called, which cancels the check running if any and waits for it
+func scheduleChecks(pricesCache cache.Repository, logger *logging.Logger) (stop func()) {
+	checkLogger := logger.Named(loggerName)
+	inspector, err := inspectorOf(pricesCache)
+	if err != nil {
+		checkLogger.Error(context.Background(), "consistency_check", logging.Err(err))
+		return func() {}
+	}
+	// the storage the server connected to, closed by the server
+	pricesStorage, err := storage.New(logger)
+	if err != nil {
+		checkLogger.Error(context.Background(), "consistency_check", logging.Err(err))
+		return func() {}
+	}
+	checker := consistency.NewChecker(pricesStorage, inspector, settings.Cache.CheckBatchSize)
+
+	ticker := time.NewTicker(settings.Cache.CheckInterval)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				logReport(checkLogger, checker.Check(ctx, settings.Cache.CheckRepair))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		cancel()
+		<-stopped
+	}
+}
+
+func inspectorOf(pricesCache cache.Repository) (cache.Inspector, error) {
+	inspector, ok := pricesCache.(cache.Inspector)
+	if !ok {
+		return nil, fmt.Errorf("the %s cache mode can not be checked", settings.Cache.Mode)
+	}
+	return inspector, nil
+}
+
+func logReport(logger *logging.Logger, r consistency.Report) {
+	logger.Info(context.Background(), "consistency_check",
+		logging.F("checked", r.Checked),
+		logging.F("mismatched", len(r.Mismatched)),
+		logging.F("missing", len(r.Missing)),
+		logging.F("orphaned", len(r.Orphaned)),
+		logging.F("repaired", r.Repaired),
+		logging.F("failed", r.Failed),
+		logging.F("took", r.FinishedAt.Sub(r.StartedAt).String()),
+	)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ldegaetano/go-ddd-example/errors"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/metrics"
+	"github.com/ldegaetano/go-ddd-example/tracing"
+)
+
+const (
+	// unmatchedRoute is the route label of the requests no route matched, so unknown paths do not make new series
+	unmatchedRoute = "unmatched"
+	// maxRequestIDLength bounds the request ids taken from the callers, longer ones are replaced
+	maxRequestIDLength = 128
+)
+
+var (
+	httpRequests = metrics.NewCounter("http_requests_total",
+		"Requests served by method, route and status", "method", "route", "status")
+	httpDuration = metrics.NewHistogram("http_request_duration_seconds",
+		"Time taken to serve the requests by method, route and status", metrics.DefaultBuckets, "method", "route", "status")
+)
+
+// requestTimeout cancels the context of the requests that take longer than timeout, along with
+// the cache and database calls made with it. A timeout of 0 never cancels them.
+func requestTimeout(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// recordMetrics counts the requests and how long they took per route, the route pattern
+// and not the path so every item code does not make a new series
+func recordMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.Inc(c.Request.Method, route, status)
+		httpDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route, status)
+	}
+}
+
+// extractTrace makes the spans of the request children of the caller span in the W3C traceparent header, if any
+func extractTrace() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if traceparent := c.GetHeader(tracing.TraceparentHeader); traceparent != "" {
+			c.Request = c.Request.WithContext(tracing.Extract(c.Request.Context(), traceparent))
+		}
+		c.Next()
+	}
+}
+
+// requestID carries the X-Request-ID of the request, or a new one when the caller sent none or an invalid one,
+// in the context of the request so every line logged with it has the id, and echoes it in the response
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(logging.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Request = c.Request.WithContext(logging.ContextWithRequestID(c.Request.Context(), id))
+		c.Header(logging.RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// validRequestID tells if id is not empty, at most maxRequestIDLength long and only has printable ASCII
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for k := 0; k < len(id); k++ {
+		if id[k] < '!' || id[k] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// logRequests logs a line for every request once served, in place of the gin text logger
+func logRequests(logger *logging.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		logger.Info(c.Request.Context(), "request",
+			logging.F("method", c.Request.Method),
+			logging.F("path", c.Request.URL.Path),
+			logging.F("route", route),
+			logging.F("status", c.Writer.Status()),
+			logging.F("bytes", c.Writer.Size()),
+			logging.F("duration_ms", float64(time.Since(start))/float64(time.Millisecond)),
+			logging.F("client_ip", c.ClientIP()),
+		)
+	}
+}
+
+// recoverPanics answers an internal error to the requests whose handler panicked and logs the panic
+// along with its stack, in place of the gin text recovery
+func recoverPanics(logger *logging.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				ctx := c.Request.Context()
+				logger.Error(ctx, "panic", logging.F("panic", fmt.Sprint(r)), logging.F("stack", string(debug.Stack())))
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+					"code":       errors.InternalError.Code,
+					"message":    errors.InternalError.Message,
+					"request_id": logging.RequestID(ctx),
+				})
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/settings"
+)
+
+func TestRequestID(t *testing.T) {
+	out := &bytes.Buffer{}
+	router := gin.New()
+	router.Use(requestID(), logRequests(logging.New(out, logging.LevelInfo, nil).Named("http")))
+	router.GET("/items/:code", func(c *gin.Context) {
+		c.String(http.StatusOK, logging.RequestID(c.Request.Context()))
+	})
+
+	for _, test := range []struct {
+		sent     string
+		expected string
+	}{
+		{sent: "req-1", expected: "req-1"},
+		{sent: "", expected: ""},
+		{sent: "with spaces", expected: ""},
+		{sent: strings.Repeat("a", maxRequestIDLength+1), expected: ""},
+	} {
+		out.Reset()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/items/p1", nil)
+		req.Header.Set(logging.RequestIDHeader, test.sent)
+		router.ServeHTTP(w, req)
+
+		id := w.Header().Get(logging.RequestIDHeader)
+		assert.Equal(t, id, w.Body.String())
+		if test.expected != "" {
+			assert.Equal(t, test.expected, id)
+		} else {
+			assert.Len(t, id, 32, test.sent)
+		}
+
+		line := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+		assert.Equal(t, id, line["request_id"])
+		assert.Equal(t, "http", line["logger"])
+		assert.Equal(t, "/items/:code", line["route"])
+		assert.Equal(t, "/items/p1", line["path"])
+		assert.Equal(t, float64(http.StatusOK), line["status"])
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	out := &bytes.Buffer{}
+	router := gin.New()
+	router.Use(requestID(), recoverPanics(logging.New(out, logging.LevelInfo, nil)))
+	router.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/panic", nil)
+	req.Header.Set(logging.RequestIDHeader, "req-1")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"code":0,"message":"Internal server error.","request_id":"req-1"}`, w.Body.String())
+	assert.Contains(t, out.String(), `"msg":"panic","request_id":"req-1","panic":"boom"`)
+}
+
+func TestNewRouter_CountsPanics(t *testing.T) {
+	out := &bytes.Buffer{}
+	router := newRouter(logging.New(out, logging.LevelInfo, nil))
+	router.GET("/count/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/count/panic", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	exposed := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", settings.Server.MetricsPath, nil)
+	router.ServeHTTP(exposed, req)
+	assert.Contains(t, exposed.Body.String(), `http_requests_total{method="GET",route="/count/panic",status="500"} 1`)
+	assert.Contains(t, exposed.Body.String(), `http_request_duration_seconds_count{method="GET",route="/count/panic",status="500"} 1`)
+	assert.Contains(t, out.String(), `"msg":"request"`)
+	assert.Contains(t, out.String(), `"status":500`)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/repositories/storage"
+)
+
+type migrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Migrate runs the "migrate" command: "up" applies the pending migrations, "down [-steps n]" reverts the
+// last n applied (1 by default) and "status" prints every migration as JSON. It returns the exit code.
+func Migrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: migrate up|down [-steps n]|status")
+		return 2
+	}
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	steps := flags.Int("steps", 1, "how many migrations to revert")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	migrator, err := storage.NewMigrator(logging.Default())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer migrator.Close()
+
+	var migrated []storage.Migration
+	switch args[0] {
+	case "up":
+		migrated, err = migrator.Up()
+	case "down":
+		migrated, err = migrator.Down(*steps)
+	case "status":
+		return printMigrationStatus(migrator)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %s\n", args[0])
+		return 2
+	}
+
+	for _, m := range migrated {
+		fmt.Printf("%s %04d_%s\n", args[0], m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func printMigrationStatus(migrator *storage.Migrator) int {
+	status, err := migrator.Status()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	response := make([]migrationStatus, len(status))
+	for k, s := range status {
+		response[k] = migrationStatus{Version: s.Version, Name: s.Name}
+		if !s.AppliedAt.IsZero() {
+			appliedAt := s.AppliedAt
+			response[k].AppliedAt = &appliedAt
+		}
+	}
+	out, _ := json.MarshalIndent(response, "", "  ")
+	fmt.Println(string(out))
+	return 0
+}
@@ -1,20 +1,165 @@
 package server
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/ldegaetano/go-ddd-example/handlers/prices"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/metrics"
+	"github.com/ldegaetano/go-ddd-example/repositories/cache"
+	pricesService "github.com/ldegaetano/go-ddd-example/services/prices"
+	"github.com/ldegaetano/go-ddd-example/settings"
+	"github.com/ldegaetano/go-ddd-example/tracing"
+)
+
+const (
+	// warmUpReportInterval is how often the progress of the warm-up on start is logged
+	warmUpReportInterval = 5 * time.Second
+	loggerName           = "server"
 )
 
-//Start new server in 8080 port
-func Start() {
-	router := gin.Default()
+// Start serves on settings.Server.Addr until SIGINT or SIGTERM, then waits for the requests in flight
+// up to ShutdownTimeout, stops the work running in the background and closes the connections to the storage
+// and the cache. It returns the exit code, 1 when the server could not start or stopped serving on its own.
+func Start() int {
+	logger := logging.Default()
+	serverLogger := logger.Named(loggerName)
+	shutdownTracing, err := tracing.FromSettings(logger)
+	if err != nil {
+		serverLogger.Error(context.Background(), "start", logging.Err(err))
+		return 1
+	}
+	// deferred before anything else so the spans of the shutdown are exported too
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), settings.Server.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			serverLogger.Error(ctx, "shutdown_tracing", logging.Err(err))
+		}
+	}()
+
+	router := newRouter(logger)
+
+	pricesHandler, err := prices.StartHandler(logger)
+	if err != nil {
+		serverLogger.Error(context.Background(), "start", logging.Err(err))
+		return 1
+	}
+	// deferred first so the connections are closed after everything using them stopped
+	defer pricesHandler.Close()
+	pricesHandler.RegisterMetrics()
+	// caches with an in process tier must hear about the prices changed by other instances
+	if subscriber, ok := pricesHandler.Cache.(cache.Subscriber); ok {
+		defer subscriber.Subscribe()()
+	}
+	if settings.Cache.WarmUpOnStart {
+		warmUp(pricesHandler.PricesService, serverLogger)
+	}
+	if settings.Cache.CheckInterval > 0 {
+		defer scheduleChecks(pricesHandler.Cache, logger)()
+	}
+	routePrices(router, pricesHandler)
+
+	if err := serve(serverLogger, &http.Server{
+		Addr:              settings.Server.Addr,
+		Handler:           router,
+		ReadTimeout:       settings.Server.ReadTimeout,
+		ReadHeaderTimeout: settings.Server.ReadHeaderTimeout,
+		WriteTimeout:      settings.Server.WriteTimeout,
+		IdleTimeout:       settings.Server.IdleTimeout,
+	}); err != nil {
+		return 1
+	}
+	return 0
+}
 
-	pricesHandler := prices.StartHandler()
+// routePrices routes the endpoints of the prices handler
+func routePrices(router *gin.Engine, pricesHandler prices.PricesHandler) {
+	router.GET(pricesHandler.LivenessPath, pricesHandler.GetLiveness)
+	router.GET(pricesHandler.ReadinessPath, pricesHandler.GetReadiness)
 	pricesBase := router.Group(pricesHandler.BasePath)
 	{
 		pricesBase.GET(pricesHandler.PricesPath, pricesHandler.GetPricesFor)
+		pricesBase.GET(pricesHandler.HistoryPath, pricesHandler.GetPriceHistory)
 		pricesBase.POST(pricesHandler.PricesPath, pricesHandler.SetPricesFor)
+		pricesBase.POST(pricesHandler.ActionPath, pricesHandler.PricesAction)
+		pricesBase.DELETE(pricesHandler.PricesPath, pricesHandler.DeletePricesFor)
+		pricesBase.POST(pricesHandler.RatesPath, pricesHandler.SetRate)
+		pricesBase.GET(pricesHandler.StatsPath, pricesHandler.GetStats)
+		pricesBase.GET(pricesHandler.HealthPath, pricesHandler.GetHealth)
+		pricesBase.POST(pricesHandler.WarmUpPath, pricesHandler.WarmUpCache)
+		pricesBase.GET(pricesHandler.WarmUpPath, pricesHandler.GetWarmUp)
+	}
+}
+
+// newRouter returns a router with the middlewares every request goes through and the metrics route.
+// Requests are logged and counted outside of the panic recovery, so the ones that panicked are too.
+func newRouter(logger *logging.Logger) *gin.Engine {
+	// in debug mode gin prints every route and its warnings to stdout, around the structured log
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(requestID(), logRequests(logger.Named("http")), recordMetrics(), recoverPanics(logger.Named(loggerName)),
+		extractTrace(), requestTimeout(settings.Server.RequestTimeout))
+	router.GET(settings.Server.MetricsPath, gin.WrapH(metrics.Handler()))
+	return router
+}
+
+// serve runs the server until SIGINT or SIGTERM and then shuts it down gracefully. It fails when the server
+// stops serving before, e.g. because its address is already in use.
+func serve(logger *logging.Logger, srv *http.Server) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Info(context.Background(), "start", logging.F("addr", srv.Addr))
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serveErr:
+		logger.Error(context.Background(), "serve", logging.Err(err))
+		return err
+	case sig := <-signals:
+		logger.Info(context.Background(), "shutdown", logging.F("signal", sig.String()))
 	}
 
-	router.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), settings.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error(ctx, "shutdown", logging.Err(err))
+	}
+	return nil
+}
+
+// warmUp caches every item price, reporting the progress every few seconds until it is over
+func warmUp(service pricesService.Service, logger *logging.Logger) {
+	ctx := context.Background()
+	done, err := service.WarmUp(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, "warm_up", logging.Err(err))
+		return
+	}
+
+	ticker := time.NewTicker(warmUpReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			p := service.WarmUpProgress()
+			logger.Info(ctx, "warm_up", logging.F("batches", p.Batches), logging.F("failed", p.Failed),
+				logging.F("cached", p.Cached), logging.F("took", p.FinishedAt.Sub(p.StartedAt).String()))
+			return
+		case <-ticker.C:
+			p := service.WarmUpProgress()
+			logger.Info(ctx, "warm_up", logging.F("batches", p.Batches), logging.F("failed", p.Failed), logging.F("cached", p.Cached))
+		}
+	}
 }
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ldegaetano/go-ddd-example/handlers/prices"
+	"github.com/ldegaetano/go-ddd-example/logging"
+)
+
+func TestServe_AddressInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	out := &bytes.Buffer{}
+	err = serve(logging.New(out, logging.LevelInfo, nil), &http.Server{Addr: listener.Addr().String()})
+	assert.NotNil(t, err, "a server that can not listen should fail")
+	assert.Contains(t, out.String(), `"msg":"serve"`)
+}
+
+func TestRoutePrices(t *testing.T) {
+	router := newRouter(nil)
+	handler := prices.NewHandler(nil, nil, nil)
+	assert.NotPanics(t, func() { routePrices(router, handler) })
+
+	routes := map[string]bool{}
+	for _, r := range router.Routes() {
+		routes[r.Method+" "+r.Path] = true
+	}
+	assert.True(t, routes["GET /api/items/:item_code/prices/history"])
+	assert.True(t, routes["GET /api/items/prices"])
+	assert.True(t, routes["POST /api/items/prices:action"])
+
+	// the handler has no service, the history route is matched when answered with something else than 404
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/items/p1/prices/history", nil))
+	assert.NotEqual(t, http.StatusNotFound, w.Code)
+}
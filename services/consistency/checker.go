@@ -0,0 +1,185 @@
+package consistency
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+)
+
+// NewChecker returns a checker that reads batchSize items at once, 0 uses the default
+func NewChecker(storage storageRepository, cache cacheRepository, batchSize int) *Checker {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	return &Checker{storage: storage, cache: cache, batchSize: batchSize}
+}
+
+// Check compares the price of every stored item with the cached one and looks for cached items without
+// a stored price. When repairing, mismatched and missing items are cached with the stored price and
+// orphaned ones are dropped from the cache, other instances are told about both.
+func (c *Checker) Check(ctx context.Context, repair bool) Report {
+	report := Report{
+		Mismatched: []string{},
+		Missing:    []string{},
+		Orphaned:   []string{},
+		StartedAt:  time.Now(),
+	}
+	c.checkStored(ctx, &report, repair)
+	c.checkCached(ctx, &report, repair)
+	report.FinishedAt = time.Now()
+	return report
+}
+
+// checkStored pages through the stored items comparing their prices with the cached ones
+func (c *Checker) checkStored(ctx context.Context, report *Report, repair bool) {
+	after := ""
+	for {
+		itemsCode, err := c.storage.GetItemCodes(ctx, after, c.batchSize)
+		if err != nil {
+			report.Failed++
+			return
+		}
+		if len(itemsCode) == 0 {
+			return
+		}
+		after = itemsCode[len(itemsCode)-1]
+
+		stored, err := c.storage.GetPricesFor(ctx, itemsCode)
+		if err != nil {
+			report.Failed++
+			continue
+		}
+		cached, missing, err := c.cache.InspectPricesFor(ctx, itemsCode)
+		if err != nil {
+			report.Failed++
+			continue
+		}
+		report.Checked += len(itemsCode)
+
+		isMissing := map[string]bool{}
+		for _, i := range missing {
+			isMissing[i] = true
+		}
+		fixes := map[string]items.Price{}
+		for _, i := range itemsCode {
+			storedPrice, ok := stored[i]
+			if !ok {
+				// items without a stored price are only wrong if cached, checkCached finds those
+				continue
+			}
+			cachedPrice, isCached := cached[i]
+			switch {
+			case isMissing[i] || isCached && differ(cachedPrice, storedPrice):
+				report.Mismatched = append(report.Mismatched, i)
+			case !isCached:
+				report.Missing = append(report.Missing, i)
+			default:
+				continue
+			}
+			fixes[i] = storedPrice
+		}
+
+		if repair && len(fixes) > 0 {
+			c.repair(ctx, report, fixes)
+		}
+	}
+}
+
+// checkCached scans the cached items looking for the ones without a stored price
+func (c *Checker) checkCached(ctx context.Context, report *Report, repair bool) {
+	seen := map[string]bool{}
+	var cursor uint64
+	for {
+		itemsCode, next, err := c.cache.ScanItemCodes(ctx, cursor, int64(c.batchSize))
+		if err != nil {
+			report.Failed++
+			return
+		}
+
+		unseen := []string{}
+		for _, i := range itemsCode {
+			if !seen[i] {
+				seen[i] = true
+				unseen = append(unseen, i)
+			}
+		}
+		if len(unseen) > 0 {
+			c.checkOrphaned(ctx, report, unseen, repair)
+		}
+
+		if cursor = next; cursor == 0 {
+			return
+		}
+	}
+}
+
+// checkOrphaned reports the items cached with a price that have no stored price.
+// The cache is read before the storage, so a price set meanwhile is not taken for an orphan.
+func (c *Checker) checkOrphaned(ctx context.Context, report *Report, itemsCode []string, repair bool) {
+	cached, _, err := c.cache.InspectPricesFor(ctx, itemsCode)
+	if err != nil {
+		report.Failed++
+		return
+	}
+	if len(cached) == 0 {
+		return
+	}
+
+	cachedCodes := []string{}
+	for i := range cached {
+		cachedCodes = append(cachedCodes, i)
+	}
+	stored, err := c.storage.GetPricesFor(ctx, cachedCodes)
+	if err != nil {
+		report.Failed++
+		return
+	}
+
+	orphaned := []string{}
+	for _, i := range cachedCodes {
+		if _, ok := stored[i]; !ok {
+			orphaned = append(orphaned, i)
+		}
+	}
+	if len(orphaned) == 0 {
+		return
+	}
+	sort.Strings(orphaned)
+	report.Orphaned = append(report.Orphaned, orphaned...)
+
+	if repair {
+		if err := c.cache.DeletePricesFor(ctx, orphaned); err != nil {
+			report.Failed++
+			return
+		}
+		c.cache.InvalidateFor(ctx, orphaned)
+		report.Repaired += len(orphaned)
+	}
+}
+
+// repair caches the stored prices of the items
+func (c *Checker) repair(ctx context.Context, report *Report, fixes map[string]items.Price) {
+	itemsCode := make([]string, 0, len(fixes))
+	for i := range fixes {
+		itemsCode = append(itemsCode, i)
+	}
+	sort.Strings(itemsCode)
+
+	if err := c.cache.SetPricesFor(ctx, fixes); err != nil {
+		report.Failed++
+		return
+	}
+	c.cache.InvalidateFor(ctx, itemsCode)
+	report.Repaired += len(itemsCode)
+}
+
+// differ tells if the cached price is other than the stored one. A price cached from a newer
+// item version than the stored one was cached after the storage was read, so it is not compared.
+func differ(cached, stored items.Price) bool {
+	if cached.Version > stored.Version {
+		return false
+	}
+	return cached.Amount != stored.Amount || cached.Currency != stored.Currency
+}
@@ -0,0 +1,184 @@
+package consistency
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+)
+
+type mockStorage struct {
+	prices map[string]items.Price // stored prices by itemCode
+	codes  []string               // item codes, with or without a price
+	err    error                  // error to return on every call
+}
+
+func (m *mockStorage) GetItemCodes(ctx context.Context, after string, limit int) ([]string, error) {
+	codes := []string{}
+	for _, i := range m.codes {
+		if i > after && len(codes) < limit {
+			codes = append(codes, i)
+		}
+	}
+	return codes, m.err
+}
+
+func (m *mockStorage) GetPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, error) {
+	result := map[string]items.Price{}
+	for _, i := range itemsCode {
+		if p, ok := m.prices[i]; ok {
+			result[i] = p
+		}
+	}
+	return result, m.err
+}
+
+type mockCache struct {
+	prices      map[string]items.Price // cached prices by itemCode
+	missing     map[string]bool        // items known to have no price
+	scans       int                    // how many times ScanItemCodes was called
+	invalidated []string               // items of every invalidation published
+}
+
+func (m *mockCache) InspectPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, []string, error) {
+	result := map[string]items.Price{}
+	missing := []string{}
+	for _, i := range itemsCode {
+		if p, ok := m.prices[i]; ok {
+			result[i] = p
+		}
+		if m.missing[i] {
+			missing = append(missing, i)
+		}
+	}
+	return result, missing, nil
+}
+
+// ScanItemCodes returns one item per call, the first one twice as Redis may do
+func (m *mockCache) ScanItemCodes(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	m.scans++
+	codes := []string{}
+	for i := range m.prices {
+		codes = append(codes, i)
+	}
+	for i := range m.missing {
+		codes = append(codes, i)
+	}
+	sort.Strings(codes)
+	codes = append(codes[:1], codes...)
+
+	if int(cursor) >= len(codes)-1 {
+		return codes[cursor:], 0, nil
+	}
+	return codes[cursor : cursor+1], cursor + 1, nil
+}
+
+func (m *mockCache) SetPricesFor(ctx context.Context, itemsPrice map[string]items.Price) error {
+	for k, v := range itemsPrice {
+		m.prices[k] = v
+		delete(m.missing, k)
+	}
+	return nil
+}
+
+func (m *mockCache) DeletePricesFor(ctx context.Context, itemsCode []string) error {
+	for _, i := range itemsCode {
+		delete(m.prices, i)
+		delete(m.missing, i)
+	}
+	return nil
+}
+
+func (m *mockCache) InvalidateFor(ctx context.Context, itemsCode []string) error {
+	m.invalidated = append(m.invalidated, itemsCode...)
+	return nil
+}
+
+func TestCheck_ReportsInconsistencies(t *testing.T) {
+	storage := &mockStorage{
+		prices: map[string]items.Price{
+			"p1": usd("1", 1),
+			"p2": usd("2", 2),
+			"p3": usd("3", 1),
+			"p4": usd("4", 1),
+			"p5": usd("5", 1),
+		},
+		codes: []string{"p1", "p2", "p3", "p4", "p5", "p6"},
+	}
+	cache := &mockCache{
+		prices: map[string]items.Price{
+			"p1": usd("1", 1),
+			"p2": usd("20", 1),
+			"p5": usd("50", 2),
+			"p6": usd("6", 1),
+			"p9": usd("9", 1),
+		},
+		missing: map[string]bool{"p4": true, "p8": true},
+	}
+	checker := NewChecker(storage, cache, 2)
+
+	report := checker.Check(context.Background(), false)
+
+	assert.Equal(t, 6, report.Checked)
+	assert.Equal(t, []string{"p2", "p4"}, report.Mismatched)
+	assert.Equal(t, []string{"p3"}, report.Missing)
+	assert.Equal(t, []string{"p6", "p9"}, report.Orphaned)
+	assert.Equal(t, 0, report.Repaired)
+	assert.Equal(t, 0, report.Failed)
+	assert.False(t, report.Consistent())
+	assert.Equal(t, usd("20", 1), cache.prices["p2"], "nothing should be repaired")
+	assert.True(t, cache.scans > 1, "the whole cache should be scanned")
+}
+
+func TestCheck_Repairs(t *testing.T) {
+	storage := &mockStorage{
+		prices: map[string]items.Price{
+			"p1": usd("1", 1),
+			"p2": usd("2", 2),
+			"p4": usd("4", 1),
+		},
+		codes: []string{"p1", "p2", "p4"},
+	}
+	cache := &mockCache{
+		prices: map[string]items.Price{
+			"p2": usd("20", 1),
+			"p9": usd("9", 1),
+		},
+		missing: map[string]bool{"p4": true},
+	}
+	checker := NewChecker(storage, cache, 0)
+
+	report := checker.Check(context.Background(), true)
+
+	assert.Equal(t, 4, report.Repaired)
+	assert.Equal(t, map[string]items.Price{"p1": usd("1", 1), "p2": usd("2", 2), "p4": usd("4", 1)}, cache.prices)
+	assert.Empty(t, cache.missing)
+	assert.ElementsMatch(t, []string{"p1", "p2", "p4", "p9"}, cache.invalidated)
+
+	report = checker.Check(context.Background(), false)
+	assert.True(t, report.Consistent())
+	assert.Empty(t, report.Missing)
+}
+
+func TestCheck_StorageError(t *testing.T) {
+	storage := &mockStorage{err: errors.New("Price query error")}
+	cache := &mockCache{prices: map[string]items.Price{"p1": usd("1", 1)}}
+	checker := NewChecker(storage, cache, 0)
+
+	report := checker.Check(context.Background(), true)
+
+	assert.Equal(t, 2, report.Failed)
+	assert.Empty(t, report.Orphaned, "items should not be taken for orphans when the storage fails")
+	assert.Contains(t, cache.prices, "p1")
+}
+
+func usd(price string, version int64) items.Price {
+	p := items.NewPrice(money.MustParse(price), money.DefaultCurrency)
+	p.Version = version
+	return p
+}
@@ -0,0 +1,57 @@
+package consistency
+
+import (
+	"context"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+)
+
+type (
+	// Report is the outcome of a check of the cache against the storage
+	Report struct {
+		// Checked is how many items were checked
+		Checked int
+		// Mismatched are the items cached with a price other than the stored one,
+		// or known to have no price while they have one
+		Mismatched []string
+		// Missing are the items with a stored price that are not cached
+		Missing []string
+		// Orphaned are the items cached without a stored price
+		Orphaned []string
+		// Repaired is how many of the items above were fixed, 0 unless repairing
+		Repaired int
+		// Failed is how many batches could not be checked or repaired
+		Failed     int
+		StartedAt  time.Time
+		FinishedAt time.Time
+	}
+
+	storageRepository interface {
+		GetItemCodes(ctx context.Context, after string, limit int) ([]string, error)
+		GetPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, error)
+	}
+
+	cacheRepository interface {
+		InspectPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, []string, error)
+		ScanItemCodes(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error)
+		SetPricesFor(ctx context.Context, itemsPrice map[string]items.Price) error
+		DeletePricesFor(ctx context.Context, itemsCode []string) error
+		InvalidateFor(ctx context.Context, itemsCode []string) error
+	}
+
+	// Checker compares the cached prices with the stored ones
+	Checker struct {
+		storage   storageRepository
+		cache     cacheRepository
+		batchSize int
+	}
+)
+
+const defaultBatchSize = 500
+
+// Consistent tells if no item was found mismatched or orphaned, missing items are not
+// inconsistent as prices are only cached once they are read
+func (r Report) Consistent() bool {
+	return len(r.Mismatched) == 0 && len(r.Orphaned) == 0
+}
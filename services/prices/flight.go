@@ -0,0 +1,115 @@
+package prices
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+)
+
+type (
+	// flightGroup coalesces concurrent lookups of the same items, while an item is
+	// being looked up every other caller asking for it waits for that result
+	// instead of doing its own lookup
+	flightGroup struct {
+		mu        sync.Mutex
+		calls     map[string]*flightCall
+		collapsed uint64
+	}
+
+	// flightCall is an in progress lookup of one item, done is closed once it is over
+	flightCall struct {
+		done  chan struct{}
+		price items.Price
+		found bool
+		err   error
+		// abandoned tells the lookup failed because the context of the caller doing it was done
+		abandoned bool
+	}
+
+	lookupFunc func(ctx context.Context, itemsCode []string) (map[string]items.Price, error)
+)
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flightCall{}}
+}
+
+// do looks up the items not already in flight with lookup and waits for the rest, until ctx is done.
+// Items missing from the lookup result are left out of the returned prices. The items whose lookup was
+// given up because the context of the caller doing it was done are looked up again with ctx.
+func (g *flightGroup) do(ctx context.Context, itemsCode []string, lookup lookupFunc) (map[string]items.Price, error) {
+	owned := map[string]*flightCall{}
+	joined := map[string]*flightCall{}
+	codes := []string{}
+
+	g.mu.Lock()
+	for _, i := range itemsCode {
+		if _, ok := owned[i]; ok {
+			continue
+		}
+		if c, ok := g.calls[i]; ok {
+			joined[i] = c
+			continue
+		}
+		c := &flightCall{done: make(chan struct{})}
+		g.calls[i] = c
+		owned[i] = c
+		codes = append(codes, i)
+	}
+	g.mu.Unlock()
+	atomic.AddUint64(&g.collapsed, uint64(len(joined)))
+
+	prices := map[string]items.Price{}
+	var err error
+	if len(codes) > 0 {
+		if prices, err = lookup(ctx, codes); prices == nil {
+			prices = map[string]items.Price{}
+		}
+
+		abandoned := err != nil && ctx.Err() != nil
+		g.mu.Lock()
+		for i, c := range owned {
+			c.price, c.found = prices[i]
+			c.err, c.abandoned = err, abandoned
+			delete(g.calls, i)
+			close(c.done)
+		}
+		g.mu.Unlock()
+	}
+
+	retry := []string{}
+	for i, c := range joined {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return prices, ctx.Err()
+		}
+		if c.abandoned {
+			retry = append(retry, i)
+			continue
+		}
+		if c.err != nil && err == nil {
+			err = c.err
+		}
+		if c.found {
+			prices[i] = c.price
+		}
+	}
+
+	if len(retry) > 0 {
+		retried, retryErr := g.do(ctx, retry, lookup)
+		for i, p := range retried {
+			prices[i] = p
+		}
+		if retryErr != nil && err == nil {
+			err = retryErr
+		}
+	}
+	return prices, err
+}
+
+// collapsedCalls returns how many item lookups were served by another caller lookup
+func (g *flightGroup) collapsedCalls() uint64 {
+	return atomic.LoadUint64(&g.collapsed)
+}
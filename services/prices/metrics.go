@@ -0,0 +1,10 @@
+package prices
+
+import "github.com/ldegaetano/go-ddd-example/metrics"
+
+var (
+	requestedItems = metrics.NewHistogram("prices_requested_items",
+		"Items requested per call to GetPricesFor", []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000})
+	pricesCalls = metrics.NewCounter("prices_calls_total",
+		"Calls to GetPricesFor by cache status, HIT, MISS or STALE", "cache_status")
+)
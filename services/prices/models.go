@@ -1,28 +1,167 @@
 package prices
 
-import "github.com/ldegaetano/go-ddd-example/errors"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/errors"
+	"github.com/ldegaetano/go-ddd-example/logging"
+)
 
 type (
 	// Service implements a transparent cache for returning prices
 	Service interface {
-		GetPricesFor(itemCode ...string) (map[string]float64, *errors.CustomError)
-		SetPriceFor(itemCode string, price float64) *errors.CustomError
+		GetPricesFor(ctx context.Context, currency money.Currency, itemCode ...string) (map[string]items.Price, CacheStatus, *errors.CustomError)
+		GetPricesAt(ctx context.Context, asOf time.Time, currency money.Currency, itemCode ...string) (map[string]items.Price, *errors.CustomError)
+		GetPriceHistory(ctx context.Context, itemCode string) ([]items.PriceRecord, *errors.CustomError)
+		SetPriceFor(ctx context.Context, itemCode string, price items.Price, actor string) *errors.CustomError
+		SetPricesFor(ctx context.Context, changes []items.PriceChange, actor string) []*errors.CustomError
+		SchedulePriceFor(ctx context.Context, itemCode string, price items.Price, window items.Window, actor string) *errors.CustomError
+		DeletePricesFor(ctx context.Context, itemsCode []string, actor string) *errors.CustomError
+		SetRate(ctx context.Context, rate money.ExchangeRate) *errors.CustomError
+		WarmUp(ctx context.Context, itemsCode []string) (<-chan struct{}, *errors.CustomError)
+		WarmUpProgress() WarmUpProgress
+		Stats() Stats
+	}
+
+	// Stats are counters of the service work
+	Stats struct {
+		// CollapsedCalls is how many item lookups were served by a storage call
+		// already in flight for the same item instead of doing their own
+		CollapsedCalls uint64
+	}
+
+	// WarmUpProgress tells how far the last cache warm-up went
+	WarmUpProgress struct {
+		Running bool
+		// Batches is how many batches of items were warmed up, Failed of them could not be read from the storage
+		// or not every price of them could be cached
+		Batches int
+		Failed  int
+		// Cached is how many prices were written to the cache
+		Cached     int
+		StartedAt  time.Time
+		FinishedAt time.Time
 	}
 
 	cacheRepository interface {
-		GetPricesFor(itemsCode []string) (map[string]float64, error)
-		SetPricesFor(prices map[string]float64) error
+		GetPricesFor(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, []string, error)
+		SetPricesFor(ctx context.Context, prices map[string]items.Price) error
+		SetConversionsFor(ctx context.Context, currency money.Currency, prices map[string]items.Price) error
+		DeletePricesFor(ctx context.Context, itemsCode []string) error
+		DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error
+		GetMissingFor(ctx context.Context, itemsCode []string) ([]string, error)
+		SetMissingFor(ctx context.Context, itemsCode []string) error
+		InvalidateFor(ctx context.Context, itemsCode []string) error
 	}
 
 	storageRepository interface {
-		GetPricesFor(itemsCode []string) (map[string]float64, error)
-		SetPriceFor(itemCode string, price float64) error
+		GetPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, error)
+		SetPriceFor(ctx context.Context, itemCode string, price items.Price, actor string) error
+		SetPricesFor(ctx context.Context, changes []items.PriceChange, actor string) error
+		SchedulePriceFor(ctx context.Context, itemCode string, price items.Price, window items.Window, actor string) error
+		DeletePricesFor(ctx context.Context, itemsCode []string, actor string) ([]string, error)
+		GetPricesAt(ctx context.Context, itemsCode []string, asOf time.Time) (map[string]items.Price, error)
+		GetPriceHistory(ctx context.Context, itemCode string) ([]items.PriceRecord, error)
+		GetRatesFor(ctx context.Context, to money.Currency, from []money.Currency) (map[money.Currency]money.ExchangeRate, error)
+		SetRate(ctx context.Context, rate money.ExchangeRate) error
+		GetItemCodes(ctx context.Context, after string, limit int) ([]string, error)
 	}
 
 	// Service is a service that allow interact with items
 	// Implements a transparent cache for returning prices
 	service struct {
-		storage storageRepository
-		cache   cacheRepository
+		storage   storageRepository
+		cache     cacheRepository
+		batchSize int
+		flights   *flightGroup
+		// refreshes holds a token for each background refresh running
+		refreshes chan struct{}
+
+		warmUpBatchSize int
+		// warmUpInterval is the least time between the start of two warm-up batches
+		warmUpInterval time.Duration
+		warmUpMu       sync.Mutex
+		warmUpProgress WarmUpProgress
+
+		logger *logging.Logger
+
+		// stopping is closed by Close, it cancels the work running in the background, tracked by tasks
+		closeMu  sync.Mutex
+		closed   bool
+		stopping chan struct{}
+		tasks    sync.WaitGroup
 	}
+
+	// CacheStatus tells where the prices returned by the service come from
+	CacheStatus string
+
+	// partialWriteError is a cache write error telling which items could not be cached,
+	// on other errors none of them is taken as cached
+	partialWriteError interface {
+		error
+		FailedItems() []string
+	}
+
+	// Option customizes the service built by NewService
+	Option func(*service)
+
+	// detachedContext has the values of the context it wraps but is only done once the service is closed,
+	// for the work that goes on after the request it was started by
+	detachedContext struct {
+		context.Context
+		stop <-chan struct{}
+	}
+)
+
+const (
+	// CacheHit means every price was fresh in the cache
+	CacheHit CacheStatus = "HIT"
+	// CacheMiss means some prices were read from the storage
+	CacheMiss CacheStatus = "MISS"
+	// CacheStale means some prices are stale, they are being refreshed in the background
+	CacheStale CacheStatus = "STALE"
 )
+
+const (
+	defaultRefreshConcurrency = 4
+	defaultWarmUpBatchSize    = 500
+	defaultWarmUpInterval     = 100 * time.Millisecond
+	loggerName                = "prices"
+)
+
+// merge returns the status of prices read partly with each status, a stale price outweighs a storage read
+func (cs CacheStatus) merge(other CacheStatus) CacheStatus {
+	if cs == CacheStale || other == CacheStale {
+		return CacheStale
+	}
+	if cs == CacheMiss || other == CacheMiss {
+		return CacheMiss
+	}
+	return CacheHit
+}
+
+// detach returns a context with the values of ctx that is not cancelled along with it but when the service is closed
+func (s *service) detach(ctx context.Context) context.Context {
+	return detachedContext{Context: ctx, stop: s.stopping}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (dc detachedContext) Done() <-chan struct{} {
+	return dc.stop
+}
+
+func (dc detachedContext) Err() error {
+	select {
+	case <-dc.stop:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
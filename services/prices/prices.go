@@ -1,41 +1,320 @@
 package prices
 
-import "github.com/ldegaetano/go-ddd-example/errors"
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
+	"github.com/ldegaetano/go-ddd-example/errors"
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/tracing"
+)
 
 // NewService return a items service for consult prices
-func NewService(storage storageRepository, cache cacheRepository) Service {
-	return &service{
-		storage: storage,
-		cache:   cache,
+func NewService(storage storageRepository, cache cacheRepository, options ...Option) Service {
+	s := &service{
+		storage:   storage,
+		cache:     cache,
+		flights:   newFlightGroup(),
+		refreshes: make(chan struct{}, defaultRefreshConcurrency),
+
+		warmUpBatchSize: defaultWarmUpBatchSize,
+		warmUpInterval:  defaultWarmUpInterval,
+
+		stopping: make(chan struct{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// WithRefreshConcurrency sets how many stale prices refreshes can run at once in the background
+func WithRefreshConcurrency(concurrency int) Option {
+	return func(s *service) {
+		if concurrency > 0 {
+			s.refreshes = make(chan struct{}, concurrency)
+		}
+	}
+}
+
+// WithBatchSize sets how many changes of a batch are written to the storage at once, 0 writes them all at once
+func WithBatchSize(size int) Option {
+	return func(s *service) {
+		s.batchSize = size
+	}
+}
+
+// WithWarmUp sets how many items a cache warm-up reads from the storage at once and the least time
+// between the start of two batches, which bounds the load it puts on the storage
+func WithWarmUp(batchSize int, interval time.Duration) Option {
+	return func(s *service) {
+		if batchSize > 0 {
+			s.warmUpBatchSize = batchSize
+		}
+		s.warmUpInterval = interval
+	}
+}
+
+// WithLogger sets the logger of the service, named after it. Without it the service logs nothing.
+func WithLogger(logger *logging.Logger) Option {
+	return func(s *service) {
+		s.logger = logger.Named(loggerName)
 	}
 }
 
-// GetPriceFor gets the price for the item, either from the cache or the actual service if it was not cached or too old
-func (s *service) GetPricesFor(itemsCode ...string) (map[string]float64, *errors.CustomError) {
-	storagePrices := map[string]float64{}
+// GetPriceFor gets the price for the item, either from the cache or the actual service if it was not cached or too old.
+// Stale cached prices are returned right away and refreshed in the background.
+// When a currency is given prices are converted into it, otherwise they are returned in the item own currency.
+func (s *service) GetPricesFor(ctx context.Context, currency money.Currency, itemsCode ...string) (map[string]items.Price, CacheStatus, *errors.CustomError) {
+	ctx, span := tracing.Start(ctx, "prices.GetPricesFor", tracing.Int("items.count", len(itemsCode)))
+	defer span.End()
 
-	cachePrices, err := s.cache.GetPricesFor(itemsCode)
+	requestedItems.Observe(float64(len(itemsCode)))
+	prices, status, err := s.getPricesIn(ctx, currency, itemsCode)
+	if status != "" {
+		pricesCalls.Inc(string(status))
+		span.SetAttributes(tracing.String("cache.status", string(status)))
+	}
+	if err != nil {
+		span.RecordError(err)
+		return prices, status, err
+	}
+
+	if missingItems := getMissingItems(itemsCode, prices); len(missingItems) > 0 {
+		span.SetAttributes(tracing.Strings("items.missing", missingItems))
+		return prices, status, errors.NotFoundItems.WithParams(missingItems)
+	}
+
+	return prices, status, nil
+}
+
+// GetPricesAt gets the prices the items had at the given moment, straight from the storage history.
+// Conversions use the current exchange rates.
+func (s *service) GetPricesAt(ctx context.Context, asOf time.Time, currency money.Currency, itemsCode ...string) (map[string]items.Price, *errors.CustomError) {
+	prices, err := s.storage.GetPricesAt(ctx, itemsCode, asOf)
+	if err != nil {
+		return prices, errors.InternalError
+	}
+
+	if currency != "" {
+		var customErr *errors.CustomError
+		if prices, customErr = s.convert(ctx, currency, prices); customErr != nil {
+			return prices, customErr
+		}
+	}
+
+	if missingItems := getMissingItems(itemsCode, prices); len(missingItems) > 0 {
+		return prices, errors.NotFoundItems.WithParams(missingItems)
+	}
+
+	return prices, nil
+}
+
+// GetPriceHistory gets every price the item had, newest first
+func (s *service) GetPriceHistory(ctx context.Context, itemCode string) ([]items.PriceRecord, *errors.CustomError) {
+	history, err := s.storage.GetPriceHistory(ctx, itemCode)
+	if err != nil {
+		return history, errors.InternalError
+	}
+
+	if len(history) == 0 {
+		return history, errors.NotFoundItems.WithParams([]string{itemCode})
+	}
+
+	return history, nil
+}
+
+// getPrices returns the items own prices from the cache, filling the missing ones from the storage
+func (s *service) getPrices(ctx context.Context, itemsCode []string) (map[string]items.Price, CacheStatus, *errors.CustomError) {
+	storagePrices := map[string]items.Price{}
+
+	cachePrices, stale, err := s.cache.GetPricesFor(ctx, "", itemsCode)
+	status := s.revalidate(ctx, stale)
 	if err == nil {
-		return cachePrices, nil
+		return cachePrices, status, nil
 	}
 
-	if missingItems := getMissingItems(itemsCode, cachePrices); len(missingItems) > 0 {
-		storagePrices, err = s.storage.GetPricesFor(missingItems)
+	if missingItems := s.getUnknownItems(ctx, getMissingItems(itemsCode, cachePrices)); len(missingItems) > 0 {
+		storagePrices, err = s.flights.do(ctx, missingItems, s.loadPrices)
 		if err != nil {
-			return storagePrices, errors.InternalError
+			return storagePrices, status, errors.InternalError
 		}
-		s.cache.SetPricesFor(storagePrices)
+		status = status.merge(CacheMiss)
+	}
+
+	return getItemsUnion(cachePrices, storagePrices), status, nil
+}
+
+// getUnknownItems leaves out of the items not found in the cache the ones known to have no price
+func (s *service) getUnknownItems(ctx context.Context, itemsCode []string) []string {
+	if len(itemsCode) == 0 {
+		return itemsCode
+	}
+	known, err := s.cache.GetMissingFor(ctx, itemsCode)
+	if err != nil || len(known) == 0 {
+		return itemsCode
+	}
+
+	isKnown := map[string]bool{}
+	for _, i := range known {
+		isKnown[i] = true
+	}
+	unknown := []string{}
+	for _, i := range itemsCode {
+		if !isKnown[i] {
+			unknown = append(unknown, i)
+		}
+	}
+	return unknown
+}
+
+// loadPrices reads the prices from the storage and caches them, along with the items that have no price.
+// Concurrent cache misses of the same items share a single call through s.flights.
+// Prices that could not be cached are returned all the same.
+func (s *service) loadPrices(ctx context.Context, itemsCode []string) (map[string]items.Price, error) {
+	prices, err := s.storage.GetPricesFor(ctx, itemsCode)
+	if err != nil {
+		return prices, err
 	}
+	s.cachePrices(ctx, itemsCode, prices)
+	return prices, nil
+}
 
-	storagePrices = getItemsUnion(cachePrices, storagePrices)
-	if missingItems := getMissingItems(itemsCode, storagePrices); len(missingItems) > 0 {
-		return storagePrices, errors.NotFoundItems.WithParams(missingItems)
+// cachePrices caches the prices read for the items along with the items that have no price,
+// it returns the error of caching the prices
+func (s *service) cachePrices(ctx context.Context, itemsCode []string, prices map[string]items.Price) error {
+	err := s.cache.SetPricesFor(ctx, prices)
+	if missingItems := getMissingItems(itemsCode, prices); len(missingItems) > 0 {
+		s.cache.SetMissingFor(ctx, missingItems)
 	}
+	return err
+}
 
-	return storagePrices, nil
+// getPricesIn returns the prices converted into currency from the cache, converting the missing ones
+func (s *service) getPricesIn(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, CacheStatus, *errors.CustomError) {
+	if currency == "" {
+		return s.getPrices(ctx, itemsCode)
+	}
+
+	convertedPrices := map[string]items.Price{}
+
+	cachePrices, stale, err := s.cache.GetPricesFor(ctx, currency, itemsCode)
+	status := s.revalidate(ctx, stale)
+	if err == nil {
+		return cachePrices, status, nil
+	}
+
+	if missingItems := getMissingItems(itemsCode, cachePrices); len(missingItems) > 0 {
+		prices, pricesStatus, customErr := s.getPrices(ctx, missingItems)
+		status = status.merge(pricesStatus)
+		if customErr != nil {
+			return prices, status, customErr
+		}
+		convertedPrices, customErr = s.convert(ctx, currency, prices)
+		if customErr != nil {
+			return convertedPrices, status, customErr
+		}
+		s.cache.SetConversionsFor(ctx, currency, convertedPrices)
+	}
+
+	return getItemsUnion(cachePrices, convertedPrices), status, nil
 }
 
-func getMissingItems(itemsCode []string, prices map[string]float64) []string {
+// revalidate refreshes the stale prices in the background and returns the status of the cached prices.
+// When as many refreshes as allowed are already running the prices stay stale until a later read.
+// Refreshes outlive the request, they are not cancelled along with ctx.
+func (s *service) revalidate(ctx context.Context, stale []string) CacheStatus {
+	if len(stale) == 0 {
+		return CacheHit
+	}
+
+	select {
+	case s.refreshes <- struct{}{}:
+		started := s.background(func() {
+			defer func() { <-s.refreshes }()
+			s.flights.do(s.detach(ctx), stale, s.loadPrices)
+		})
+		if !started {
+			<-s.refreshes
+		}
+	default:
+	}
+	return CacheStale
+}
+
+// background runs f in a goroutine Close waits for, it tells false without running f once the service is closed
+func (s *service) background(f func()) bool {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		f()
+	}()
+	return true
+}
+
+// Close cancels the refreshes and the warm-up running in the background and waits for them to stop,
+// so the storage and the cache can be closed once it returns
+func (s *service) Close() error {
+	s.closeMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stopping)
+	}
+	s.closeMu.Unlock()
+	s.tasks.Wait()
+	return nil
+}
+
+func (s *service) convert(ctx context.Context, currency money.Currency, prices map[string]items.Price) (map[string]items.Price, *errors.CustomError) {
+	converted := map[string]items.Price{}
+
+	rates, err := s.storage.GetRatesFor(ctx, currency, getSourceCurrencies(currency, prices))
+	if err != nil {
+		return converted, errors.InternalError
+	}
+
+	missingRates := []string{}
+	for itemCode, price := range prices {
+		if price.Currency == currency {
+			converted[itemCode] = price
+			continue
+		}
+		rate, ok := rates[price.Currency]
+		if !ok {
+			missingRates = append(missingRates, price.Currency.String()+"-"+currency.String())
+			continue
+		}
+		converted[itemCode] = price.ConvertWith(rate)
+	}
+
+	if len(missingRates) > 0 {
+		sort.Strings(missingRates)
+		return converted, errors.RateNotFound.WithParams(missingRates)
+	}
+	return converted, nil
+}
+
+func getSourceCurrencies(currency money.Currency, prices map[string]items.Price) []money.Currency {
+	seen := map[money.Currency]bool{}
+	sources := []money.Currency{}
+	for _, p := range prices {
+		if p.Currency != currency && !seen[p.Currency] {
+			seen[p.Currency] = true
+			sources = append(sources, p.Currency)
+		}
+	}
+	return sources
+}
+
+func getMissingItems(itemsCode []string, prices map[string]items.Price) []string {
 	missingItems := []string{}
 	for _, item := range itemsCode {
 		if _, ok := prices[item]; !ok {
@@ -45,22 +324,132 @@ func getMissingItems(itemsCode []string, prices map[string]float64) []string {
 	return missingItems
 }
 
-func getItemsUnion(cache, storage map[string]float64) map[string]float64 {
+func getItemsUnion(cache, storage map[string]items.Price) map[string]items.Price {
 	for k, v := range cache {
 		storage[k] = v
 	}
 	return storage
 }
 
-func (s *service) SetPriceFor(itemCode string, price float64) *errors.CustomError {
+func (s *service) SetPriceFor(ctx context.Context, itemCode string, price items.Price, actor string) *errors.CustomError {
+
+	if err := s.storage.SetPriceFor(ctx, itemCode, price, actor); err != nil {
+		return errors.InternalError
+	}
+
+	s.refreshCache(s.detach(ctx), itemCode)
+
+	return nil
+}
+
+// SetPricesFor applies a batch of price changes in chunks of batchSize, each chunk is written atomically.
+// It returns the error of each change, in the same order, nil for the ones that were written.
+func (s *service) SetPricesFor(ctx context.Context, changes []items.PriceChange, actor string) []*errors.CustomError {
+	results := make([]*errors.CustomError, len(changes))
+	written := []string{}
+
+	size := s.batchSize
+	if size <= 0 {
+		size = len(changes)
+	}
+	for start := 0; start < len(changes); start += size {
+		end := start + size
+		if end > len(changes) {
+			end = len(changes)
+		}
+		if err := s.storage.SetPricesFor(ctx, changes[start:end], actor); err != nil {
+			for k := start; k < end; k++ {
+				results[k] = errors.InternalError
+			}
+			continue
+		}
+		for _, change := range changes[start:end] {
+			written = append(written, change.ItemCode)
+		}
+	}
+
+	if len(written) > 0 {
+		s.refreshCache(s.detach(ctx), written...)
+	}
+
+	return results
+}
+
+// SchedulePriceFor sets a price that is only effective for the item during the window
+func (s *service) SchedulePriceFor(ctx context.Context, itemCode string, price items.Price, window items.Window, actor string) *errors.CustomError {
+
+	if err := s.storage.SchedulePriceFor(ctx, itemCode, price, window, actor); err != nil {
+		return errors.InternalError
+	}
+
+	s.refreshCache(s.detach(ctx), itemCode)
+
+	return nil
+}
 
-	if err := s.storage.SetPriceFor(itemCode, price); err != nil {
+// DeletePricesFor removes the items prices, scheduled ones included, and drops them from the cache.
+// It fails with NotFoundItems only when none of the items had a price.
+func (s *service) DeletePricesFor(ctx context.Context, itemsCode []string, actor string) *errors.CustomError {
+	deleted, err := s.storage.DeletePricesFor(ctx, itemsCode, actor)
+	if err != nil {
 		return errors.InternalError
 	}
 
-	s.cache.SetPricesFor(map[string]float64{
-		itemCode: price,
-	})
+	// every requested key is dropped, not only the deleted ones, so a retry after
+	// a cache failure still clears prices whose storage delete already succeeded.
+	// Once deleted from the storage they are dropped even if the request is cancelled.
+	// The delete is stored already, a cache that can not be reached does not fail it:
+	// the circuit breaker drops the items once the cache is reachable again.
+	ctx = s.detach(ctx)
+	if err := s.cache.DeletePricesFor(ctx, itemsCode); err != nil {
+		s.logger.Warn(ctx, "delete_cache", logging.Err(err), logging.F("items", itemsCode))
+	}
+	s.cache.InvalidateFor(ctx, itemsCode)
+
+	if len(deleted) == 0 {
+		return errors.NotFoundItems.WithParams(itemsCode)
+	}
 
 	return nil
 }
+
+// refreshCache caches the prices the items have now, which after a change is not always
+// the price that was set because a scheduled price may be overriding it.
+// Items that still have no price are dropped from the cache so they are not known as missing anymore.
+// Other instances are told to drop the items from their local caches.
+// It runs once the change is stored, so ctx should not be cancelled along with the request.
+func (s *service) refreshCache(ctx context.Context, itemsCode ...string) {
+	defer s.cache.InvalidateFor(ctx, itemsCode)
+
+	prices, err := s.storage.GetPricesFor(ctx, itemsCode)
+	if err != nil {
+		s.logger.Warn(ctx, "refresh_cache", logging.Err(err), logging.F("items", itemsCode))
+		s.cache.DeletePricesFor(ctx, itemsCode)
+		return
+	}
+	s.cache.SetPricesFor(ctx, prices)
+	if missingItems := getMissingItems(itemsCode, prices); len(missingItems) > 0 {
+		s.cache.DeletePricesFor(ctx, missingItems)
+	}
+}
+
+// Stats returns the service counters
+func (s *service) Stats() Stats {
+	return Stats{CollapsedCalls: s.flights.collapsedCalls()}
+}
+
+// SetRate stores the exchange rate and drops from the cache the prices converted with the previous one
+func (s *service) SetRate(ctx context.Context, rate money.ExchangeRate) *errors.CustomError {
+	if err := s.storage.SetRate(ctx, rate); err != nil {
+		return errors.InternalError
+	}
+
+	// the rate is stored already, a cache that can not be reached does not fail it:
+	// the circuit breaker drops the conversions once the cache is reachable again
+	ctx = s.detach(ctx)
+	if err := s.cache.DeleteConversionsFor(ctx, rate.From, rate.To); err != nil {
+		s.logger.Warn(ctx, "delete_conversions_cache", logging.Err(err),
+			logging.F("from", rate.From), logging.F("to", rate.To))
+	}
+	return nil
+}
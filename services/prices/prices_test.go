@@ -1,41 +1,67 @@
 package prices
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/domain/money"
 )
 
-// mockResult has the float64 and err to return
+// mockResult has the price and err to return
 type mockResult struct {
-	price      float64
+	price      money.Amount
 	err        error
-	expiration time.Time
+	currency   money.Currency // currency of the price, money.DefaultCurrency when empty
+	validUntil time.Time
 }
 
 type mockStorage struct {
+	mu          sync.Mutex
 	numCalls    int
 	mockResults map[string]mockResult // what price and err to return for a particular itemCode
+	rates       []money.ExchangeRate  // exchange rates known by the storage
+	history     []mockRecord          // price history, in insertion order
 	callDelay   time.Duration         // how long to sleep on each call so that we can simulate calls to be expensive
 }
 
-func (m *mockStorage) GetPricesFor(itemsCode []string) (map[string]float64, error) {
+type mockRecord struct {
+	itemCode string
+	record   items.PriceRecord
+}
+
+func (m *mockStorage) GetPricesFor(ctx context.Context, itemsCode []string) (map[string]items.Price, error) {
 
-	m.numCalls++            // increase the number of calls
-	time.Sleep(m.callDelay) // sleep to simulate expensive call
+	m.mu.Lock()
+	m.numCalls++ // increase the number of calls
+	m.mu.Unlock()
+	select {
+	case <-time.After(m.callDelay): // sleep to simulate expensive call
+	case <-ctx.Done():
+		return map[string]items.Price{}, ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	result := map[string]float64{}
+	result := map[string]items.Price{}
 	var resultErr error
 	for _, i := range itemsCode {
 		p, ok := m.mockResults[i]
 		if !ok {
-			return result, nil
+			continue
 		}
-		result[i] = p.price
+		currency := p.currency
+		if currency == "" {
+			currency = money.DefaultCurrency
+		}
+		result[i] = items.Price{Amount: p.price, Currency: currency, ValidUntil: p.validUntil}
 		if p.err != nil {
 			resultErr = p.err
 		}
@@ -44,74 +70,324 @@ func (m *mockStorage) GetPricesFor(itemsCode []string) (map[string]float64, erro
 }
 
 func (m *mockStorage) getNumCalls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.numCalls
 }
 
-func (m *mockStorage) SetPriceFor(itemCode string, price float64) error {
+func (m *mockStorage) SetPriceFor(ctx context.Context, itemCode string, price items.Price, actor string) error {
 
 	m.numCalls++ // increase the number of calls
 	if m.mockResults[itemCode].err != nil {
 		return m.mockResults[itemCode].err
 	}
+	if m.mockResults == nil {
+		m.mockResults = make(map[string]mockResult)
+	}
+	m.mockResults[itemCode] = mockResult{price: price.Amount, currency: price.Currency}
+	m.history = append(m.history, mockRecord{itemCode, items.PriceRecord{Price: price, EffectiveAt: time.Now(), Actor: actor}})
+	return nil
+}
+
+func (m *mockStorage) SetPricesFor(ctx context.Context, changes []items.PriceChange, actor string) error {
+
+	m.numCalls++ // increase the number of calls
+	for _, c := range changes {
+		if m.mockResults[c.ItemCode].err != nil {
+			return m.mockResults[c.ItemCode].err
+		}
+	}
+	for _, c := range changes {
+		m.mockResults[c.ItemCode] = mockResult{price: c.Price.Amount, currency: c.Price.Currency}
+	}
+	return nil
+}
+
+func (m *mockStorage) SchedulePriceFor(ctx context.Context, itemCode string, price items.Price, window items.Window, actor string) error {
+
+	m.numCalls++ // increase the number of calls
+	if window.Contains(time.Now()) {
+		m.mockResults[itemCode] = mockResult{price: price.Amount, currency: price.Currency, validUntil: window.To}
+	}
+	return nil
+}
+
+func (m *mockStorage) DeletePricesFor(ctx context.Context, itemsCode []string, actor string) ([]string, error) {
+
+	m.numCalls++ // increase the number of calls
+	deleted := []string{}
+	for _, i := range itemsCode {
+		if _, ok := m.mockResults[i]; ok {
+			delete(m.mockResults, i)
+			deleted = append(deleted, i)
+			m.history = append(m.history, mockRecord{i, items.PriceRecord{EffectiveAt: time.Now(), Actor: actor, Deleted: true}})
+		}
+	}
+	return deleted, nil
+}
+
+func (m *mockStorage) GetPricesAt(ctx context.Context, itemsCode []string, asOf time.Time) (map[string]items.Price, error) {
+
+	m.numCalls++ // increase the number of calls
+
+	result := map[string]items.Price{}
+	for _, i := range itemsCode {
+		for _, h := range m.history {
+			if h.itemCode == i && !h.record.EffectiveAt.After(asOf) {
+				result[i] = h.record.Price
+			}
+		}
+	}
+	return result, nil
+}
+
+func (m *mockStorage) GetPriceHistory(ctx context.Context, itemCode string) ([]items.PriceRecord, error) {
+
+	m.numCalls++ // increase the number of calls
+
+	result := []items.PriceRecord{}
+	for k := len(m.history) - 1; k >= 0; k-- {
+		if m.history[k].itemCode == itemCode {
+			result = append(result, m.history[k].record)
+		}
+	}
+	return result, nil
+}
+
+func (m *mockStorage) GetRatesFor(ctx context.Context, to money.Currency, from []money.Currency) (map[money.Currency]money.ExchangeRate, error) {
+	result := map[money.Currency]money.ExchangeRate{}
+	for _, r := range m.rates {
+		for _, f := range from {
+			if r.From == f && r.To == to {
+				result[f] = r
+			}
+		}
+	}
+	return result, nil
+}
+
+func (m *mockStorage) SetRate(ctx context.Context, rate money.ExchangeRate) error {
+	m.rates = append(m.rates, rate)
 	return nil
 }
 
+func (m *mockStorage) GetItemCodes(ctx context.Context, after string, limit int) ([]string, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := []string{}
+	for i := range m.mockResults {
+		if i > after {
+			codes = append(codes, i)
+		}
+	}
+	sort.Strings(codes)
+	if len(codes) > limit {
+		codes = codes[:limit]
+	}
+	return codes, nil
+}
+
+// cacheEntry is a price cached for an item in a currency, stale from staleAt until expiration
+type cacheEntry struct {
+	price      items.Price
+	staleAt    time.Time
+	expiration time.Time
+}
+
 type mockCache struct {
-	numCalls int
-	maxAge   time.Duration
-	prices   map[string]mockResult // what price and err to return for a particular itemCode
+	mu         sync.Mutex
+	numCalls   int
+	maxAge     time.Duration
+	staleAge   time.Duration                            // how long prices are kept stale after maxAge
+	missingAge time.Duration                            // how long items are known to have no price
+	prices     map[string]map[money.Currency]cacheEntry // cached prices by itemCode and currency
+	missing    map[string]time.Time                     // expiration of the items known to have no price
+	published  [][]string                               // items of each invalidation published
+	setErr     error                                    // error of writing prices, none of them is cached
+	failed     []string                                 // items whose price can not be cached
+	deleteErr  error                                    // error of dropping prices, none of them is dropped
+}
+
+// partialError tells which items could not be cached
+type partialError struct {
+	items []string
+}
+
+func (e partialError) Error() string {
+	return "Set cache error"
+}
+
+func (e partialError) FailedItems() []string {
+	return e.items
 }
 
-func (m *mockCache) GetPricesFor(itemsCode []string) (map[string]float64, error) {
+func (m *mockCache) GetPricesFor(ctx context.Context, currency money.Currency, itemsCode []string) (map[string]items.Price, []string, error) {
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.numCalls++ // increase the number of calls
 
-	result := map[string]float64{}
+	result := map[string]items.Price{}
+	stale := []string{}
 	var resultErr error
+	now := time.Now()
 	for _, i := range itemsCode {
-		p, ok := m.prices[i]
-		if ok && p.expiration.After(time.Now()) {
+		p, ok := m.prices[i][currency]
+		if ok && p.expiration.After(now) {
 			result[i] = p.price
-			resultErr = p.err
+			if !p.staleAt.After(now) {
+				stale = append(stale, i)
+			}
 		} else {
 			resultErr = errors.New("not found in cache")
 		}
 	}
-	return result, resultErr
+	return result, stale, resultErr
 }
 
-func (m *mockCache) SetPricesFor(prices map[string]float64) error {
+func (m *mockCache) SetPricesFor(ctx context.Context, prices map[string]items.Price) error {
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.numCalls++ // increase the number of calls
+	if m.setErr != nil {
+		return m.setErr
+	}
 	if m.prices == nil {
-		m.prices = make(map[string]mockResult)
+		m.prices = make(map[string]map[money.Currency]cacheEntry)
+	}
+	failed := map[string]bool{}
+	for _, i := range m.failed {
+		failed[i] = true
 	}
+	notCached := []string{}
 	for k, p := range prices {
-		m.prices[k] = mockResult{p, nil, time.Now().Add(m.maxAge)}
+		if failed[k] {
+			notCached = append(notCached, k)
+			continue
+		}
+		staleAt := time.Now().Add(m.maxAge)
+		expiration := staleAt.Add(m.staleAge)
+		if !p.ValidUntil.IsZero() && p.ValidUntil.Before(staleAt) {
+			staleAt = p.ValidUntil
+		}
+		if !p.ValidUntil.IsZero() && p.ValidUntil.Before(expiration) {
+			expiration = p.ValidUntil
+		}
+		m.prices[k] = map[money.Currency]cacheEntry{"": {p, staleAt, expiration}}
+		delete(m.missing, k)
+	}
+	if len(notCached) > 0 {
+		return partialError{notCached}
+	}
+	return nil
+}
+
+func (m *mockCache) SetConversionsFor(ctx context.Context, currency money.Currency, prices map[string]items.Price) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.numCalls++ // increase the number of calls
+	for k, p := range prices {
+		if raw, ok := m.prices[k][""]; ok {
+			m.prices[k][currency] = cacheEntry{p, raw.staleAt, raw.expiration}
+		}
 	}
 	return nil
 }
 
+func (m *mockCache) DeletePricesFor(ctx context.Context, itemsCode []string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.numCalls++ // increase the number of calls
+	if m.deleteErr != nil {
+		return m.deleteErr
+	}
+	for _, i := range itemsCode {
+		delete(m.prices, i)
+		delete(m.missing, i)
+	}
+	return nil
+}
+
+func (m *mockCache) DeleteConversionsFor(ctx context.Context, from money.Currency, to money.Currency) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.numCalls++ // increase the number of calls
+	for _, prices := range m.prices {
+		if p, ok := prices[to]; ok && p.price.Conversion != nil && p.price.Conversion.From == from {
+			delete(prices, to)
+		}
+	}
+	return nil
+}
+
+func (m *mockCache) GetMissingFor(ctx context.Context, itemsCode []string) ([]string, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.numCalls++ // increase the number of calls
+	result := []string{}
+	for _, i := range itemsCode {
+		if expiration, ok := m.missing[i]; ok && expiration.After(time.Now()) {
+			result = append(result, i)
+		}
+	}
+	return result, nil
+}
+
+func (m *mockCache) SetMissingFor(ctx context.Context, itemsCode []string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.numCalls++ // increase the number of calls
+	if m.missingAge <= 0 {
+		return nil
+	}
+	if m.missing == nil {
+		m.missing = make(map[string]time.Time)
+	}
+	for _, i := range itemsCode {
+		if _, ok := m.prices[i]; !ok {
+			m.missing[i] = time.Now().Add(m.missingAge)
+		}
+	}
+	return nil
+}
+
+func (m *mockCache) InvalidateFor(ctx context.Context, itemsCode []string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.published = append(m.published, itemsCode)
+	return nil
+}
+
 func (m *mockCache) getNumCalls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.numCalls
 }
 
-func getPriceWithNoErr(t *testing.T, service Service, itemCode string) float64 {
-	prices, err := service.GetPricesFor(itemCode)
+func getPriceWithNoErr(t *testing.T, service Service, itemCode string) money.Amount {
+	prices, _, err := service.GetPricesFor(context.Background(), "", itemCode)
 	if err != nil {
 		t.Error("error getting prices for", itemCode)
 	}
-	return prices[itemCode]
+	return prices[itemCode].Amount
 }
 
-func getPricesWithNoErr(t *testing.T, service Service, itemCodes ...string) []float64 {
-	prices, err := service.GetPricesFor(itemCodes...)
+func getPricesWithNoErr(t *testing.T, service Service, itemCodes ...string) []money.Amount {
+	prices, _, err := service.GetPricesFor(context.Background(), "", itemCodes...)
 	if err != nil {
 		t.Error("error getting prices for", itemCodes)
 	}
-	result := []float64{}
+	result := []money.Amount{}
 	for _, p := range prices {
-		result = append(result, p)
+		result = append(result, p.Amount)
 	}
 	return result
 }
@@ -122,7 +398,7 @@ func assertInt(t *testing.T, expected int, actual int, msg string) {
 	}
 }
 
-func assertFloat(t *testing.T, expected float64, actual float64, msg string) {
+func assertAmount(t *testing.T, expected money.Amount, actual money.Amount, msg string) {
 	if expected != actual {
 		t.Error(msg, fmt.Sprintf("expected : %v, got : %v", expected, actual))
 	}
@@ -134,13 +410,13 @@ func assertErr(t *testing.T, err error) {
 	}
 }
 
-func assertFloats(t *testing.T, expected []float64, actual []float64, msg string) {
+func assertAmounts(t *testing.T, expected []money.Amount, actual []money.Amount, msg string) {
 	if len(expected) != len(actual) {
 		t.Error(msg, fmt.Sprintf("expected : %v, got : %v", expected, actual))
 		return
 	}
-	sort.Float64s(expected)
-	sort.Float64s(actual)
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	sort.Slice(actual, func(i, j int) bool { return actual[i] < actual[j] })
 	for i, expectedValue := range expected {
 		if expectedValue != actual[i] {
 			t.Error(msg, fmt.Sprintf("expected : %v, got : %v", expected, actual))
@@ -153,7 +429,7 @@ func assertFloats(t *testing.T, expected []float64, actual []float64, msg string
 func TestGetPriceFor_CachesResults(t *testing.T) {
 	mockStorage := &mockStorage{
 		mockResults: map[string]mockResult{
-			"p1": {price: 5, err: nil},
+			"p1": {price: money.MustParse("5"), err: nil},
 		},
 	}
 	mockCache := &mockCache{
@@ -161,9 +437,9 @@ func TestGetPriceFor_CachesResults(t *testing.T) {
 	}
 	service := NewService(mockStorage, mockCache)
 
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
 	assertInt(t, 1, mockStorage.getNumCalls(), "wrong number of service calls")
 }
 
@@ -171,12 +447,12 @@ func TestGetPriceFor_CachesResults(t *testing.T) {
 func TestGetPriceFor_ReturnsErrorOnServiceError(t *testing.T) {
 	mockStorage := &mockStorage{
 		mockResults: map[string]mockResult{
-			"p1": {price: 0, err: fmt.Errorf("some error")},
+			"p1": {price: money.MustParse("0"), err: fmt.Errorf("some error")},
 		},
 	}
 	mockCache := &mockCache{}
 	service := NewService(mockStorage, mockCache)
-	_, err := service.GetPricesFor("p1")
+	_, _, err := service.GetPricesFor(context.Background(), "", "p1")
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
@@ -186,8 +462,8 @@ func TestGetPriceFor_ReturnsErrorOnServiceError(t *testing.T) {
 func TestGetPricesFor_GetsSeveralPricesAtOnceAndCachesThem(t *testing.T) {
 	mockStorage := &mockStorage{
 		mockResults: map[string]mockResult{
-			"p1": {price: 5, err: nil},
-			"p2": {price: 7, err: nil},
+			"p1": {price: money.MustParse("5"), err: nil},
+			"p2": {price: money.MustParse("7"), err: nil},
 		},
 	}
 	mockCache := &mockCache{
@@ -195,9 +471,9 @@ func TestGetPricesFor_GetsSeveralPricesAtOnceAndCachesThem(t *testing.T) {
 	}
 	service := NewService(mockStorage, mockCache)
 
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
-	assertFloats(t, []float64{5, 7}, getPricesWithNoErr(t, service, "p1", "p2"), "wrong price returned")
-	assertFloats(t, []float64{5, 7}, getPricesWithNoErr(t, service, "p1", "p2"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmounts(t, []money.Amount{money.MustParse("5"), money.MustParse("7")}, getPricesWithNoErr(t, service, "p1", "p2"), "wrong price returned")
+	assertAmounts(t, []money.Amount{money.MustParse("5"), money.MustParse("7")}, getPricesWithNoErr(t, service, "p1", "p2"), "wrong price returned")
 	assertInt(t, 2, mockStorage.getNumCalls(), "wrong number of service calls")
 }
 
@@ -205,8 +481,8 @@ func TestGetPricesFor_GetsSeveralPricesAtOnceAndCachesThem(t *testing.T) {
 func TestGetPriceFor_DoesNotReturnOldResults(t *testing.T) {
 	mockStorage := &mockStorage{
 		mockResults: map[string]mockResult{
-			"p1": {price: 5, err: nil},
-			"p2": {price: 7, err: nil},
+			"p1": {price: money.MustParse("5"), err: nil},
+			"p2": {price: money.MustParse("7"), err: nil},
 		},
 	}
 	mockCache := &mockCache{
@@ -216,23 +492,23 @@ func TestGetPriceFor_DoesNotReturnOldResults(t *testing.T) {
 	service := NewService(mockStorage, mockCache)
 
 	// get price for "p1" twice (one external service call)
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
 	assertInt(t, 1, mockStorage.getNumCalls(), "wrong number of service calls")
 	// sleep 0.7 the maxAge
 	time.Sleep(maxAge70Pct)
 	// get price for "p1" and "p2", only "p2" should be retrieved from the external service (one more external call)
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
-	assertFloat(t, 7, getPriceWithNoErr(t, service, "p2"), "wrong price returned")
-	assertFloat(t, 7, getPriceWithNoErr(t, service, "p2"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("7"), getPriceWithNoErr(t, service, "p2"), "wrong price returned")
+	assertAmount(t, money.MustParse("7"), getPriceWithNoErr(t, service, "p2"), "wrong price returned")
 	assertInt(t, 2, mockStorage.getNumCalls(), "wrong number of service calls")
 	// sleep 0.7 the maxAge
 	time.Sleep(maxAge70Pct)
 	// get price for "p1" and "p2", only "p1" should be retrieved from the cache ("p2" is still valid)
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
-	assertFloat(t, 5, getPriceWithNoErr(t, service, "p1"), "wrong price returned")
-	assertFloat(t, 7, getPriceWithNoErr(t, service, "p2"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertAmount(t, money.MustParse("7"), getPriceWithNoErr(t, service, "p2"), "wrong price returned")
 	assertInt(t, 3, mockStorage.getNumCalls(), "wrong number of service calls")
 }
 
@@ -241,15 +517,15 @@ func TestGetPricesFor_ParallelizeCalls(t *testing.T) {
 	mockStorage := &mockStorage{
 		callDelay: time.Second, // each call to external service takes one full second
 		mockResults: map[string]mockResult{
-			"p1": {price: 5, err: nil},
-			"p2": {price: 7, err: nil},
+			"p1": {price: money.MustParse("5"), err: nil},
+			"p2": {price: money.MustParse("7"), err: nil},
 		},
 	}
 	mockCache := &mockCache{}
 	cache := NewService(mockStorage, mockCache)
 
 	start := time.Now()
-	assertFloats(t, []float64{5, 7}, getPricesWithNoErr(t, cache, "p1", "p2"), "wrong price returned")
+	assertAmounts(t, []money.Amount{money.MustParse("5"), money.MustParse("7")}, getPricesWithNoErr(t, cache, "p1", "p2"), "wrong price returned")
 	elapsedTime := time.Since(start)
 	if elapsedTime > (1200 * time.Millisecond) {
 		t.Error("calls took too long, expected them to take a bit over one second")
@@ -261,14 +537,14 @@ func TestGetPricesFor_ParallelizeCallsWithError(t *testing.T) {
 	mockService := &mockStorage{
 		callDelay: time.Second,
 		mockResults: map[string]mockResult{
-			"p1": {price: 5, err: errors.New("Test error")},
-			"p2": {price: 7, err: nil},
+			"p1": {price: money.MustParse("5"), err: errors.New("Test error")},
+			"p2": {price: money.MustParse("7"), err: nil},
 		},
 	}
 	mockCache := &mockCache{}
 	cache := NewService(mockService, mockCache)
 	start := time.Now()
-	_, err := cache.GetPricesFor("p1", "p2")
+	_, _, err := cache.GetPricesFor(context.Background(), "", "p1", "p2")
 	assertErr(t, err)
 	elapsedTime := time.Since(start)
 	if elapsedTime > (1200 * time.Millisecond) {
@@ -280,30 +556,648 @@ func TestGetPricesFor_NotFound(t *testing.T) {
 	mockService := &mockStorage{}
 	mockCache := &mockCache{}
 	service := NewService(mockService, mockCache)
-	_, err := service.GetPricesFor("p1", "p2")
+	_, _, err := service.GetPricesFor(context.Background(), "", "p1", "p2")
 	assert.Equal(t, "Items not found: p1,p2.", err.Message)
 }
 
 func TestSetPricesFor_InsertPrice(t *testing.T) {
 	mockService := &mockStorage{
 		mockResults: map[string]mockResult{
-			"p2": {price: 7, err: nil},
+			"p2": {price: money.MustParse("7"), err: nil},
 		},
 	}
 	mockCache := &mockCache{}
 	service := NewService(mockService, mockCache)
-	err := service.SetPriceFor("p1", 10)
+	err := service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("10"), money.DefaultCurrency), "tester")
 	assert.Nil(t, err)
 }
 
 func TestSetPricesFor_InsertPriceErr(t *testing.T) {
 	mockService := &mockStorage{
 		mockResults: map[string]mockResult{
-			"p1": {price: 10, err: errors.New("Insert err")},
+			"p1": {price: money.MustParse("10"), err: errors.New("Insert err")},
 		},
 	}
 	mockCache := &mockCache{}
 	service := NewService(mockService, mockCache)
-	err := service.SetPriceFor("p1", 10)
+	err := service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("10"), money.DefaultCurrency), "tester")
 	assert.Equal(t, "Internal server error.", err.Error())
 }
+
+func TestGetPricesFor_ConvertsAndCachesConversions(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("10")},
+			"p2": {price: money.MustParse("4.5"), currency: "EUR"},
+		},
+		rates: []money.ExchangeRate{
+			{From: "USD", To: "EUR", Rate: money.MustParseRate("0.8625"), UpdatedAt: time.Now()},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge: time.Millisecond * 200,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	prices, _, err := service.GetPricesFor(context.Background(), "EUR", "p1", "p2")
+	assert.Nil(t, err)
+	assert.Equal(t, money.MustParse("8.63"), prices["p1"].Amount)
+	assert.Equal(t, money.Currency("EUR"), prices["p1"].Currency)
+	assert.Equal(t, money.MustParseRate("0.8625"), prices["p1"].Conversion.Rate)
+	assert.Equal(t, money.MustParse("4.5"), prices["p2"].Amount)
+	assert.Nil(t, prices["p2"].Conversion)
+
+	prices, _, err = service.GetPricesFor(context.Background(), "EUR", "p1", "p2")
+	assert.Nil(t, err)
+	assert.Equal(t, money.MustParse("8.63"), prices["p1"].Amount)
+	assertInt(t, 1, mockStorage.getNumCalls(), "wrong number of service calls")
+}
+
+func TestGetPricesFor_RateNotFound(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("10")},
+		},
+	}
+	mockCache := &mockCache{}
+	service := NewService(mockStorage, mockCache)
+	_, _, err := service.GetPricesFor(context.Background(), "GBP", "p1")
+	assert.Equal(t, "Exchange rates not found: USD-GBP.", err.Message)
+}
+
+func TestSetPriceFor_DropsCachedConversions(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("10")},
+		},
+		rates: []money.ExchangeRate{
+			{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	prices, _, _ := service.GetPricesFor(context.Background(), "EUR", "p1")
+	assert.Equal(t, money.MustParse("5"), prices["p1"].Amount)
+
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("20"), money.DefaultCurrency), "tester")
+
+	prices, _, _ = service.GetPricesFor(context.Background(), "EUR", "p1")
+	assert.Equal(t, money.MustParse("10"), prices["p1"].Amount)
+}
+
+func TestSetRate_DropsCachedConversions(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("10")},
+			"p2": {price: money.MustParse("10"), currency: "GBP"},
+		},
+		rates: []money.ExchangeRate{
+			{From: "USD", To: "EUR", Rate: money.MustParseRate("0.5")},
+			{From: "GBP", To: "EUR", Rate: money.MustParseRate("1.2")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	prices, _, _ := service.GetPricesFor(context.Background(), "EUR", "p1", "p2")
+	assert.Equal(t, money.MustParse("5"), prices["p1"].Amount)
+
+	assert.Nil(t, service.SetRate(context.Background(), money.ExchangeRate{From: "USD", To: "EUR", Rate: money.MustParseRate("0.8")}))
+
+	_, ok := mockCache.prices["p1"]["EUR"]
+	assert.False(t, ok, "the conversion with the previous rate should be dropped")
+	_, ok = mockCache.prices["p2"]["EUR"]
+	assert.True(t, ok, "the conversions from other currencies should be kept")
+	prices, _, _ = service.GetPricesFor(context.Background(), "EUR", "p1")
+	assert.Equal(t, money.MustParse("8"), prices["p1"].Amount)
+}
+
+func TestGetPricesAt_BypassesCache(t *testing.T) {
+	mockStorage := &mockStorage{}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("10"), money.DefaultCurrency), "tester")
+	time.Sleep(time.Millisecond * 10)
+	between := time.Now()
+	time.Sleep(time.Millisecond * 10)
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("12"), money.DefaultCurrency), "tester")
+
+	cacheCalls := mockCache.getNumCalls()
+	prices, err := service.GetPricesAt(context.Background(), between, "", "p1")
+	assert.Nil(t, err)
+	assert.Equal(t, money.MustParse("10"), prices["p1"].Amount)
+	assertInt(t, cacheCalls, mockCache.getNumCalls(), "cache must not be used for historical reads")
+
+	_, err = service.GetPricesAt(context.Background(), between.Add(-time.Hour), "", "p1")
+	assert.Equal(t, "Items not found: p1.", err.Message)
+}
+
+func TestGetPriceHistory(t *testing.T) {
+	mockStorage := &mockStorage{}
+	mockCache := &mockCache{}
+	service := NewService(mockStorage, mockCache)
+
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("10"), money.DefaultCurrency), "alice")
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("12"), money.DefaultCurrency), "bob")
+
+	history, err := service.GetPriceHistory(context.Background(), "p1")
+	assert.Nil(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, money.MustParse("12"), history[0].Price.Amount)
+	assert.Equal(t, "bob", history[0].Actor)
+
+	_, err = service.GetPriceHistory(context.Background(), "p2")
+	assert.Equal(t, "Items not found: p2.", err.Message)
+}
+
+func TestSetPriceFor_CachesEffectivePrice(t *testing.T) {
+	mockStorage := &mockStorage{}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("10"), money.DefaultCurrency), "tester")
+	storageCalls := mockStorage.getNumCalls()
+
+	assertAmount(t, money.MustParse("10"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertInt(t, storageCalls, mockStorage.getNumCalls(), "price should be served from the cache")
+}
+
+func TestSchedulePriceFor_CachedPriceDoesNotOutliveWindow(t *testing.T) {
+	mockStorage := &mockStorage{}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("10"), money.DefaultCurrency), "tester")
+	now := time.Now()
+	window := items.Window{From: now, To: now.Add(time.Millisecond * 100)}
+	err := service.SchedulePriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("8"), money.DefaultCurrency), window, "tester")
+	assert.Nil(t, err)
+
+	assertAmount(t, money.MustParse("8"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	storageCalls := mockStorage.getNumCalls()
+
+	time.Sleep(time.Millisecond * 150)
+	mockStorage.mockResults["p1"] = mockResult{price: money.MustParse("10")}
+	assertAmount(t, money.MustParse("10"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	assertInt(t, storageCalls+1, mockStorage.getNumCalls(), "expired window should be read from the storage")
+}
+
+func TestSetPricesFor_WritesInChunks(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p3": {err: errors.New("Insert err")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache, WithBatchSize(2))
+
+	changes := []items.PriceChange{
+		{ItemCode: "p1", Price: items.NewPrice(money.MustParse("1"), money.DefaultCurrency)},
+		{ItemCode: "p2", Price: items.NewPrice(money.MustParse("2"), money.DefaultCurrency)},
+		{ItemCode: "p3", Price: items.NewPrice(money.MustParse("3"), money.DefaultCurrency)},
+		{ItemCode: "p4", Price: items.NewPrice(money.MustParse("4"), money.DefaultCurrency)},
+		{ItemCode: "p5", Price: items.NewPrice(money.MustParse("5"), money.DefaultCurrency)},
+	}
+	results := service.SetPricesFor(context.Background(), changes, "tester")
+
+	assert.Len(t, results, 5)
+	assert.Nil(t, results[0])
+	assert.Nil(t, results[1])
+	assert.Equal(t, "Internal server error.", results[2].Error())
+	assert.Equal(t, "Internal server error.", results[3].Error())
+	assert.Nil(t, results[4])
+
+	// three chunks written plus one read to refresh the cache
+	assertInt(t, 4, mockStorage.getNumCalls(), "wrong number of service calls")
+	assertAmounts(t, []money.Amount{money.MustParse("1"), money.MustParse("2"), money.MustParse("5")},
+		getPricesWithNoErr(t, service, "p1", "p2", "p5"), "wrong price returned")
+	assertInt(t, 4, mockStorage.getNumCalls(), "written prices should be cached")
+}
+
+func TestDeletePricesFor_DropsCachedPrices(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("10")},
+			"p2": {price: money.MustParse("20")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	getPricesWithNoErr(t, service, "p1", "p2")
+
+	err := service.DeletePricesFor(context.Background(), []string{"p1", "p3"}, "tester")
+	assert.Nil(t, err)
+
+	_, _, err = service.GetPricesFor(context.Background(), "", "p1", "p2")
+	assert.Equal(t, "Items not found: p1.", err.Message)
+
+	history, _ := service.GetPriceHistory(context.Background(), "p1")
+	assert.True(t, history[0].Deleted)
+}
+
+func TestDeletePricesFor_CacheErrorAfterStoredDelete(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("10")},
+		},
+	}
+	mockCache := &mockCache{deleteErr: errors.New("Cache circuit open")}
+	service := NewService(mockStorage, mockCache)
+
+	err := service.DeletePricesFor(context.Background(), []string{"p1"}, "tester")
+	assert.Nil(t, err, "a delete stored should not fail because the cache is down")
+	assert.Equal(t, [][]string{{"p1"}}, mockCache.published)
+}
+
+func TestDeletePricesFor_NotFound(t *testing.T) {
+	mockStorage := &mockStorage{}
+	mockCache := &mockCache{}
+	service := NewService(mockStorage, mockCache)
+
+	err := service.DeletePricesFor(context.Background(), []string{"p1", "p2"}, "tester")
+	assert.Equal(t, "Items not found: p1,p2.", err.Message)
+}
+
+// Concurrent cache misses of the same item must share a single storage call
+func TestGetPricesFor_CoalescesConcurrentMisses(t *testing.T) {
+	mockStorage := &mockStorage{
+		callDelay: time.Millisecond * 200,
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("5")},
+			"p2": {price: money.MustParse("7")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	var wg sync.WaitGroup
+	for k := 0; k < 10; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+		}()
+	}
+	wg.Wait()
+
+	assertInt(t, 1, mockStorage.getNumCalls(), "wrong number of service calls")
+	assert.Equal(t, uint64(9), service.Stats().CollapsedCalls)
+}
+
+// A caller only waits for the items in flight, the rest are looked up by itself
+func TestGetPricesFor_CoalescesOverlappingMisses(t *testing.T) {
+	mockStorage := &mockStorage{
+		callDelay: time.Millisecond * 200,
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("5")},
+			"p2": {price: money.MustParse("7")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		getPriceWithNoErr(t, service, "p1")
+	}()
+	time.Sleep(time.Millisecond * 50)
+	assertAmounts(t, []money.Amount{money.MustParse("5"), money.MustParse("7")},
+		getPricesWithNoErr(t, service, "p1", "p2"), "wrong price returned")
+	wg.Wait()
+
+	assertInt(t, 2, mockStorage.getNumCalls(), "wrong number of service calls")
+	assert.Equal(t, uint64(1), service.Stats().CollapsedCalls)
+}
+
+// Every caller waiting for a failed lookup gets the error
+func TestGetPricesFor_CoalescedMissesShareErrors(t *testing.T) {
+	mockStorage := &mockStorage{
+		callDelay: time.Millisecond * 200,
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("5"), err: errors.New("Test error")},
+		},
+	}
+	mockCache := &mockCache{}
+	service := NewService(mockStorage, mockCache)
+
+	var wg sync.WaitGroup
+	for k := 0; k < 5; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := service.GetPricesFor(context.Background(), "", "p1")
+			assert.NotNil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assertInt(t, 1, mockStorage.getNumCalls(), "wrong number of service calls")
+}
+
+// A caller cancelled while looking up items fails, the callers that joined its lookup look them up again
+func TestGetPricesFor_CoalescedMissesOutliveCancelledCaller(t *testing.T) {
+	mockStorage := &mockStorage{
+		callDelay: time.Millisecond * 200,
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("5")},
+		},
+	}
+	mockCache := &mockCache{maxAge: time.Second}
+	service := NewService(mockStorage, mockCache)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _, err := service.GetPricesFor(ctx, "", "p1")
+		assert.NotNil(t, err)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	assertAmount(t, money.MustParse("5"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+	wg.Wait()
+	assertInt(t, 2, mockStorage.getNumCalls(), "wrong number of service calls")
+}
+
+// Stale prices are returned right away and refreshed from the storage in the background
+func TestGetPricesFor_ServesStaleWhileRevalidating(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("5")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge:   time.Millisecond * 100,
+		staleAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	_, status, _ := service.GetPricesFor(context.Background(), "", "p1")
+	assert.Equal(t, CacheMiss, status)
+	_, status, _ = service.GetPricesFor(context.Background(), "", "p1")
+	assert.Equal(t, CacheHit, status)
+
+	time.Sleep(time.Millisecond * 150)
+	mockStorage.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("6"), money.DefaultCurrency), "tester")
+	storageCalls := mockStorage.getNumCalls()
+
+	prices, status, err := service.GetPricesFor(context.Background(), "", "p1")
+	assert.Nil(t, err)
+	assert.Equal(t, CacheStale, status)
+	assert.Equal(t, money.MustParse("5"), prices["p1"].Amount)
+
+	time.Sleep(time.Millisecond * 50)
+	assertInt(t, storageCalls+1, mockStorage.getNumCalls(), "stale price should be refreshed once")
+	prices, status, _ = service.GetPricesFor(context.Background(), "", "p1")
+	assert.Equal(t, CacheHit, status)
+	assert.Equal(t, money.MustParse("6"), prices["p1"].Amount)
+}
+
+// Background refreshes never exceed the concurrency, stale reads do not wait for them
+func TestGetPricesFor_BoundsBackgroundRefreshes(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("5")},
+			"p2": {price: money.MustParse("7")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge:   time.Millisecond * 100,
+		staleAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache, WithRefreshConcurrency(1))
+
+	getPricesWithNoErr(t, service, "p1", "p2")
+	time.Sleep(time.Millisecond * 150)
+	mockStorage.mu.Lock()
+	mockStorage.callDelay = time.Millisecond * 200
+	mockStorage.mu.Unlock()
+	storageCalls := mockStorage.getNumCalls()
+
+	start := time.Now()
+	_, status, _ := service.GetPricesFor(context.Background(), "", "p1")
+	assert.Equal(t, CacheStale, status)
+	_, status, _ = service.GetPricesFor(context.Background(), "", "p2")
+	assert.Equal(t, CacheStale, status)
+	if time.Since(start) > time.Millisecond*100 {
+		t.Error("stale reads took too long, they must not wait for the refresh")
+	}
+
+	time.Sleep(time.Millisecond * 300)
+	assertInt(t, storageCalls+1, mockStorage.getNumCalls(), "only one refresh should have run")
+}
+
+// Items without price are not looked up in the storage again until the missing marker expires
+func TestGetPricesFor_CachesMissingItems(t *testing.T) {
+	mockStorage := &mockStorage{
+		mockResults: map[string]mockResult{
+			"p1": {price: money.MustParse("5")},
+		},
+	}
+	mockCache := &mockCache{
+		maxAge:     time.Second,
+		missingAge: time.Millisecond * 100,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	_, _, err := service.GetPricesFor(context.Background(), "", "p1", "p2")
+	assert.Equal(t, "Items not found: p2.", err.Message)
+	_, status, err := service.GetPricesFor(context.Background(), "", "p1", "p2")
+	assert.Equal(t, "Items not found: p2.", err.Message)
+	assert.Equal(t, CacheHit, status)
+	assertInt(t, 1, mockStorage.getNumCalls(), "missing item should not be looked up again")
+
+	time.Sleep(time.Millisecond * 150)
+	service.GetPricesFor(context.Background(), "", "p2")
+	assertInt(t, 2, mockStorage.getNumCalls(), "expired missing item should be looked up again")
+}
+
+// Setting a price to an item known to have none makes it found right away
+func TestSetPriceFor_ClearsMissingItem(t *testing.T) {
+	mockStorage := &mockStorage{}
+	mockCache := &mockCache{
+		maxAge:     time.Second,
+		missingAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	_, _, err := service.GetPricesFor(context.Background(), "", "p1")
+	assert.NotNil(t, err)
+
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("10"), money.DefaultCurrency), "tester")
+	assertAmount(t, money.MustParse("10"), getPriceWithNoErr(t, service, "p1"), "wrong price returned")
+
+	now := time.Now()
+	window := items.Window{From: now.Add(time.Hour)}
+	service.GetPricesFor(context.Background(), "", "p2")
+	service.SchedulePriceFor(context.Background(), "p2", items.NewPrice(money.MustParse("8"), money.DefaultCurrency), window, "tester")
+	_, isMissing := mockCache.missing["p2"]
+	assert.False(t, isMissing, "a price not effective yet should clear the missing marker too")
+}
+
+// Other instances are told about every change so they evict their local caches
+func TestChanges_InvalidateOtherInstances(t *testing.T) {
+	mockStorage := &mockStorage{}
+	mockCache := &mockCache{
+		maxAge: time.Second,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	service.SetPriceFor(context.Background(), "p1", items.NewPrice(money.MustParse("10"), money.DefaultCurrency), "tester")
+	service.SetPricesFor(context.Background(), []items.PriceChange{
+		{ItemCode: "p2", Price: items.NewPrice(money.MustParse("2"), money.DefaultCurrency)},
+		{ItemCode: "p3", Price: items.NewPrice(money.MustParse("3"), money.DefaultCurrency)},
+	}, "tester")
+	service.DeletePricesFor(context.Background(), []string{"p1"}, "tester")
+	getPricesWithNoErr(t, service, "p2", "p3")
+
+	assert.Equal(t, [][]string{{"p1"}, {"p2", "p3"}, {"p1"}}, mockCache.published)
+}
+
+func TestWarmUp_CachesEveryItemInBatches(t *testing.T) {
+	mockStorage := &mockStorage{mockResults: map[string]mockResult{
+		"p1": {price: money.MustParse("1")},
+		"p2": {price: money.MustParse("2")},
+		"p3": {price: money.MustParse("3")},
+		"p4": {price: money.MustParse("4")},
+		"p5": {price: money.MustParse("5")},
+	}}
+	mockCache := &mockCache{
+		maxAge: time.Minute,
+	}
+	service := NewService(mockStorage, mockCache, WithWarmUp(2, time.Millisecond*10))
+
+	started := time.Now()
+	done, err := service.WarmUp(context.Background(), nil)
+	assert.Nil(t, err)
+	_, err = service.WarmUp(context.Background(), nil)
+	assert.NotNil(t, err, "only one warm-up should run at a time")
+	<-done
+
+	progress := service.WarmUpProgress()
+	assert.False(t, progress.Running)
+	assert.Equal(t, 3, progress.Batches)
+	assert.Equal(t, 5, progress.Cached)
+	assert.Equal(t, 0, progress.Failed)
+	assert.True(t, time.Since(started) >= time.Millisecond*20, "batches should be spaced by the interval")
+
+	calls := mockStorage.getNumCalls()
+	getPricesWithNoErr(t, service, "p1", "p2", "p3", "p4", "p5")
+	assertInt(t, calls, mockStorage.getNumCalls(), "warmed up prices should be served from the cache")
+}
+
+func TestWarmUp_GivenItems(t *testing.T) {
+	mockStorage := &mockStorage{mockResults: map[string]mockResult{
+		"p1": {price: money.MustParse("1")},
+		"p2": {price: money.MustParse("2")},
+	}}
+	mockCache := &mockCache{
+		maxAge:     time.Minute,
+		missingAge: time.Minute,
+	}
+	service := NewService(mockStorage, mockCache)
+
+	done, err := service.WarmUp(context.Background(), []string{"p1", "p9"})
+	assert.Nil(t, err)
+	<-done
+
+	progress := service.WarmUpProgress()
+	assert.Equal(t, 1, progress.Batches)
+	assert.Equal(t, 1, progress.Cached)
+	_, cached := mockCache.prices["p2"]
+	assert.False(t, cached)
+	_, isMissing := mockCache.missing["p9"]
+	assert.True(t, isMissing)
+
+	_, err = service.WarmUp(context.Background(), nil)
+	assert.Nil(t, err, "a warm-up should start once the previous one is over")
+}
+
+func TestWarmUp_CountsOnlyCachedPrices(t *testing.T) {
+	mockStorage := &mockStorage{mockResults: map[string]mockResult{
+		"p1": {price: money.MustParse("1")},
+		"p2": {price: money.MustParse("2")},
+		"p3": {price: money.MustParse("3")},
+	}}
+	mockCache := &mockCache{
+		maxAge: time.Minute,
+		failed: []string{"p2"},
+	}
+	service := NewService(mockStorage, mockCache, WithWarmUp(2, 0))
+
+	done, _ := service.WarmUp(context.Background(), []string{"p1", "p2", "p3"})
+	<-done
+	progress := service.WarmUpProgress()
+	assert.Equal(t, 2, progress.Batches)
+	assert.Equal(t, 2, progress.Cached, "the price that could not be cached should not be counted")
+	assert.Equal(t, 1, progress.Failed)
+
+	mockCache.setErr = errors.New("Cache circuit open")
+	done, _ = service.WarmUp(context.Background(), []string{"p1", "p2", "p3"})
+	<-done
+	progress = service.WarmUpProgress()
+	assert.Equal(t, 0, progress.Cached, "no price should be counted while the cache is down")
+	assert.Equal(t, 2, progress.Failed)
+}
+
+func TestClose_StopsBackgroundWork(t *testing.T) {
+	mockStorage := &mockStorage{mockResults: map[string]mockResult{
+		"p1": {price: money.MustParse("1")},
+		"p2": {price: money.MustParse("2")},
+	}}
+	mockCache := &mockCache{
+		maxAge: time.Minute,
+	}
+	service := NewService(mockStorage, mockCache, WithWarmUp(1, time.Minute)).(*service)
+
+	done, err := service.WarmUp(context.Background(), []string{"p1", "p2"})
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 20)
+
+	closed := make(chan struct{})
+	go func() {
+		service.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close should cancel the warm-up waiting for its next batch")
+	}
+	<-done
+	assert.Equal(t, 1, service.WarmUpProgress().Batches, "no batch should be warmed up once closed")
+
+	done, err = service.WarmUp(context.Background(), nil)
+	assert.Nil(t, err)
+	<-done
+	assert.False(t, service.WarmUpProgress().Running, "no warm-up should start once closed")
+	calls := mockStorage.getNumCalls()
+	assert.Equal(t, CacheStale, service.revalidate(context.Background(), []string{"p1"}))
+	service.Close()
+	assertInt(t, calls, mockStorage.getNumCalls(), "no refresh should start once closed")
+}
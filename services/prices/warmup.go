@@ -0,0 +1,158 @@
+package prices
+
+import (
+	"context"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/domain/items"
+	"github.com/ldegaetano/go-ddd-example/errors"
+	"github.com/ldegaetano/go-ddd-example/logging"
+)
+
+// WarmUp caches in the background the prices of the given items or, when none is given, of every item.
+// Items are read from the storage in batches of warmUpBatchSize started at most once every warmUpInterval
+// so the storage is not saturated. The returned channel is closed when it finishes, the warm-up is not
+// cancelled along with ctx but when the service is closed.
+// Only one warm-up runs at a time, it fails with WarmUpRunning while another one is running.
+func (s *service) WarmUp(ctx context.Context, itemsCode []string) (<-chan struct{}, *errors.CustomError) {
+	s.warmUpMu.Lock()
+	defer s.warmUpMu.Unlock()
+	if s.warmUpProgress.Running {
+		return nil, errors.WarmUpRunning
+	}
+	s.warmUpProgress = WarmUpProgress{Running: true, StartedAt: time.Now()}
+
+	done := make(chan struct{})
+	started := s.background(func() {
+		defer close(done)
+		ctx := s.detach(ctx)
+		s.warmUp(ctx, s.warmUpBatches(ctx, itemsCode))
+
+		s.warmUpMu.Lock()
+		defer s.warmUpMu.Unlock()
+		s.warmUpProgress.Running = false
+		s.warmUpProgress.FinishedAt = time.Now()
+	})
+	if !started {
+		s.warmUpProgress.Running = false
+		s.warmUpProgress.FinishedAt = time.Now()
+		close(done)
+	}
+	return done, nil
+}
+
+// WarmUpProgress returns the progress of the running warm-up or else of the last one
+func (s *service) WarmUpProgress() WarmUpProgress {
+	s.warmUpMu.Lock()
+	defer s.warmUpMu.Unlock()
+	return s.warmUpProgress
+}
+
+// warmUp caches the batches until there are no more, the next one can not be read or ctx is done.
+// Batches go through s.flights so they share the storage reads of concurrent cache misses.
+func (s *service) warmUp(ctx context.Context, next func() ([]string, error)) {
+	for ctx.Err() == nil {
+		started := time.Now()
+		batch, err := next()
+		if err != nil {
+			s.logger.Error(ctx, "warm_up", logging.Err(err))
+			s.recordWarmUp(0, false)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		cached, err := s.warmUpBatch(ctx, batch)
+		if err != nil {
+			s.logger.Warn(ctx, "warm_up_batch", logging.Err(err), logging.F("items", len(batch)))
+		}
+		s.recordWarmUp(cached, err == nil)
+
+		if wait := s.warmUpInterval - time.Since(started); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// warmUpBatch caches the prices of the batch and returns how many were written to the cache, failing when
+// they could not be read or some could not be cached. Items read by a concurrent lookup through s.flights
+// are counted as cached by it.
+func (s *service) warmUpBatch(ctx context.Context, batch []string) (int, error) {
+	notCached := map[string]bool{}
+	var cacheErr error
+	prices, err := s.flights.do(ctx, batch, func(ctx context.Context, itemsCode []string) (map[string]items.Price, error) {
+		prices, err := s.storage.GetPricesFor(ctx, itemsCode)
+		if err != nil {
+			return prices, err
+		}
+		if err := s.cachePrices(ctx, itemsCode, prices); err != nil {
+			cacheErr = err
+			for _, i := range failedItems(err, prices) {
+				notCached[i] = true
+			}
+		}
+		return prices, nil
+	})
+
+	cached := 0
+	for i := range prices {
+		if !notCached[i] {
+			cached++
+		}
+	}
+	if err == nil {
+		err = cacheErr
+	}
+	return cached, err
+}
+
+// failedItems returns the items of prices err tells could not be cached, every one unless it tells which
+func failedItems(err error, prices map[string]items.Price) []string {
+	if partial, ok := err.(partialWriteError); ok {
+		return partial.FailedItems()
+	}
+	failed := make([]string, 0, len(prices))
+	for i := range prices {
+		failed = append(failed, i)
+	}
+	return failed
+}
+
+// warmUpBatches returns a func that returns the next batch of items to warm up, an empty one when there
+// are no more. Without items every item in the storage is warmed up, paging through their codes.
+func (s *service) warmUpBatches(ctx context.Context, itemsCode []string) func() ([]string, error) {
+	if len(itemsCode) > 0 {
+		return func() ([]string, error) {
+			size := s.warmUpBatchSize
+			if size > len(itemsCode) {
+				size = len(itemsCode)
+			}
+			batch := itemsCode[:size]
+			itemsCode = itemsCode[size:]
+			return batch, nil
+		}
+	}
+
+	after := ""
+	return func() ([]string, error) {
+		batch, err := s.storage.GetItemCodes(ctx, after, s.warmUpBatchSize)
+		if len(batch) > 0 {
+			after = batch[len(batch)-1]
+		}
+		return batch, err
+	}
+}
+
+func (s *service) recordWarmUp(cached int, ok bool) {
+	s.warmUpMu.Lock()
+	defer s.warmUpMu.Unlock()
+	s.warmUpProgress.Batches++
+	s.warmUpProgress.Cached += cached
+	if !ok {
+		s.warmUpProgress.Failed++
+	}
+}
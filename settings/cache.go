@@ -0,0 +1,50 @@
+package settings
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+const (
+	// CacheModeRedis caches prices in Redis only
+	CacheModeRedis = "redis"
+	// CacheModeLRU caches prices in process only, Redis is not used
+	CacheModeLRU = "lru"
+	// CacheModeTiered caches prices in process in front of Redis
+	CacheModeTiered = "tiered"
+)
+
+type cacheSettings struct {
+	Mode string `envconfig:"CACHE_MODE" default:"redis"`
+	// LRUSize is how many items the in process cache holds at most
+	LRUSize int `envconfig:"CACHE_LRU_SIZE" default:"10000"`
+	// LRUExpiration is how long prices are kept in process in the tiered mode, in the lru
+	// mode the Redis expirations are used instead
+	LRUExpiration time.Duration `envconfig:"CACHE_LRU_EXPIRATION" default:"5s"`
+	// WarmUpOnStart caches every item price before the server accepts traffic
+	WarmUpOnStart bool `envconfig:"CACHE_WARMUP_ON_START" default:"false"`
+	// WarmUpBatchSize is how many items a warm-up reads from the database at once
+	WarmUpBatchSize int `envconfig:"CACHE_WARMUP_BATCH_SIZE" default:"500"`
+	// WarmUpInterval is the least time between two warm-up batches, so the database is not saturated
+	WarmUpInterval time.Duration `envconfig:"CACHE_WARMUP_INTERVAL" default:"100ms"`
+	// BreakerThreshold is how many calls in a row have to fail to reach Redis to stop calling it
+	// and serve from the database alone, 0 disables the circuit breaker
+	BreakerThreshold int `envconfig:"CACHE_BREAKER_THRESHOLD" default:"5"`
+	// BreakerCooldown is how often Redis is probed while the circuit breaker is open
+	BreakerCooldown time.Duration `envconfig:"CACHE_BREAKER_COOLDOWN" default:"5s"`
+	// CheckInterval is how often the server checks the cache against the database, 0 disables it
+	CheckInterval time.Duration `envconfig:"CACHE_CHECK_INTERVAL" default:"0s"`
+	// CheckRepair fixes the inconsistencies found by the periodic checks
+	CheckRepair bool `envconfig:"CACHE_CHECK_REPAIR" default:"false"`
+	// CheckBatchSize is how many items a check reads at once
+	CheckBatchSize int `envconfig:"CACHE_CHECK_BATCH_SIZE" default:"500"`
+}
+
+var Cache cacheSettings
+
+func init() {
+	if err := envconfig.Process("", &Cache); err != nil {
+		panic(err.Error())
+	}
+}
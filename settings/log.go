@@ -0,0 +1,20 @@
+package settings
+
+import (
+	"github.com/kelseyhightower/envconfig"
+)
+
+type logSettings struct {
+	// Level is the least level logged: debug, info, warn or error
+	Level string `envconfig:"LOG_LEVEL" default:"info"`
+	// Levels overrides Level per package, e.g. "cache:debug,storage:warn"
+	Levels map[string]string `envconfig:"LOG_LEVELS"`
+}
+
+var Log logSettings
+
+func init() {
+	if err := envconfig.Process("", &Log); err != nil {
+		panic(err.Error())
+	}
+}
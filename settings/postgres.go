@@ -1,6 +1,10 @@
 package settings
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type postgresSettings struct {
 	DBName   string `envconfig:"DB_NAME" required:"true"`
@@ -8,6 +12,23 @@ type postgresSettings struct {
 	Password string `envconfig:"DB_PASSWORD" required:"true"`
 	Host     string `envconfig:"DB_HOST" required:"true"`
 	Port     string `envconfig:"DB_PORT" required:"true"`
+	// BatchSize is how many prices of a batch are written per transaction, 0 writes the whole batch in one
+	BatchSize int `envconfig:"DB_BATCH_SIZE" default:"0"`
+	// SSLMode is the libpq sslmode: disable, require, verify-ca or verify-full
+	SSLMode string `envconfig:"DB_SSL_MODE" default:"disable"`
+	// SSLRootCert is the file with the CA certificates verify-ca and verify-full check the server against
+	SSLRootCert string `envconfig:"DB_SSL_ROOT_CERT"`
+	// MaxOpenConns is how many connections are open at most, 0 is unlimited
+	MaxOpenConns int `envconfig:"DB_MAX_OPEN_CONNS" default:"20"`
+	MaxIdleConns int `envconfig:"DB_MAX_IDLE_CONNS" default:"5"`
+	// ConnMaxLifetime is how long a connection is reused before it is closed, 0 reuses it forever
+	ConnMaxLifetime time.Duration `envconfig:"DB_CONN_MAX_LIFETIME" default:"30m"`
+	// ConnectTimeout is how long the database has to answer the ping on startup
+	ConnectTimeout time.Duration `envconfig:"DB_CONNECT_TIMEOUT" default:"5s"`
+	// MigrateOnStart applies the migrations pending when the server starts
+	MigrateOnStart bool `envconfig:"DB_MIGRATE_ON_START" default:"true"`
+	// QueryTimeout is how long reading or writing prices can take before it is cancelled, 0 never cancels it
+	QueryTimeout time.Duration `envconfig:"DB_QUERY_TIMEOUT" default:"5s"`
 }
 
 var Postgres postgresSettings
@@ -7,10 +7,51 @@ import (
 )
 
 type redisSettings struct {
-	Host              string `envconfig:"REDIS_HOST" required:"true"`
-	Port              string `envconfig:"REDIS_PORT" required:"true"`
-	PriceKey          string
-	DefaultExpiration time.Duration
+	Host     string `envconfig:"REDIS_HOST" default:"localhost"`
+	Port     string `envconfig:"REDIS_PORT" default:"6379"`
+	Password string `envconfig:"REDIS_PASSWORD"`
+	// DB is the database selected on a single node or behind Sentinel, a Cluster only has 0
+	DB int `envconfig:"REDIS_DB" default:"0"`
+	// SentinelMaster is the name of the master to connect to through SentinelAddrs, instead of Host
+	SentinelMaster string   `envconfig:"REDIS_SENTINEL_MASTER"`
+	SentinelAddrs  []string `envconfig:"REDIS_SENTINEL_ADDRS"`
+	// ClusterAddrs are the seed nodes of a Cluster to connect to, instead of Host
+	ClusterAddrs []string `envconfig:"REDIS_CLUSTER_ADDRS"`
+	TLS          bool     `envconfig:"REDIS_TLS" default:"false"`
+	// TLSServerName is the name verified in the server certificates, when empty the host of each node dialed
+	TLSServerName         string `envconfig:"REDIS_TLS_SERVER_NAME"`
+	TLSInsecureSkipVerify bool   `envconfig:"REDIS_TLS_INSECURE_SKIP_VERIFY" default:"false"`
+	// PoolSize is how many connections are kept per node, 0 is 10 per CPU
+	PoolSize     int           `envconfig:"REDIS_POOL_SIZE" default:"0"`
+	MinIdleConns int           `envconfig:"REDIS_MIN_IDLE_CONNS" default:"0"`
+	DialTimeout  time.Duration `envconfig:"REDIS_DIAL_TIMEOUT" default:"5s"`
+	ReadTimeout  time.Duration `envconfig:"REDIS_READ_TIMEOUT" default:"3s"`
+	WriteTimeout time.Duration `envconfig:"REDIS_WRITE_TIMEOUT" default:"3s"`
+	// PoolTimeout is how long a command waits for a free connection
+	PoolTimeout time.Duration `envconfig:"REDIS_POOL_TIMEOUT" default:"4s"`
+	// CommandTimeout is how long a call to Redis is waited for before it is given up on, 0 never gives up
+	CommandTimeout time.Duration `envconfig:"REDIS_COMMAND_TIMEOUT" default:"500ms"`
+	// PriceKey is versioned, the version is bumped whenever the cached entries change
+	// in a way older instances cannot read
+	PriceKey string
+	// LegacyPriceKey is where instances before versioned entries cache bare amounts. While LegacyKeys is
+	// on, it is read when PriceKey misses and dropped whenever a price changes, so both kinds of instances
+	// can run together during a rollout.
+	LegacyPriceKey string
+	LegacyKeys     bool `envconfig:"REDIS_LEGACY_KEYS" default:"true"`
+	// InvalidationChannel is where the instances announce the items whose price changed
+	InvalidationChannel string
+	DefaultExpiration   time.Duration
+	// StaleExpiration is how long a price is still served after DefaultExpiration
+	// while it is refreshed in the background, 0 disables serving stale prices
+	StaleExpiration time.Duration `envconfig:"REDIS_STALE_EXPIRATION" default:"0s"`
+	// MissingExpiration is how long items known to have no price are not looked up again, 0 disables it
+	MissingExpiration time.Duration `envconfig:"REDIS_MISSING_EXPIRATION" default:"10s"`
+	// ExpirationJitter is the fraction of DefaultExpiration prices may randomly be kept longer,
+	// so prices cached together are not refreshed together
+	ExpirationJitter float64 `envconfig:"REDIS_EXPIRATION_JITTER" default:"0.1"`
+	// RefreshConcurrency bounds how many background refreshes run at once
+	RefreshConcurrency int `envconfig:"REDIS_REFRESH_CONCURRENCY" default:"4"`
 }
 
 var Redis redisSettings
@@ -20,6 +61,8 @@ func init() {
 		panic(err.Error())
 	}
 
-	Redis.PriceKey = "price:%s"
+	Redis.PriceKey = "prices:v2:%s"
+	Redis.LegacyPriceKey = "price:%s"
+	Redis.InvalidationChannel = "prices:invalidations"
 	Redis.DefaultExpiration = 1 * time.Minute
 }
@@ -0,0 +1,36 @@
+package settings
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type serverSettings struct {
+	// Addr is the address the server listens on
+	Addr string `envconfig:"SERVER_ADDR" default:":8080"`
+	// ReadTimeout is how long reading a request, body included, can take
+	ReadTimeout time.Duration `envconfig:"SERVER_READ_TIMEOUT" default:"5s"`
+	// ReadHeaderTimeout is how long reading the headers of a request can take
+	ReadHeaderTimeout time.Duration `envconfig:"SERVER_READ_HEADER_TIMEOUT" default:"2s"`
+	// WriteTimeout is how long a request can take until its response is written, it should exceed RequestTimeout
+	WriteTimeout time.Duration `envconfig:"SERVER_WRITE_TIMEOUT" default:"15s"`
+	// IdleTimeout is how long an idle keep-alive connection is kept open
+	IdleTimeout time.Duration `envconfig:"SERVER_IDLE_TIMEOUT" default:"60s"`
+	// ReadinessTimeout is how long the readiness check waits for each dependency to answer a ping
+	ReadinessTimeout time.Duration `envconfig:"SERVER_READINESS_TIMEOUT" default:"1s"`
+	// MetricsPath is where the metrics are served in the Prometheus text format
+	MetricsPath string `envconfig:"SERVER_METRICS_PATH" default:"/metrics"`
+	// ShutdownTimeout is how long the requests in flight are waited for on shutdown
+	ShutdownTimeout time.Duration `envconfig:"SERVER_SHUTDOWN_TIMEOUT" default:"15s"`
+	// RequestTimeout is how long a request can take before the work done for it is cancelled, 0 never cancels it
+	RequestTimeout time.Duration `envconfig:"SERVER_REQUEST_TIMEOUT" default:"10s"`
+}
+
+var Server serverSettings
+
+func init() {
+	if err := envconfig.Process("", &Server); err != nil {
+		panic(err.Error())
+	}
+}
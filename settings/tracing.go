@@ -0,0 +1,41 @@
+package settings
+
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+const (
+	// TracingExporterNone does not record spans
+	TracingExporterNone = "none"
+	// TracingExporterStdout writes spans to stdout as JSON lines
+	TracingExporterStdout = "stdout"
+	// TracingExporterOTLP posts spans to an OpenTelemetry collector over OTLP/HTTP
+	TracingExporterOTLP = "otlp"
+)
+
+type tracingSettings struct {
+	Exporter string `envconfig:"TRACING_EXPORTER" default:"none"`
+	// OTLPEndpoint is the OTLP/HTTP traces endpoint of the collector
+	OTLPEndpoint string `envconfig:"TRACING_OTLP_ENDPOINT" default:"http://localhost:4318/v1/traces"`
+	// OTLPTimeout is how long posting a batch of spans to the collector can take
+	OTLPTimeout time.Duration `envconfig:"TRACING_OTLP_TIMEOUT" default:"5s"`
+	// ServiceName names the service in the exported spans
+	ServiceName string `envconfig:"TRACING_SERVICE_NAME" default:"go-ddd-example"`
+	// SampleRatio is the fraction of the traces started here that are recorded, traces started by
+	// a caller follow the caller decision
+	SampleRatio float64 `envconfig:"TRACING_SAMPLE_RATIO" default:"1"`
+	// BatchSize is how many spans are exported at once at most
+	BatchSize int `envconfig:"TRACING_BATCH_SIZE" default:"512"`
+	// FlushInterval is how often the spans ended are exported
+	FlushInterval time.Duration `envconfig:"TRACING_FLUSH_INTERVAL" default:"5s"`
+}
+
+var Tracing tracingSettings
+
+func init() {
+	if err := envconfig.Process("", &Tracing); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,231 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLP span kind, status codes and encoding
+const (
+	otlpKindInternal    = 1
+	otlpStatusUnset     = 0
+	otlpStatusOK        = 1
+	otlpStatusError     = 2
+	otlpScope           = "github.com/ldegaetano/go-ddd-example"
+	otlpJSONContentType = "application/json"
+)
+
+type (
+	// writerExporter writes every span as a line of JSON
+	writerExporter struct {
+		mu sync.Mutex
+		w  io.Writer
+	}
+
+	// otlpExporter posts the spans to an OpenTelemetry collector through OTLP over HTTP, JSON encoded
+	otlpExporter struct {
+		endpoint    string
+		serviceName string
+		client      *http.Client
+	}
+
+	spanJSON struct {
+		TraceID       string                 `json:"trace_id"`
+		SpanID        string                 `json:"span_id"`
+		ParentSpanID  string                 `json:"parent_span_id,omitempty"`
+		Name          string                 `json:"name"`
+		StartTime     time.Time              `json:"start_time"`
+		EndTime       time.Time              `json:"end_time"`
+		DurationMs    float64                `json:"duration_ms"`
+		Attributes    map[string]interface{} `json:"attributes,omitempty"`
+		Status        string                 `json:"status"`
+		StatusMessage string                 `json:"status_message,omitempty"`
+	}
+
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpInstrumentationScope `json:"scope"`
+		Spans []otlpSpan               `json:"spans"`
+	}
+
+	otlpInstrumentationScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+
+	otlpValue struct {
+		StringValue *string         `json:"stringValue,omitempty"`
+		IntValue    *string         `json:"intValue,omitempty"`
+		DoubleValue *float64        `json:"doubleValue,omitempty"`
+		BoolValue   *bool           `json:"boolValue,omitempty"`
+		ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+	}
+
+	otlpArrayValue struct {
+		Values []otlpValue `json:"values"`
+	}
+)
+
+// NewWriterExporter writes the spans to w, one JSON object per line
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{w: w}
+}
+
+// NewOTLPExporter posts the spans of serviceName to the OTLP/HTTP traces endpoint of a collector,
+// e.g. http://localhost:4318/v1/traces
+func NewOTLPExporter(endpoint string, serviceName string, timeout time.Duration) Exporter {
+	return &otlpExporter{endpoint: endpoint, serviceName: serviceName, client: &http.Client{Timeout: timeout}}
+}
+
+func (e *writerExporter) Export(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	encoder := json.NewEncoder(e.w)
+	for _, s := range spans {
+		out := spanJSON{
+			TraceID:       s.TraceID.String(),
+			SpanID:        s.SpanID.String(),
+			Name:          s.Name,
+			StartTime:     s.StartTime,
+			EndTime:       s.EndTime,
+			DurationMs:    float64(s.EndTime.Sub(s.StartTime)) / float64(time.Millisecond),
+			Status:        s.Status,
+			StatusMessage: s.StatusMessage,
+		}
+		if s.ParentSpanID.IsValid() {
+			out.ParentSpanID = s.ParentSpanID.String()
+		}
+		if len(s.Attributes) > 0 {
+			out.Attributes = map[string]interface{}{}
+			for _, a := range s.Attributes {
+				out.Attributes[a.Key] = a.Value
+			}
+		}
+		if err := encoder.Encode(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *otlpExporter) Export(ctx context.Context, spans []SpanData) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for k, s := range spans {
+		otlpSpans[k] = otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+			Status:            otlpStatus{Code: otlpStatusUnset},
+		}
+		if s.ParentSpanID.IsValid() {
+			otlpSpans[k].ParentSpanID = s.ParentSpanID.String()
+		}
+		switch s.Status {
+		case StatusOK:
+			otlpSpans[k].Status.Code = otlpStatusOK
+		case StatusError:
+			otlpSpans[k].Status = otlpStatus{Code: otlpStatusError, Message: s.StatusMessage}
+		}
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{String("service.name", e.serviceName)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpInstrumentationScope{Name: otlpScope}, Spans: otlpSpans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", otlpJSONContentType)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func otlpAttributes(attributes []Attribute) []otlpKeyValue {
+	keyValues := make([]otlpKeyValue, 0, len(attributes))
+	for _, a := range attributes {
+		keyValues = append(keyValues, otlpKeyValue{Key: a.Key, Value: toOTLPValue(a.Value)})
+	}
+	return keyValues
+}
+
+func toOTLPValue(v interface{}) otlpValue {
+	switch value := v.(type) {
+	case string:
+		return otlpValue{StringValue: &value}
+	case int:
+		s := strconv.Itoa(value)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &value}
+	case bool:
+		return otlpValue{BoolValue: &value}
+	case []string:
+		values := make([]otlpValue, len(value))
+		for k := range value {
+			values[k] = toOTLPValue(value[k])
+		}
+		return otlpValue{ArrayValue: &otlpArrayValue{Values: values}}
+	}
+	s := fmt.Sprint(v)
+	return otlpValue{StringValue: &s}
+}
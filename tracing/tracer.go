@@ -0,0 +1,150 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ldegaetano/go-ddd-example/logging"
+	"github.com/ldegaetano/go-ddd-example/settings"
+)
+
+const loggerName = "tracing"
+
+type (
+	// Exporter sends ended spans somewhere, called with a batch at a time and never concurrently
+	Exporter interface {
+		Export(ctx context.Context, spans []SpanData) error
+	}
+
+	// tracer batches the ended spans and exports them every interval or as soon as a batch is full.
+	// Spans ended while the queue is full are dropped rather than slowing down the requests.
+	tracer struct {
+		exporter    Exporter
+		logger      *logging.Logger
+		sampleRatio float64
+		batchSize   int
+		interval    time.Duration
+		queue       chan SpanData
+		stop        chan struct{}
+		stopped     chan struct{}
+	}
+)
+
+var global = struct {
+	mu     sync.RWMutex
+	tracer *tracer
+}{}
+
+// Setup records the spans sampled at sampleRatio, exporting them in batches of up to batchSize every interval.
+// The returned function stops recording and exports the spans left, it must be called before exiting.
+// Spans dropped and export errors are logged through logger.
+func Setup(exporter Exporter, sampleRatio float64, batchSize int, interval time.Duration, logger *logging.Logger) func(ctx context.Context) error {
+	t := &tracer{
+		exporter:    exporter,
+		logger:      logger.Named(loggerName),
+		sampleRatio: sampleRatio,
+		batchSize:   batchSize,
+		interval:    interval,
+		queue:       make(chan SpanData, 4*batchSize),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go t.run()
+
+	global.mu.Lock()
+	global.tracer = t
+	global.mu.Unlock()
+
+	return func(ctx context.Context) error {
+		global.mu.Lock()
+		if global.tracer == t {
+			global.tracer = nil
+		}
+		global.mu.Unlock()
+
+		close(t.stop)
+		select {
+		case <-t.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func current() *tracer {
+	global.mu.RLock()
+	defer global.mu.RUnlock()
+	return global.tracer
+}
+
+func (t *tracer) sample() bool {
+	return sampled(t.sampleRatio)
+}
+
+func (t *tracer) export(span SpanData) {
+	select {
+	case t.queue <- span:
+	default:
+		t.logger.Warn(context.Background(), "tracing_queue_full", logging.F("span", span.Name))
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, t.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(context.Background(), batch); err != nil {
+			t.logger.Error(context.Background(), "tracing_export", logging.Err(err), logging.F("spans", len(batch)))
+		}
+		batch = make([]SpanData, 0, t.batchSize)
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			if batch = append(batch, span); len(batch) >= t.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// FromSettings sets up the exporter selected by settings.Tracing.Exporter, if any. The returned
+// function exports the spans left and must be called before exiting.
+func FromSettings(logger *logging.Logger) (func(ctx context.Context) error, error) {
+	s := settings.Tracing
+	var exporter Exporter
+	switch s.Exporter {
+	case settings.TracingExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case settings.TracingExporterStdout:
+		exporter = NewWriterExporter(os.Stdout)
+	case settings.TracingExporterOTLP:
+		exporter = NewOTLPExporter(s.OTLPEndpoint, s.ServiceName, s.OTLPTimeout)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s", s.Exporter)
+	}
+	return Setup(exporter, s.SampleRatio, s.BatchSize, s.FlushInterval, logger), nil
+}
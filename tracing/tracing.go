@@ -0,0 +1,283 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header carrying the trace and the parent span of a request
+const TraceparentHeader = "traceparent"
+
+// Span status codes, as in OpenTelemetry
+const (
+	StatusUnset = "unset"
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+type (
+	// TraceID identifies a trace, every span of a request shares it
+	TraceID [16]byte
+
+	// SpanID identifies a span within its trace
+	SpanID [8]byte
+
+	// SpanContext is what a span passes on to its children, in process through the context or
+	// across processes through the traceparent header
+	SpanContext struct {
+		TraceID TraceID
+		SpanID  SpanID
+		Sampled bool
+		// Remote is set when the span was started by another process
+		Remote bool
+	}
+
+	// Attribute is a key and value describing a span, values are strings, ints, floats, bools or string slices
+	Attribute struct {
+		Key   string
+		Value interface{}
+	}
+
+	// Span is a timed operation of a trace. A nil span is not recorded, every method on it does nothing,
+	// so spans are only checked for nil to skip computing costly attributes.
+	Span struct {
+		mu         sync.Mutex
+		data       SpanData
+		ended      bool
+		onEnd      func(SpanData)
+		attributes map[string]interface{}
+	}
+
+	// SpanData is a span once ended, as given to the exporters
+	SpanData struct {
+		TraceID       TraceID
+		SpanID        SpanID
+		ParentSpanID  SpanID
+		Name          string
+		StartTime     time.Time
+		EndTime       time.Time
+		Attributes    []Attribute
+		Status        string
+		StatusMessage string
+	}
+
+	spanContextKey struct{}
+)
+
+// Int returns an int attribute
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// String returns a string attribute
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Strings returns a string slice attribute
+func Strings(key string, value []string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool returns a bool attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Start starts a span named name as a child of the span in ctx, or of the remote parent extracted into ctx,
+// and returns it along with a context carrying it. The span is nil when tracing is off or it is not sampled.
+func Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	t := current()
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent, hasParent := SpanContextFrom(ctx)
+	sc := SpanContext{SpanID: newSpanID()}
+	if hasParent {
+		sc.TraceID, sc.Sampled = parent.TraceID, parent.Sampled
+	} else {
+		sc.TraceID, sc.Sampled = newTraceID(), t.sample()
+	}
+	ctx = ContextWithSpanContext(ctx, sc)
+	if !sc.Sampled {
+		return ctx, nil
+	}
+
+	span := &Span{
+		data:       SpanData{TraceID: sc.TraceID, SpanID: sc.SpanID, Name: name, StartTime: time.Now(), Status: StatusUnset},
+		onEnd:      t.export,
+		attributes: map[string]interface{}{},
+	}
+	if hasParent {
+		span.data.ParentSpanID = parent.SpanID
+	}
+	span.SetAttributes(attributes...)
+	return ctx, span
+}
+
+// SetAttributes sets the attributes of the span, replacing the ones with the same key
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range attributes {
+		s.attributes[a.Key] = a.Value
+	}
+}
+
+// RecordError marks the span as failed with err, a nil err does nothing
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Status, s.data.StatusMessage = StatusError, err.Error()
+}
+
+// End ends the span and hands it to the exporter, only the first call counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now()
+	if s.data.Status == StatusUnset {
+		s.data.Status = StatusOK
+	}
+	s.data.Attributes = sortedAttributes(s.attributes)
+	data := s.data
+	s.mu.Unlock()
+
+	s.onEnd(data)
+}
+
+// ContextWithSpanContext returns a context carrying sc as the parent of the spans started with it
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFrom returns the span context carried by ctx, if any
+func SpanContextFrom(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Extract returns a context whose spans are children of the remote span in the traceparent header,
+// ctx itself when the header is missing or invalid
+func Extract(ctx context.Context, traceparent string) context.Context {
+	sc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// ParseTraceparent parses a W3C traceparent header, version-traceid-spanid-flags in lower case hex
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	version, errVersion := hex.DecodeString(parts[0])
+	traceID, errTrace := hex.DecodeString(parts[1])
+	spanID, errSpan := hex.DecodeString(parts[2])
+	flags, errFlags := hex.DecodeString(parts[3])
+	if errVersion != nil || errTrace != nil || errSpan != nil || errFlags != nil ||
+		len(version) != 1 || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 ||
+		strings.ToLower(traceparent) != traceparent {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+
+	sc := SpanContext{Sampled: flags[0]&1 == 1, Remote: true}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	return sc, nil
+}
+
+// Traceparent returns the traceparent header of the span in ctx, empty if there is none
+func Traceparent(ctx context.Context) string {
+	sc, ok := SpanContextFrom(ctx)
+	if !ok {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// IsValid tells if the trace id is not all zeros
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid tells if the span id is not all zeros
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// sampled tells if a new trace is recorded, ratio of them are
+func sampled(ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	const precision = 1 << 53
+	n, err := rand.Int(rand.Reader, big.NewInt(precision))
+	return err == nil && float64(n.Int64()) < ratio*precision
+}
+
+func sortedAttributes(attributes map[string]interface{}) []Attribute {
+	sorted := make([]Attribute, 0, len(attributes))
+	for k, v := range attributes {
+		sorted = append(sorted, Attribute{Key: k, Value: v})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
@@ -0,0 +1,193 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// recorder is an exporter keeping the spans exported
+type recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (r *recorder) Export(ctx context.Context, spans []SpanData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent(testTraceparent)
+	assert.Nil(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.True(t, sc.Remote)
+	assert.Equal(t, testTraceparent, Traceparent(ContextWithSpanContext(context.Background(), sc)))
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+	assert.Equal(t, "", Traceparent(context.Background()))
+}
+
+func TestStart_Off(t *testing.T) {
+	ctx, span := Start(context.Background(), "off")
+
+	assert.Nil(t, span)
+	span.SetAttributes(Int("items.count", 1))
+	span.RecordError(errors.New("ignored"))
+	span.End()
+	_, ok := SpanContextFrom(ctx)
+	assert.False(t, ok)
+}
+
+func TestStart_ChildOfRemoteParent(t *testing.T) {
+	exported := &recorder{}
+	shutdown := Setup(exported, 1, 10, time.Hour, nil)
+
+	ctx := Extract(context.Background(), testTraceparent)
+	ctx, parent := Start(ctx, "handler", Int("items.count", 2))
+	_, child := Start(ctx, "redis", String("call", "get"))
+	child.RecordError(errors.New("Redis get error"))
+	child.End()
+	parent.SetAttributes(String("cache.status", "MISS"), Int("items.count", 3))
+	parent.End()
+	parent.End()
+	assert.Nil(t, shutdown(context.Background()))
+
+	assert.Len(t, exported.spans, 2)
+	redis, handler := exported.spans[0], exported.spans[1]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", handler.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", handler.ParentSpanID.String())
+	assert.Equal(t, handler.TraceID, redis.TraceID)
+	assert.Equal(t, handler.SpanID, redis.ParentSpanID)
+	assert.Equal(t, []Attribute{String("cache.status", "MISS"), Int("items.count", 3)}, handler.Attributes)
+	assert.Equal(t, StatusOK, handler.Status)
+	assert.Equal(t, StatusError, redis.Status)
+	assert.Equal(t, "Redis get error", redis.StatusMessage)
+	assert.False(t, handler.EndTime.Before(handler.StartTime))
+}
+
+func TestStart_NotSampled(t *testing.T) {
+	exported := &recorder{}
+	shutdown := Setup(exported, 1, 10, time.Hour, nil)
+
+	ctx := Extract(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, span := Start(ctx, "handler")
+	assert.Nil(t, span)
+	sc, _ := SpanContextFrom(ctx)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.False(t, sc.Sampled)
+
+	_, span = Start(context.Background(), "root")
+	assert.NotNil(t, span)
+	span.End()
+	assert.Nil(t, shutdown(context.Background()))
+	assert.Len(t, exported.spans, 1)
+
+	shutdown = Setup(exported, 0, 10, time.Hour, nil)
+	_, span = Start(context.Background(), "root")
+	assert.Nil(t, span)
+	assert.Nil(t, shutdown(context.Background()))
+}
+
+func TestWriterExporter(t *testing.T) {
+	out := bytes.Buffer{}
+	shutdown := Setup(NewWriterExporter(&out), 1, 10, time.Hour, nil)
+
+	_, span := Start(Extract(context.Background(), testTraceparent), "postgres.get_prices", Int("items.count", 2))
+	span.End()
+	assert.Nil(t, shutdown(context.Background()))
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", line["trace_id"])
+	assert.Equal(t, "00f067aa0ba902b7", line["parent_span_id"])
+	assert.Equal(t, "postgres.get_prices", line["name"])
+	assert.Equal(t, map[string]interface{}{"items.count": float64(2)}, line["attributes"])
+	assert.Equal(t, StatusOK, line["status"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	// collector stands in for an OpenTelemetry collector receiving OTLP/HTTP JSON
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, otlpJSONContentType, r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer collector.Close()
+	shutdown := Setup(NewOTLPExporter(collector.URL+"/v1/traces", "prices", time.Second), 1, 10, time.Hour, nil)
+
+	_, span := Start(Extract(context.Background(), testTraceparent), "redis.GetPricesFor", Int("items.count", 2), Strings("items.missing", []string{"A1"}))
+	span.RecordError(errors.New("Redis get error"))
+	span.End()
+	assert.Nil(t, shutdown(context.Background()))
+
+	assert.JSONEq(t, `{"resourceSpans": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "prices"}}]},
+		"scopeSpans": [{
+			"scope": {"name": "github.com/ldegaetano/go-ddd-example"},
+			"spans": [{
+				"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+				"spanId": "SPAN_ID",
+				"parentSpanId": "00f067aa0ba902b7",
+				"name": "redis.GetPricesFor",
+				"kind": 1,
+				"startTimeUnixNano": "START",
+				"endTimeUnixNano": "END",
+				"attributes": [
+					{"key": "items.count", "value": {"intValue": "2"}},
+					{"key": "items.missing", "value": {"arrayValue": {"values": [{"stringValue": "A1"}]}}}
+				],
+				"status": {"code": 2, "message": "Redis get error"}
+			}]
+		}]
+	}]}`, string(withoutIDsAndTimes(t, <-received)))
+}
+
+func TestOTLPExporter_CollectorError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	err := NewOTLPExporter(collector.URL, "prices", time.Second).Export(context.Background(), []SpanData{{Name: "span"}})
+	assert.Equal(t, "collector answered 503", err.Error())
+}
+
+// withoutIDsAndTimes replaces the span id and times of the single span exported, they change every run
+func withoutIDsAndTimes(t *testing.T, body []byte) []byte {
+	request := otlpRequest{}
+	assert.Nil(t, json.Unmarshal(body, &request))
+	span := &request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	span.SpanID, span.StartTimeUnixNano, span.EndTimeUnixNano = "SPAN_ID", "START", "END"
+	out, _ := json.Marshal(request)
+	return out
+}
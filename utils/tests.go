@@ -24,18 +24,29 @@ func ChangeWorkDir(path string) {
 }
 
 func ServeTestRequest(method string, endPoint string, payload io.Reader, handler gin.HandlerFunc, queryParams string) *httptest.ResponseRecorder {
+	return ServeTestRequestTo(method, endPoint, endPoint, payload, handler, queryParams, nil)
+}
+
+// ServeTestRequestTo registers the handler in route and sends the request to path,
+// which allows testing routes with params, e.g. route "/items/:code" and path "/items/p1"
+func ServeTestRequestTo(method string, route string, path string, payload io.Reader, handler gin.HandlerFunc, queryParams string, headers map[string]string) *httptest.ResponseRecorder {
 	router := gin.Default()
 	switch method {
 	case "GET":
-		router.GET(endPoint, handler)
+		router.GET(route, handler)
 	case "POST":
-		router.POST(endPoint, handler)
+		router.POST(route, handler)
+	case "DELETE":
+		router.DELETE(route, handler)
 	default:
 		return nil
 	}
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest(method, fmt.Sprintf("%s?%s", endPoint, queryParams), payload)
+	req, _ := http.NewRequest(method, fmt.Sprintf("%s?%s", path, queryParams), payload)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	router.ServeHTTP(w, req)
 
 	return w